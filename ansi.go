@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ansiEscape matches terminal control sequences, CSI ones like colors and
+// cursor movement as well as OSC ones like window titles.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;?]*[ -/]*[@-~]|\x1b\\][^\x07\x1b]*(\x07|\x1b\\\\)|\x1b[@-Z\\\\-_]")
+
+var ansiSgr = regexp.MustCompile("\x1b\\[([0-9;]*)m")
+
+func stripAnsi(line []byte) []byte {
+	return ansiEscape.ReplaceAll(line, nil)
+}
+
+// ansiHtml renders a log with colors as html, bold and the 16 basic colors
+// becoming spans of ansi-bold and ansi-<code> classes, other sequences being
+// dropped.
+func ansiHtml(log []byte) string {
+	out := &strings.Builder{}
+	open := false
+	for len(log) > 0 {
+		loc := ansiEscape.FindIndex(log)
+		if loc == nil {
+			out.WriteString(html.EscapeString(string(log)))
+			break
+		}
+		out.WriteString(html.EscapeString(string(log[:loc[0]])))
+		sgr := ansiSgr.FindSubmatch(log[loc[0]:loc[1]])
+		log = log[loc[1]:]
+		if sgr == nil || len(sgr[0]) != loc[1]-loc[0] {
+			continue
+		}
+
+		classes := []string{}
+		for _, param := range bytes.Split(sgr[1], []byte(";")) {
+			code, _ := strconv.Atoi(string(param))
+			switch {
+			case code == 1:
+				classes = append(classes, "ansi-bold")
+			case code >= 30 && code <= 37, code >= 90 && code <= 97:
+				classes = append(classes, "ansi-"+strconv.Itoa(code))
+			}
+		}
+		if open {
+			out.WriteString("</span>")
+			open = false
+		}
+		if len(classes) > 0 {
+			out.WriteString(`<span class="` + strings.Join(classes, " ") + `">`)
+			open = true
+		}
+	}
+	if open {
+		out.WriteString("</span>")
+	}
+	return out.String()
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestAnsiHtml(t *testing.T) {
+	tests := []struct {
+		log  string
+		want string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"<b>&", "&lt;b&gt;&amp;"},
+		{"\x1b[31mred\x1b[0m", `<span class="ansi-31">red</span>`},
+		{"\x1b[1;32mok\x1b[m done", `<span class="ansi-bold ansi-32">ok</span> done`},
+		{"\x1b[91mbright", `<span class="ansi-91">bright</span>`},
+		{"\x1b[31ma\x1b[34mb", `<span class="ansi-31">a</span><span class="ansi-34">b</span>`},
+		{"\x1b[38;5;200mx", "x"},
+		{"\x1b[2Kcleared", "cleared"},
+		{"\x1b]0;title\x07text", "text"},
+		{"\x1b[31m<x>\x1b[0m", `<span class="ansi-31">&lt;x&gt;</span>`},
+	}
+	for _, test := range tests {
+		if got := ansiHtml([]byte(test.log)); got != test.want {
+			t.Errorf("ansiHtml(%q) = %q, want %q", test.log, got, test.want)
+		}
+	}
+}
+
+func TestStripAnsi(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"plain", "plain"},
+		{"\x1b[1;31merror\x1b[0m: x", "error: x"},
+		{"\x1b]0;title\x1b\\text", "text"},
+		{"\x1b[?25lhidden", "hidden"},
+	}
+	for _, test := range tests {
+		if got := string(stripAnsi([]byte(test.line))); got != test.want {
+			t.Errorf("stripAnsi(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
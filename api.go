@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ApiHandler struct {
+	Store  Store
+	Repos  *RepoSet
+	Tokens []Token
+}
+
+// apiRoutes maps each endpoint to its method, the token scope it needs and
+// the per repo action it is subject to, if any.
+var apiRoutes = map[string]struct {
+	method string
+	scope  string
+	action string
+}{
+	"/api/builds":     {"GET", "read", ""},
+	"/api/coverage":   {"GET", "read", ""},
+	"/api/durations":  {"GET", "read", ""},
+	"/api/diff":       {"GET", "read", ""},
+	"/api/flaky":      {"GET", "read", ""},
+	"/api/feed":       {"GET", "read", ""},
+	"/api/events":     {"GET", "read", ""},
+	"/api/log":        {"GET", "read", "logs"},
+	"/api/search":     {"GET", "read", "logs"},
+	"/api/deliveries": {"GET", "admin", ""},
+	"/api/metrics":    {"GET", "read", ""},
+
+	"/api/builds/{id}/artifacts/{name}": {"GET", "read", "logs"},
+	"/api/deliveries/{id}/replay":       {"POST", "admin", ""},
+	"/api/debug/pprof/":                 {"GET", "admin", ""},
+	"/api/trigger":                      {"POST", "trigger", "trigger"},
+	"/api/cancel":                       {"POST", "cancel", "cancel"},
+	"/api/approve":                      {"POST", "approve", "approve"},
+}
+
+func (h ApiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "spectacle")
+	repos := h.Repos.List()
+
+	path, id, name := r.URL.Path, "", ""
+	if parts := strings.Split(strings.TrimPrefix(path, "/api/builds/"), "/"); strings.HasPrefix(path, "/api/builds/") && len(parts) == 3 && parts[1] == "artifacts" {
+		path, id, name = "/api/builds/{id}/artifacts/{name}", parts[0], parts[2]
+	} else if parts := strings.Split(strings.TrimPrefix(path, "/api/deliveries/"), "/"); strings.HasPrefix(path, "/api/deliveries/") && len(parts) == 2 && parts[1] == "replay" {
+		path, id = "/api/deliveries/{id}/replay", parts[0]
+	} else if strings.HasPrefix(path, "/api/debug/pprof/") {
+		path, id = "/api/debug/pprof/", strings.TrimPrefix(path, "/api/debug/pprof/")
+	}
+	route, ok := apiRoutes[path]
+	if !ok {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	} else if r.Method != route.method {
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := authenticate(h.Tokens, r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+		return
+	} else if !token.Allows(route.scope) {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+	if name := r.URL.Query().Get("repo"); name != "" && !visibleTo(repos, token.Tenant, name) {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	if repo := findRepo(repos, r.URL.Query().Get("repo")); route.action != "" && repo != nil {
+		if !token.Allows("admin") && !repo.Permits(route.action, "token:"+token.Name) {
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	switch path {
+	case "/api/builds":
+		offset, limit := pageOf(r.URL.Query(), 100)
+		writeJson(w, tenantBuilds(repos, token.Tenant, h.Store.Page(r.URL.Query().Get("repo"), offset, limit)))
+	case "/api/deliveries":
+		writeJson(w, tenantDeliveries(repos, token.Tenant, h.Store.Deliveries(r.URL.Query().Get("repo"))))
+	case "/api/coverage":
+		h.serveCoverage(token, w, r)
+	case "/api/durations":
+		h.serveDurations(token, w, r)
+	case "/api/diff":
+		h.serveDiff(w, r)
+	case "/api/flaky":
+		h.serveFlaky(token, w, r)
+	case "/api/feed":
+		h.serveFeed(token, w, r)
+	case "/api/events":
+		h.serveEvents(token, w, r)
+	case "/api/log":
+		serveLog(h.Store, w, r)
+	case "/api/metrics":
+		serveMetrics(w)
+	case "/api/search":
+		h.serveSearch(token, w, r)
+	case "/api/trigger":
+		h.serveTrigger(w, r)
+	case "/api/cancel":
+		h.serveCancel(w, r)
+	case "/api/approve":
+		h.serveApprove(token, w, r)
+	case "/api/builds/{id}/artifacts/{name}":
+		serveArtifact(h.Store, w, r, id, name)
+	case "/api/deliveries/{id}/replay":
+		h.serveReplay(token, w, id)
+	case "/api/debug/pprof/":
+		serveProfile(w, r, id)
+	}
+}
+
+// serveProfile serves the runtime profiles of net/http/pprof. Cpu profiles
+// and traces default to a few seconds so they finish within the server's
+// write timeout.
+func serveProfile(w http.ResponseWriter, r *http.Request, name string) {
+	if (name == "profile" || name == "trace") && r.URL.Query().Get("seconds") == "" {
+		query := r.URL.Query()
+		query.Set("seconds", "5")
+		r.URL.RawQuery = query.Encode()
+	}
+	r.URL.Path = "/debug/pprof/" + name
+
+	switch name {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
+
+// serveReplay handles a verified delivery again as if it had just been
+// received, recording the replay as a delivery of its own.
+func (h ApiHandler) serveReplay(token *Token, w http.ResponseWriter, id string) {
+	var original *Delivery
+	for _, delivery := range tenantDeliveries(h.Repos.List(), token.Tenant, h.Store.Deliveries("")) {
+		if delivery.Id == id {
+			original = &delivery
+			break
+		}
+	}
+	var repo *Repo
+	if original != nil {
+		repo = h.Repos.Find(original.Repo)
+	}
+	raw, err := h.Store.Payload(id)
+	if repo == nil || err != nil {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	payload := GithubPayload{}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	start := time.Now()
+	infof("http", "┌replaying delivery %s\n", id)
+	replay := *original
+	replay.Id = id + "-replay-" + strconv.FormatInt(start.Unix(), 10)
+	replay.Received = start
+	replay.Reason = ""
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	span := startSpan("", "replay")
+	span.Set("spectacle.delivery", id)
+	HookHandler{Repos: h.Repos}.handle(recorder, repo, replay.Event, raw, payload, &replay, span)
+	span.End()
+	replay.Status = recorder.status
+	if err := h.Store.AddDelivery(replay); err != nil {
+		errorf("http", "├could not record delivery, %s\n", err.Error())
+	}
+	infof("http", "└done in %.2fms\n", float64(time.Since(start))/float64(time.Millisecond))
+}
+
+// serveTrigger queues a manual build of a repo's branch, defaulting to the
+// configured one.
+func (h ApiHandler) serveTrigger(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	repo := h.Repos.Find(query.Get("repo"))
+	if repo == nil {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	branch := query.Get("branch")
+	if branch == "" {
+		branch = repo.Branch
+	}
+	build, err := queueBuild(repo, Build{
+		Repo:   repo.Name,
+		Branch: branch,
+	})
+	if err != nil {
+		refuseBuild(w, err)
+		return
+	}
+	infof("queue", "manual build #%d queued for %s|%s\n", build.Number, repo.Name, branch)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(build)
+}
+
+func (h ApiHandler) serveCancel(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	number, _ := strconv.Atoi(query.Get("build"))
+	if !cancelJob(query.Get("repo"), number) {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	infof("queue", "cancelled build #%d of %s\n", number, query.Get("repo"))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveApprove queues a build held for approval or resumes one paused at a
+// gated step.
+func (h ApiHandler) serveApprove(token *Token, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	repo := h.Repos.Find(query.Get("repo"))
+	if repo == nil {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	number, _ := strconv.Atoi(query.Get("build"))
+	build, err := approve(repo, number, "token:"+token.Name)
+	if err == errQueueFull {
+		refuseBuild(w, err)
+		return
+	} else if err != nil {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(build)
+}
+
+// serveLog sends the log of a build, or of a single step when step is given,
+// only its stdout with stream=stdout.
+func serveLog(store Store, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	number, _ := strconv.Atoi(query.Get("build"))
+	build, ok := store.Get(query.Get("repo"), number)
+	if !ok {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	path := build.Log
+	if step := query.Get("step"); step != "" {
+		path = ""
+		for _, result := range build.Steps {
+			if result.Name == step && query.Get("stream") == "stdout" {
+				path = result.Stdout
+			} else if result.Name == step {
+				path = result.Log
+			}
+		}
+	}
+	if path == "" {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeFile(w, r, path)
+}
+
+// serveArtifact sends an artifact of the build numbered id, its signature or
+// the build's checksums, as a download that may be fetched in ranges.
+func serveArtifact(store Store, w http.ResponseWriter, r *http.Request, id, name string) {
+	number, _ := strconv.Atoi(id)
+	build, ok := store.Get(r.URL.Query().Get("repo"), number)
+	if !ok {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	path, etag := "", ""
+	for _, artifact := range build.Artifacts {
+		if artifact.Name == name {
+			path, etag = artifact.Path, artifact.Sha256
+		} else if artifact.Signature != "" && filepath.Base(artifact.Signature) == name {
+			path = artifact.Signature
+		} else if name == checksumFile {
+			path = filepath.Dir(artifact.Path) + "/" + checksumFile
+		}
+	}
+	if path == "" {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	// Artifacts gone from disk, like those of lost build hosts, are served
+	// from the artifact store
+	var content io.ReadSeeker
+	modified := build.Started.Add(build.Duration)
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		if info, err := f.Stat(); err == nil {
+			modified = info.ModTime()
+		}
+		content = f
+	} else if artifactStore != nil {
+		raw, err := artifactStore.Get(artifactKey(path))
+		if err != nil {
+			warnf("http", "could not get artifact %s, %s\n", name, err.Error())
+			http.Error(w, "404 not found", http.StatusNotFound)
+			return
+		}
+		content = bytes.NewReader(raw)
+	} else {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	if etag != "" {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, modified, content)
+}
+
+// serveSearch finds the builds whose logs hold q, oldest first, in the repo
+// given or all those the token may read the logs of.
+func (h ApiHandler) serveSearch(token *Token, w http.ResponseWriter, r *http.Request) {
+	if logIndex == nil {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	repos := h.Repos.List()
+	only := r.URL.Query().Get("repo")
+	writeJson(w, logIndex.Search(r.URL.Query().Get("q"), func(name string) bool {
+		if (only != "" && name != only) || !visibleTo(repos, token.Tenant, name) {
+			return false
+		}
+		repo := findRepo(repos, name)
+		return token.Allows("admin") || repo == nil || repo.Permits("logs", "token:"+token.Name)
+	}))
+}
+
+// serveDiff compares build to with build from of a repo, to defaulting to
+// the latest build and from to the last passing one before it.
+func (h ApiHandler) serveDiff(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	repo := h.Repos.Find(query.Get("repo"))
+	if repo == nil {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	number, _ := strconv.Atoi(query.Get("to"))
+	if number == 0 {
+		number = h.Store.Last(repo.Name)
+	}
+	to, ok := h.Store.Get(repo.Name, number)
+	if !ok {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	from, ok := lastGreen(h.Store, repo.Name, to.Number)
+	if number, _ = strconv.Atoi(query.Get("from")); number != 0 {
+		from, ok = h.Store.Get(repo.Name, number)
+	}
+	if !ok {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	writeJson(w, diffBuilds(repo, from, to))
+}
+
+// serveCoverage lists the coverage trend of a repo, newest build first.
+func (h ApiHandler) serveCoverage(token *Token, w http.ResponseWriter, r *http.Request) {
+	type point struct {
+		Number   int     `json:"number"`
+		Commit   string  `json:"commit"`
+		Coverage float64 `json:"coverage"`
+	}
+
+	trend := make([]point, 0, 100)
+	for _, build := range tenantBuilds(h.Repos.List(), token.Tenant, h.Store.List(r.URL.Query().Get("repo"))) {
+		if build.Coverage != nil {
+			trend = append(trend, point{build.Number, build.Commit, *build.Coverage})
+		}
+	}
+	writeJson(w, trend)
+}
+
+// serveDurations lists the durations of a repo's successful builds, newest
+// first, for spotting slow creep.
+func (h ApiHandler) serveDurations(token *Token, w http.ResponseWriter, r *http.Request) {
+	type point struct {
+		Number   int           `json:"number"`
+		Commit   string        `json:"commit"`
+		Branch   string        `json:"branch"`
+		Duration time.Duration `json:"duration"`
+	}
+
+	trend := make([]point, 0, 100)
+	for _, build := range tenantBuilds(h.Repos.List(), token.Tenant, h.Store.List(r.URL.Query().Get("repo"))) {
+		if build.Status == "OK" {
+			trend = append(trend, point{build.Number, build.Commit, build.Branch, build.Duration})
+		}
+	}
+	writeJson(w, trend)
+}
+
+// serveFlaky counts, per step, how many of a repo's runs of it passed only
+// on a retry.
+func (h ApiHandler) serveFlaky(token *Token, w http.ResponseWriter, r *http.Request) {
+	type count struct {
+		Step  string `json:"step"`
+		Runs  int    `json:"runs"`
+		Flaky int    `json:"flaky"`
+	}
+
+	counts := make([]*count, 0, 10)
+	byStep := make(map[string]*count)
+	for _, build := range tenantBuilds(h.Repos.List(), token.Tenant, h.Store.List(r.URL.Query().Get("repo"))) {
+		for _, step := range build.Steps {
+			if step.Skipped != "" {
+				continue
+			}
+			c, ok := byStep[step.Name]
+			if !ok {
+				c = &count{Step: step.Name}
+				byStep[step.Name] = c
+				counts = append(counts, c)
+			}
+			c.Runs++
+			if step.Flaky {
+				c.Flaky++
+			}
+		}
+	}
+	writeJson(w, counts)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// pageOf reads the 1-based page and per_page of a listing, per_page being
+// capped at 1000.
+func pageOf(query url.Values, perPage int) (int, int) {
+	if n, err := strconv.Atoi(query.Get("per_page")); err == nil && n > 0 {
+		perPage = n
+	}
+	if perPage > 1000 {
+		perPage = 1000
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return (page - 1) * perPage, perPage
+}
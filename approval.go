@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const awaitingApproval = "APPROVAL"
+
+// awaitingGate marks a running build paused at a gated step, approved apart
+// from the held builds so a pull request's "/approve" can't release a deploy.
+const awaitingGate = "GATED"
+
+// firstTimer reports whether a pull request's author association marks them
+// as not yet having contributed to the repo.
+func firstTimer(association string) bool {
+	switch association {
+	case "FIRST_TIME_CONTRIBUTOR", "FIRST_TIMER", "NONE", "":
+		return true
+	}
+	return false
+}
+
+// maintainer reports whether an association may approve builds by comment.
+func maintainer(association string) bool {
+	switch association {
+	case "OWNER", "MEMBER", "COLLABORATOR":
+		return true
+	}
+	return false
+}
+
+// holdBuild records a build that waits for a maintainer's approval before
+// being queued.
+func holdBuild(repo *Repo, build Build) (Build, error) {
+	build, err := allocateBuild(repo, build)
+	if err != nil {
+		return build, err
+	}
+	build.Status = awaitingApproval
+	if err := store.Update(build); err != nil {
+		return build, errors.Wrap(err, "could not hold build")
+	}
+	if token, err := repoToken(*repo); err == nil {
+		if err := postStatus(token, repo.Name, build.Commit, "spectacle", "pending", "awaiting approval"); err != nil {
+			warnf("http", "├%s", err.Error())
+		}
+	}
+	publish(Event{Type: "held", Repo: repo.Name, Number: build.Number, Status: build.Status})
+	return build, nil
+}
+
+// gates holds the running builds paused at a step that needs approval.
+var gates = struct {
+	sync.Mutex
+	waiting map[string]chan string
+}{
+	waiting: make(map[string]chan string),
+}
+
+// awaitApproval pauses job before a gated step until it is approved, the
+// build is cancelled or it times out, reporting who approved.
+func awaitApproval(ctx context.Context, job *BuildJob, step string) (string, error) {
+	key := jobKey(job.Name, job.Build.Number)
+	approved := make(chan string, 1)
+	gates.Lock()
+	gates.waiting[key] = approved
+	gates.Unlock()
+	defer func() {
+		gates.Lock()
+		delete(gates.waiting, key)
+		gates.Unlock()
+	}()
+
+	infof("runner", "├step %s awaits approval\n", step)
+	status := job.Build.Status
+	job.Build.Status = awaitingGate
+	if err := store.Update(job.Build); err != nil {
+		errorf("runner", "├could not update build, %s", err.Error())
+	}
+	publish(Event{Type: "step", Repo: job.Name, Number: job.Build.Number, Step: step, Status: awaitingGate})
+	if err := postStatus(job.token, job.Name, job.Build.Commit, "spectacle/"+step, "pending", "awaiting approval"); err != nil {
+		warnf("runner", "├%s", err.Error())
+	}
+
+	var by string
+	select {
+	case by = <-approved:
+	case <-ctx.Done():
+	}
+	job.Build.Status = status
+	if err := store.Update(job.Build); err != nil {
+		errorf("runner", "├could not update build, %s", err.Error())
+	}
+	if by == "" {
+		return "", errors.New("not approved")
+	}
+	infof("runner", "├step %s approved by %s\n", step, by)
+	return by, nil
+}
+
+// approveGate resumes a build paused at a gated step of this process.
+func approveGate(repo *Repo, number int, by string) (Build, error) {
+	gates.Lock()
+	approved, paused := gates.waiting[jobKey(repo.Name, number)]
+	gates.Unlock()
+	build, _ := store.Get(repo.Name, number)
+	if !paused {
+		return build, errors.Errorf("build #%d is not paused at a gate", number)
+	}
+	select {
+	case approved <- by:
+	default:
+	}
+	return build, nil
+}
+
+// approveBuild queues a build held for approval.
+func approveBuild(repo *Repo, number int, by string) (Build, error) {
+	build, ok := store.Get(repo.Name, number)
+	if !ok || build.Status != awaitingApproval {
+		return build, errors.Errorf("build #%d is not awaiting approval", number)
+	}
+	build.Status = "QUEUED"
+	if err := store.Update(build); err != nil {
+		return build, errors.Wrap(err, "could not update build")
+	}
+	if err := queueWork(newJob(repo, build)); err != nil {
+		build.Status = "DROPPED"
+		store.Update(build)
+		return build, err
+	}
+	infof("queue", "build #%d of %s approved by %s\n", number, repo.Name, by)
+	publish(Event{Type: "queued", Repo: repo.Name, Number: build.Number, Status: build.Status})
+	return build, nil
+}
+
+// approvePull queues the held builds of a pull request, approved by a
+// maintainer's "/approve" comment.
+func approvePull(repo *Repo, pull int, by string) []Build {
+	approved := []Build{}
+	for _, build := range store.List(repo.Name) {
+		if build.Pull != pull || build.Status != awaitingApproval {
+			continue
+		}
+		build, err := approveBuild(repo, build.Number, by)
+		if err != nil {
+			warnf("queue", "├could not queue approved build, %s", err.Error())
+			continue
+		}
+		approved = append(approved, build)
+	}
+	return approved
+}
+
+// approve approves build number of repo, resuming it when paused at a gate
+// and queueing it when held.
+func approve(repo *Repo, number int, by string) (Build, error) {
+	if build, ok := store.Get(repo.Name, number); ok && build.Status == awaitingGate {
+		return approveGate(repo, number, by)
+	}
+	return approveBuild(repo, number, by)
+}
+
+func isApproveComment(body string) bool {
+	return strings.TrimSpace(body) == "/approve"
+}
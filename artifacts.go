@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const artifactDir = "artifacts"
+
+const checksumFile = "SHA256SUMS"
+
+type ObjectStoreConfig struct {
+	Backend          string `ini:"backend"`
+	Bucket           string `ini:"bucket"`
+	Container        string `ini:"container"`
+	Prefix           string `ini:"prefix"`
+	Region           string `ini:"region"`
+	AccessKey        string `ini:"access_key"`
+	SecretKey        string `ini:"secret_key"`
+	Credentials      string `ini:"credentials"`
+	ConnectionString string `ini:"connection_string"`
+	Account          string `ini:"account"`
+	Endpoint         string `ini:"endpoint"`
+	PathStyle        bool   `ini:"path_style"`
+	CaFile           string `ini:"ca_file"`
+}
+
+// ObjectStore keeps copies of artifacts and logs off the build host,
+// artifacts keyed by their paths below the artifact dir.
+type ObjectStore interface {
+	Put(key string, body []byte, contentType string) error
+	Get(key string) ([]byte, error)
+}
+
+var artifactStore ObjectStore
+
+func openObjectStore(config ObjectStoreConfig) (ObjectStore, error) {
+	switch config.Backend {
+	case "s3":
+		return NewS3Bucket(S3Bucket{
+			Bucket:    config.Bucket,
+			Region:    config.Region,
+			Prefix:    config.Prefix,
+			AccessKey: config.AccessKey,
+			SecretKey: config.SecretKey,
+			Endpoint:  config.Endpoint,
+			PathStyle: config.PathStyle,
+			CaFile:    config.CaFile,
+		})
+	case "gcs":
+		return NewGCSBucket(config.Bucket, config.Prefix, config.Credentials)
+	case "azure":
+		return NewAzureContainer(config.Container, config.Prefix, config.ConnectionString, config.Account)
+	default:
+		return nil, errors.Errorf("unknown object store %s, expected s3, gcs or azure", config.Backend)
+	}
+}
+
+func artifactKey(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(path), artifactDir+"/")
+}
+
+type Artifact struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// collectArtifacts copies the files matching the repo's artifact globs, and
+// those produced by builtin steps, out of the checkout before it is removed,
+// writing a SHA256SUMS next to them and signing each when the repo has a
+// signing key and the build is a release, see signsArtifacts.
+func collectArtifacts(job *BuildJob, buildPath string) ([]Artifact, error) {
+	patterns := append([]string{}, job.Repo.Artifacts...)
+	for _, step := range job.Build.Steps {
+		patterns = append(patterns, step.Outputs...)
+	}
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	dir := artifactDir + "/" + workspaceName(job.Repo, job.Name) + "-" + strconv.Itoa(job.Build.Number)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "could not create artifact dir")
+	}
+
+	// Matches are resolved and kept to the checkout, so builds can't have
+	// links to files of the host, or patterns climbing out of it, collected
+	root, err := filepath.EvalSymlinks(buildPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not resolve checkout")
+	}
+	repo := job.Repo
+	if !signsArtifacts(job) {
+		repo.SignWith = ""
+	}
+	artifacts := make([]Artifact, 0, 10)
+	seen := make(map[string]string)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(buildPath + "/" + strings.TrimSpace(pattern))
+		if err != nil {
+			return artifacts, errors.Wrap(err, "bad artifact pattern "+pattern)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			resolved, err := filepath.EvalSymlinks(match)
+			if err != nil {
+				continue
+			}
+			if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				return artifacts, errors.Errorf("artifact %s is outside the checkout", filepath.Base(match))
+			}
+			if info, err := os.Lstat(resolved); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			name := filepath.Base(match)
+			if seen[name] == match {
+				continue
+			} else if seen[name] != "" {
+				return artifacts, errors.Errorf("artifact %s collected twice", name)
+			}
+			seen[name] = match
+
+			artifact, err := copyArtifact(resolved, dir+"/"+name)
+			if err != nil {
+				return artifacts, err
+			}
+			if artifact.Signature, err = signArtifact(repo, artifact.Path); err != nil {
+				return artifacts, err
+			}
+			artifacts = append(artifacts, artifact)
+		}
+	}
+
+	sums := &bytes.Buffer{}
+	for _, artifact := range artifacts {
+		fmt.Fprintf(sums, "%s  %s\n", artifact.Sha256, artifact.Name)
+	}
+	f, err := os.Create(dir + "/" + checksumFile)
+	if err != nil {
+		return artifacts, errors.Wrap(err, "could not write checksums")
+	}
+	_, err = f.Write(sums.Bytes())
+	f.Close()
+	if err != nil {
+		return artifacts, errors.Wrap(err, "could not write checksums")
+	}
+	signature, err := signArtifact(repo, dir+"/"+checksumFile)
+	if err != nil {
+		return artifacts, err
+	}
+	return artifacts, uploadArtifacts(artifacts, dir+"/"+checksumFile, signature)
+}
+
+// uploadArtifacts copies artifacts, their signatures and the other files
+// given to the artifact store, when there is one.
+func uploadArtifacts(artifacts []Artifact, files ...string) error {
+	if artifactStore == nil {
+		return nil
+	}
+	for _, artifact := range artifacts {
+		files = append(files, artifact.Path, artifact.Signature)
+	}
+	for _, path := range files {
+		if path == "" {
+			continue
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "could not read artifact")
+		}
+		if err := artifactStore.Put(artifactKey(path), raw, "application/octet-stream"); err != nil {
+			return errors.Wrap(err, "could not upload artifact")
+		}
+	}
+	return nil
+}
+
+func copyArtifact(from, to string) (Artifact, error) {
+	artifact := Artifact{
+		Name: filepath.Base(to),
+		Path: to,
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return artifact, errors.Wrap(err, "could not open artifact")
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return artifact, errors.Wrap(err, "could not create artifact")
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	if artifact.Size, err = io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		return artifact, errors.Wrap(err, "could not copy artifact")
+	}
+	artifact.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	return artifact, nil
+}
+
+// signsArtifacts reports whether the artifacts of a build get signed, only
+// trusted pushes of tags or the repo's branch being, so code from pull
+// requests never gets a valid signature.
+func signsArtifacts(job *BuildJob) bool {
+	if !trusted(job) || job.Build.Pull > 0 {
+		return false
+	}
+	return job.Build.Tag != "" || job.Branch == job.Repo.Branch
+}
+
+// signArtifact writes a detached signature next to path, with minisign
+// sign_key being the secret key file and with gpg the keyring dir.
+func signArtifact(repo Repo, path string) (string, error) {
+	var cmd *exec.Cmd
+	signature := ""
+	switch repo.SignWith {
+	case "":
+		return "", nil
+	case "minisign":
+		signature = path + ".minisig"
+		cmd = exec.Command("minisign", "-S", "-s", repo.SignKey, "-m", path, "-x", signature)
+	case "gpg":
+		signature = path + ".asc"
+		cmd = exec.Command("gpg", "--batch", "--yes", "--armor", "--detach-sign", "-o", signature, path)
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+repo.SignKey)
+	default:
+		return "", errors.Errorf("unknown signing tool %s", repo.SignWith)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "could not sign %s, %s", filepath.Base(path), bytes.TrimSpace(out))
+	}
+	return signature, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const maxDeliveries = 1000
+
+const maxAuditPayload = 4096
+
+// payloadDir keeps the full payloads of verified deliveries for replays.
+const payloadDir = "payloads"
+
+var deliveryId = regexp.MustCompile("^[0-9A-Za-z-]+$")
+
+type Delivery struct {
+	Id       string            `json:"id"`
+	Received time.Time         `json:"received"`
+	Event    string            `json:"event"`
+	Repo     string            `json:"repo"`
+	Status   int               `json:"status"`
+	Reason   string            `json:"reason"`
+	Headers  map[string]string `json:"headers"`
+	Payload  string            `json:"payload"`
+}
+
+// DeliveryStore is an append only log of received hooks, the latest
+// maxDeliveries being kept in memory for queries.
+type DeliveryStore struct {
+	sync.Mutex
+	file       *os.File
+	deliveries []Delivery
+}
+
+func OpenDeliveryStore(path string) (*DeliveryStore, error) {
+	store := &DeliveryStore{
+		deliveries: make([]Delivery, 0, maxDeliveries),
+	}
+
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			delivery := Delivery{}
+			if err := json.Unmarshal(scanner.Bytes(), &delivery); err != nil {
+				continue
+			}
+			store.append(delivery)
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "could not read delivery log")
+	}
+
+	// Compact the log down to what is kept in memory
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open delivery log")
+	}
+	kept := make(map[string]bool)
+	for _, delivery := range store.deliveries {
+		raw, _ := json.Marshal(delivery)
+		file.Write(append(raw, '\n'))
+		kept[delivery.Id+".json"] = true
+	}
+	store.file = file
+
+	if files, err := ioutil.ReadDir(payloadDir); err == nil {
+		for _, payload := range files {
+			if !kept[payload.Name()] {
+				os.Remove(payloadDir + "/" + payload.Name())
+			}
+		}
+	}
+	return store, nil
+}
+
+func (s *DeliveryStore) SavePayload(id string, raw []byte) error {
+	if !deliveryId.MatchString(id) {
+		return errors.Errorf("bad delivery id %s", id)
+	}
+	os.MkdirAll(payloadDir, os.ModePerm)
+	return errors.Wrap(ioutil.WriteFile(payloadDir+"/"+id+".json", raw, 0600), "could not write payload")
+}
+
+func (s *DeliveryStore) Payload(id string) ([]byte, error) {
+	if !deliveryId.MatchString(id) {
+		return nil, errors.Errorf("bad delivery id %s", id)
+	}
+	raw, err := ioutil.ReadFile(payloadDir + "/" + id + ".json")
+	return raw, errors.Wrap(err, "could not read payload")
+}
+
+func (s *DeliveryStore) append(delivery Delivery) {
+	if len(s.deliveries) >= maxDeliveries {
+		s.deliveries = append(s.deliveries[:0], s.deliveries[1:]...)
+	}
+	s.deliveries = append(s.deliveries, delivery)
+}
+
+func (s *DeliveryStore) AddDelivery(delivery Delivery) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.append(delivery)
+	raw, err := json.Marshal(delivery)
+	if err != nil {
+		return errors.Wrap(err, "could not encode delivery")
+	}
+	_, err = s.file.Write(append(raw, '\n'))
+	return errors.Wrap(err, "could not write delivery")
+}
+
+// Deliveries returns deliveries newest first, optionally filtered by repo.
+func (s *DeliveryStore) Deliveries(repo string) []Delivery {
+	s.Lock()
+	defer s.Unlock()
+
+	result := make([]Delivery, 0, len(s.deliveries))
+	for i := len(s.deliveries) - 1; i >= 0; i-- {
+		if repo == "" || s.deliveries[i].Repo == repo {
+			result = append(result, s.deliveries[i])
+		}
+	}
+	return result
+}
+
+func newDelivery(r *http.Request, received time.Time) Delivery {
+	headers := make(map[string]string)
+	for name := range r.Header {
+		headers[name] = r.Header.Get(name)
+	}
+	for _, name := range secretHeaders {
+		if _, ok := headers[name]; ok {
+			headers[name] = redacted
+		}
+	}
+	return Delivery{
+		Id:       r.Header.Get("X-GitHub-Delivery"),
+		Received: received,
+		Event:    r.Header.Get("X-GitHub-Event"),
+		Headers:  headers,
+	}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
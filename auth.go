@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+type Token struct {
+	Name   string
+	Secret string   `ini:"secret"`
+	Scopes []string `ini:"scopes" delim:","`
+	Tenant string   `ini:"tenant"`
+}
+
+// Allows reports whether the token grants scope, admin granting everything.
+func (t Token) Allows(scope string) bool {
+	for _, s := range t.Scopes {
+		s = strings.TrimSpace(s)
+		if s == scope || s == "admin" {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate finds the token presented as "Authorization: Bearer <secret>",
+// or as the basic auth password for clients like feed readers that only
+// speak basic auth.
+func authenticate(tokens []Token, r *http.Request) (*Token, bool) {
+	header := r.Header.Get("Authorization")
+	var secret []byte
+	if strings.HasPrefix(header, "Bearer ") {
+		secret = []byte(strings.TrimPrefix(header, "Bearer "))
+	} else if _, password, ok := r.BasicAuth(); ok {
+		secret = []byte(password)
+	} else {
+		return nil, false
+	}
+
+	for i := range tokens {
+		if tokens[i].Secret != "" && subtle.ConstantTimeCompare([]byte(tokens[i].Secret), secret) == 1 {
+			return &tokens[i], true
+		}
+	}
+	return nil, false
+}
+
+// Permits reports whether who may perform action on the repo, where action
+// is one of trigger, cancel, approve or logs, logs also covering artifacts.
+// An empty allow list leaves the action to anyone otherwise authorized.
+func (r Repo) Permits(action, who string) bool {
+	var allowed []string
+	switch action {
+	case "trigger":
+		allowed = r.AllowTrigger
+	case "cancel":
+		allowed = r.AllowCancel
+	case "approve":
+		allowed = r.AllowApprove
+	case "logs":
+		allowed = r.AllowLogs
+	}
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, name := range allowed {
+		if strings.TrimSpace(name) == who {
+			return true
+		}
+	}
+	return false
+}
+
+func findRepo(repos []Repo, name string) *Repo {
+	for i := range repos {
+		if repos[i].Name == name {
+			return &repos[i]
+		}
+	}
+	return nil
+}
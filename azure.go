@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const azureVersion = "2020-04-08"
+
+const azureMetadataToken = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fstorage.azure.com%2F"
+
+// AzureContainer keeps objects as block blobs in an Azure storage container,
+// signing requests with the account key of the connection string, or with
+// tokens of the host's managed identity when there is none.
+type AzureContainer struct {
+	sync.Mutex
+	container string
+	prefix    string
+	account   string
+	key       []byte
+	endpoint  string
+	client    *http.Client
+	token     string
+	expires   time.Time
+}
+
+// NewAzureContainer opens container of the account in connection, or of
+// account with a managed identity when connection is empty.
+func NewAzureContainer(container, prefix, connection, account string) (*AzureContainer, error) {
+	if container == "" {
+		return nil, errors.New("azure needs a container")
+	}
+	a := &AzureContainer{
+		container: container,
+		prefix:    strings.Trim(prefix, "/"),
+		account:   account,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	protocol, suffix := "https", "core.windows.net"
+	for _, part := range strings.Split(connection, ";") {
+		pair := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		switch pair[0] {
+		case "AccountName":
+			a.account = pair[1]
+		case "AccountKey":
+			key, err := base64.StdEncoding.DecodeString(pair[1])
+			if err != nil {
+				return nil, errors.Wrap(err, "bad azure account key")
+			}
+			a.key = key
+		case "DefaultEndpointsProtocol":
+			protocol = pair[1]
+		case "EndpointSuffix":
+			suffix = pair[1]
+		case "BlobEndpoint":
+			a.endpoint = strings.TrimSuffix(pair[1], "/")
+		}
+	}
+	if a.account == "" {
+		return nil, errors.Errorf("azure container %s has no account", container)
+	}
+	if connection != "" && a.key == nil {
+		return nil, errors.Errorf("azure connection string for %s has no AccountKey", container)
+	}
+	if a.endpoint == "" {
+		a.endpoint = protocol + "://" + a.account + ".blob." + suffix
+	}
+	return a, nil
+}
+
+func (a *AzureContainer) url(key string) string {
+	if a.prefix != "" {
+		key = a.prefix + "/" + key
+	}
+	segments := strings.Split(a.container+"/"+key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return a.endpoint + "/" + strings.Join(segments, "/")
+}
+
+func (a *AzureContainer) Put(key string, body []byte, contentType string) error {
+	req, err := http.NewRequest("PUT", a.url(key), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "bad azure key "+key)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	_, err = a.do(req)
+	return errors.Wrap(err, "could not put "+key)
+}
+
+func (a *AzureContainer) Get(key string) ([]byte, error) {
+	req, err := http.NewRequest("GET", a.url(key), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad azure key "+key)
+	}
+	body, err := a.do(req)
+	return body, errors.Wrap(err, "could not get "+key)
+}
+
+func (a *AzureContainer) do(req *http.Request) ([]byte, error) {
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureVersion)
+	if a.key != nil {
+		a.sign(req)
+	} else {
+		token, err := a.accessToken()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return nil, errors.New(strings.TrimSpace(resp.Status + " " + string(raw)))
+	}
+	return raw, err
+}
+
+// sign adds the shared key authorization, signing the standard headers, the
+// x-ms ones and the resource.
+func (a *AzureContainer) sign(req *http.Request) {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	names := []string{}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	headers := &strings.Builder{}
+	for _, name := range names {
+		headers.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	resource := "/" + a.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	toSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"",
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		headers.String() + resource,
+	}, "\n")
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(toSign))
+	req.Header.Set("Authorization", "SharedKey "+a.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// accessToken returns a managed identity token for storage, cached until
+// shortly before it expires.
+func (a *AzureContainer) accessToken() (string, error) {
+	a.Lock()
+	defer a.Unlock()
+	if time.Until(a.expires) > time.Minute {
+		return a.token, nil
+	}
+
+	req, _ := http.NewRequest("GET", azureMetadataToken, nil)
+	req.Header.Set("Metadata", "true")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "could not get managed identity token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("could not get managed identity token, %s", resp.Status)
+	}
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in,string"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "could not decode managed identity token")
+	}
+	a.token = token.AccessToken
+	a.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return a.token, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The well known key of the Azurite storage emulator.
+const azuriteKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+func TestAzureContainerSignsWithSharedKey(t *testing.T) {
+	key, _ := base64.StdEncoding.DecodeString(azuriteKey)
+	stored := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		toSign := r.Method + "\n\n\n"
+		if len(body) > 0 {
+			toSign += "3"
+		}
+		toSign += "\n\n" + r.Header.Get("Content-Type") + "\n\n\n\n\n\n\n"
+		if r.Method == "PUT" {
+			toSign += "x-ms-blob-type:BlockBlob\n"
+		}
+		toSign += "x-ms-date:" + r.Header.Get("x-ms-date") + "\nx-ms-version:" + azureVersion + "\n" +
+			"/devstoreaccount1/devstoreaccount1/logs/ci/a%20b.txt"
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(toSign))
+		if want := "SharedKey devstoreaccount1:" + base64.StdEncoding.EncodeToString(mac.Sum(nil)); r.Header.Get("Authorization") != want {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		if r.Method == "PUT" {
+			stored = string(body)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Write([]byte(stored))
+	}))
+	defer server.Close()
+
+	connection := "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=" + azuriteKey + ";BlobEndpoint=" + server.URL + "/devstoreaccount1/;"
+	a, err := NewAzureContainer("logs", "ci", connection, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Put("a b.txt", []byte("log"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := a.Get("a b.txt"); err != nil || string(body) != "log" {
+		t.Errorf("Get = %q, %v", body, err)
+	}
+}
+
+func TestNewAzureContainerConnectionStrings(t *testing.T) {
+	a, err := NewAzureContainer("logs", "", "AccountName=ci;AccountKey="+azuriteKey+";EndpointSuffix=core.chinacloudapi.cn", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := a.url("a/b"); got != "https://ci.blob.core.chinacloudapi.cn/logs/a/b" {
+		t.Errorf("url = %s", got)
+	}
+
+	for _, connection := range []string{"AccountName=ci", "AccountName=ci;AccountKey=%%%", "AccountKey=" + azuriteKey} {
+		if _, err := NewAzureContainer("logs", "", connection, ""); err == nil || !strings.Contains(err.Error(), "azure") {
+			t.Errorf("NewAzureContainer accepted %q, %v", connection, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Backend runs a whole build away from this host, cloning the commit and
+// running spectacle.sh with the build's log streamed back into log.
+type Backend interface {
+	Run(ctx context.Context, job *BuildJob, log io.Writer) error
+}
+
+// backends are the configured remote backends repos pick with "backend",
+// repos without one building locally.
+var backends = map[string]Backend{}
+
+var unsafeName = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// runRemote runs the job on its backend, recording the run as a single step.
+func runRemote(job *BuildJob, name string, backend Backend) error {
+	os.MkdirAll(logDir, os.ModePerm)
+	logFile, err := os.Create(job.Build.Log)
+	if err != nil {
+		errorf("runner", "├could not create build log, %s", err.Error())
+		reportError(errors.Wrap(err, "could not create build log"), job)
+		return errors.Wrap(err, "log create failed")
+	}
+	defer logFile.Close()
+
+	context := "spectacle/" + name
+	if err := postStatus(job.token, job.Name, job.Build.Commit, context, "pending", "running"); err != nil {
+		warnf("runner", "├%s", err.Error())
+	}
+
+	start := time.Now()
+	span := job.span.Child("remote " + name)
+	err = backend.Run(job.ctx, job, logFile)
+	span.Fail(err)
+	span.End()
+	result := StepResult{
+		Name:     name,
+		Duration: time.Since(start),
+		Log:      job.Build.Log,
+	}
+	state := "success"
+	if err != nil {
+		result.ExitCode = 1
+		state = "failure"
+		fmt.Fprintln(logFile, err.Error())
+	}
+	job.Build.Steps = append(job.Build.Steps, result)
+	if err := store.Update(job.Build); err != nil {
+		errorf("runner", "├could not update build, %s", err.Error())
+	}
+
+	publish(Event{Type: "step", Repo: job.Name, Number: job.Build.Number, Step: name, Status: state})
+
+	description := fmt.Sprintf("%s in %.2fs", state, float64(result.Duration)/float64(time.Second))
+	if err := postStatus(job.token, job.Name, job.Build.Commit, context, state, description); err != nil {
+		warnf("runner", "├%s", err.Error())
+	}
+	infof("runner", "├%s %s\n", name, description)
+	return errors.Wrap(err, name+" build failed")
+}
+
+// remoteName names the job's remote run, lowercase and short enough for
+// kubernetes and nomad alike.
+func remoteName(job *BuildJob) string {
+	name := unsafeName.ReplaceAllString(strings.ToLower(workspaceName(job.Repo, job.Name)), "-")
+	if len(name) > 48 {
+		name = name[:48]
+	}
+	return "spectacle-" + strings.Trim(name, "-") + "-" + strconv.Itoa(job.Build.Number)
+}
+
+// remoteEnv is the env a remote build runs with, the same as for local
+// builds plus the url to clone from, the build's own env withheld from
+// untrusted builds. The token to clone with is never part of it, backends
+// handing remoteToken to the build as SPECTACLE_TOKEN by other means.
+func remoteEnv(job *BuildJob) map[string]string {
+	env := map[string]string{
+		"SPECTACLE_CLONE_URL":    job.Url,
+		"SPECTACLE_REPO":         job.Name,
+		"SPECTACLE_BRANCH":       job.Branch,
+		"SPECTACLE_TAG":          job.Build.Tag,
+		"SPECTACLE_COMMIT":       job.Build.Commit,
+		"SPECTACLE_PULL":         strconv.Itoa(job.Build.Pull),
+		"SPECTACLE_PULL_MERGE":   strconv.FormatBool(job.Build.Pull > 0 && job.Repo.PullMerge),
+		"SPECTACLE_BUILD_NUMBER": strconv.Itoa(job.Build.Number),
+	}
+	if !trusted(job) {
+		return env
+	}
+	for _, entry := range job.Build.Env {
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			if _, ok := env[parts[0]]; !ok {
+				env[parts[0]] = parts[1]
+			}
+		}
+	}
+	return env
+}
+
+// remoteToken is the installation token a remote build clones with, none
+// for untrusted builds.
+func remoteToken(job *BuildJob) string {
+	if githubApp == nil || !trusted(job) {
+		return ""
+	}
+	return job.token
+}
+
+// remoteScript checks out the build's commit, or the pull request merged
+// into its base with pull_merge, and runs spectacle.sh, using
+// only the env from remoteEnv and SPECTACLE_TOKEN, which is unset before
+// spectacle.sh runs and never written to the checkout.
+const remoteScript = `set -e
+clone_url="$SPECTACLE_CLONE_URL"
+if [ -n "$SPECTACLE_TOKEN" ]; then clone_url="https://x-access-token:$SPECTACLE_TOKEN@${SPECTACLE_CLONE_URL#https://}"; fi
+unset SPECTACLE_TOKEN
+git clone -q "$clone_url" /tmp/src
+cd /tmp/src
+git remote set-url origin "$SPECTACLE_CLONE_URL"
+if [ "$SPECTACLE_PULL_MERGE" = "true" ]; then
+  git fetch -q "$clone_url" "pull/$SPECTACLE_PULL/merge"
+  git checkout -q FETCH_HEAD
+  if [ -n "$SPECTACLE_COMMIT" ] && [ "$(git rev-parse HEAD^2)" != "$SPECTACLE_COMMIT" ]; then echo "merge ref is not yet updated to $SPECTACLE_COMMIT" >&2; exit 1; fi
+else
+  if [ "$SPECTACLE_PULL" != "0" ]; then git fetch -q "$clone_url" "pull/$SPECTACLE_PULL/head"; fi
+  if [ -n "$SPECTACLE_COMMIT" ]; then git checkout -q "$SPECTACLE_COMMIT"; elif [ -n "$SPECTACLE_BRANCH" ]; then git checkout -q "$SPECTACLE_BRANCH"; fi
+fi
+unset clone_url
+sh spectacle.sh
+`
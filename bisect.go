@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maybeBisect starts bisecting when a branch build fails after a successful
+// build of an older commit, several commits having landed in between.
+func maybeBisect(job *BuildJob) {
+	build := job.Build
+	if !job.Repo.Bisect || build.Status != "FAIL" || build.Bisect || build.Pull > 0 || build.Tag != "" || build.Commit == "" {
+		return
+	}
+
+	for _, previous := range store.List(job.Name) {
+		if previous.Number >= build.Number || previous.Branch != build.Branch || previous.Pull > 0 || previous.Tag != "" || previous.Bisect {
+			continue
+		}
+		if previous.Status == "OK" && previous.Commit != "" && previous.Commit != build.Commit {
+			go (func(repo Repo, good string) {
+				if err := bisect(repo, build, good); err != nil {
+					warnf("queue", "bisect of %s #%d failed, %s\n", build.Repo, build.Number, err.Error())
+				}
+			})(job.Repo, previous.Commit)
+		}
+		if previous.Status == "OK" || previous.Status == "FAIL" {
+			return
+		}
+	}
+}
+
+// bisect builds commits between good and the failed build's until the first
+// bad one is found, recording it on the failed build.
+func bisect(repo Repo, failed Build, good string) error {
+	token, err := repoToken(repo)
+	if err != nil {
+		return err
+	}
+	compare := struct {
+		Commits []struct {
+			Sha string `json:"sha"`
+		} `json:"commits"`
+	}{}
+	if err := githubGet(token, "/repos/"+repo.Name+"/compare/"+good+"..."+failed.Commit, &compare); err != nil {
+		return errors.Wrap(err, "could not compare commits")
+	}
+	if len(compare.Commits) < 2 {
+		return nil
+	}
+	infof("queue", "bisecting %d commits of %s|%s\n", len(compare.Commits), repo.Name, failed.Branch)
+
+	// The last commit is the failed build's, known bad
+	lo, hi := 0, len(compare.Commits)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		status, err := buildAndWait(&repo, Build{
+			Repo:   repo.Name,
+			Branch: failed.Branch,
+			Commit: compare.Commits[mid].Sha,
+			Bisect: true,
+		})
+		if err != nil {
+			return err
+		}
+		switch status {
+		case "OK":
+			lo = mid + 1
+		case "FAIL":
+			hi = mid
+		default:
+			return errors.Errorf("bisect build %s", status)
+		}
+	}
+
+	first := compare.Commits[lo].Sha
+	if current, ok := store.Get(failed.Repo, failed.Number); ok {
+		current.FirstBad = first
+		if err := store.Update(current); err != nil {
+			errorf("queue", "could not update build, %s\n", err.Error())
+		}
+	}
+	infof("queue", "first bad commit of %s|%s is %.7s\n", repo.Name, failed.Branch, first)
+	notify(repo, fmt.Sprintf("%s build #%d on %s failed, first bad commit is %.7s", repo.Name, failed.Number, failed.Branch, first))
+	return nil
+}
+
+// buildAndWait queues build, returning its status once it has finished.
+func buildAndWait(repo *Repo, build Build) (string, error) {
+	build, err := queueBuild(repo, build)
+	if err != nil {
+		return "", errors.Wrap(err, "could not queue bisect build")
+	}
+	for {
+		time.Sleep(5 * time.Second)
+		if current, ok := store.Get(build.Repo, build.Number); ok && current.Status != "QUEUED" && current.Status != "RUNNING" && current.Status != awaitingGate {
+			return current.Status, nil
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// builtinStep is a step spectacle runs itself, named by a step's "uses". It
+// records the files it produced, relative to the checkout, in the result.
+type builtinStep func(ctx context.Context, workspace Workspace, result *StepResult, log io.Writer) error
+
+var builtinSteps = map[string]builtinStep{
+	"sbom":        sbomStep,
+	"govulncheck": vulncheckStep,
+	"release":     releaseStep,
+	"docker":      dockerStep,
+}
+
+func runBuiltin(ctx context.Context, step Step, workspace Workspace, logPath string) (StepResult, error) {
+	result := StepResult{
+		Name: step.Name,
+		Log:  logPath,
+	}
+	if step.Timeout == 0 {
+		step.Timeout = defaultStepTimeout
+	}
+
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return result, errors.Wrap(err, "could not create step log")
+	}
+	defer logFile.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, step.Timeout)
+	defer cancel()
+	start := time.Now()
+	if run, ok := builtinSteps[step.Uses]; ok {
+		err = run(ctx, workspace, &result, logFile)
+	} else {
+		err = runPlugin(ctx, step, workspace, &result, logFile)
+	}
+	result.Duration = time.Since(start)
+	if err != nil {
+		fmt.Fprintln(logFile, err.Error())
+		result.ExitCode = 1
+		result.TimedOut = ctx.Err() == context.DeadlineExceeded
+	}
+	return result, errors.Wrap(err, "step "+step.Name+" failed")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const maxCacheBlob = 1 << 30
+
+var cacheUrl = "http://127.0.0.1:8283/cache/"
+
+var blobKey = regexp.MustCompile("^[0-9a-f]{64}$")
+
+var blobCache *BlobCache
+
+// BlobCache is a content addressed store builds share over HTTP, blobs being
+// named by the hex sha256 of their content. Only running builds may use it,
+// each being granted a token for the duration of its run.
+type BlobCache struct {
+	sync.Mutex
+	dir    string
+	grants map[string]bool
+}
+
+func NewBlobCache(dir string) (*BlobCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "could not create cache dir")
+	}
+	return &BlobCache{
+		dir:    dir,
+		grants: make(map[string]bool),
+	}, nil
+}
+
+func (c *BlobCache) Grant() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	token := hex.EncodeToString(raw)
+
+	c.Lock()
+	c.grants[token] = true
+	c.Unlock()
+	return token
+}
+
+func (c *BlobCache) Revoke(token string) {
+	c.Lock()
+	delete(c.grants, token)
+	c.Unlock()
+}
+
+func (c *BlobCache) path(key string) string {
+	return c.dir + "/" + key[:2] + "/" + key
+}
+
+func (c *BlobCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "spectacle")
+
+	c.Lock()
+	granted := c.grants[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	c.Unlock()
+	if !granted {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/cache/")
+	if !blobKey.MatchString(key) {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if _, err := os.Stat(c.path(key)); err != nil {
+			http.Error(w, "404 not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeFile(w, r, c.path(key))
+	case "PUT":
+		if err := c.put(key, http.MaxBytesReader(w, r.Body, maxCacheBlob)); err != nil {
+			http.Error(w, "400 bad request, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// put stores the blob if its content matches key, writing to a temporary
+// file first so readers never see a partial blob.
+func (c *BlobCache) put(key string, body io.Reader) error {
+	if _, err := os.Stat(c.path(key)); err == nil {
+		io.Copy(ioutil.Discard, body)
+		return nil
+	}
+
+	os.MkdirAll(c.dir+"/"+key[:2], os.ModePerm)
+	tmp, err := ioutil.TempFile(c.dir+"/"+key[:2], ".upload-")
+	if err != nil {
+		return errors.Wrap(err, "could not create blob")
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), body)
+	tmp.Close()
+	if err != nil {
+		return errors.Wrap(err, "could not write blob")
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != key {
+		return errors.New("content does not match key")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), c.path(key)), "could not store blob")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const redacted = "[redacted]"
+
+var secretHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+var secretKeys = []string{"secret", "token", "password", "private_key"}
+
+// captureDelivery dumps a rejected delivery with its full body to the
+// capture dir, redacting credentials in headers and payload.
+func captureDelivery(dir string, delivery Delivery, raw []byte) error {
+	headers := make(map[string]string)
+	for name, value := range delivery.Headers {
+		headers[name] = value
+	}
+	for _, name := range secretHeaders {
+		if _, ok := headers[name]; ok {
+			headers[name] = redacted
+		}
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(raw, &payload); err == nil {
+		payload = redact(payload)
+	} else {
+		payload = string(raw)
+	}
+
+	capture, _ := json.MarshalIndent(map[string]interface{}{
+		"delivery": delivery.Id,
+		"received": delivery.Received,
+		"status":   delivery.Status,
+		"reason":   delivery.Reason,
+		"headers":  headers,
+		"payload":  payload,
+	}, "", "  ")
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "could not create capture dir")
+	}
+	name := delivery.Received.Format("20060102-150405.000000000")
+	if deliveryId.MatchString(delivery.Id) {
+		name += "-" + delivery.Id
+	}
+	return errors.Wrap(ioutil.WriteFile(dir+"/"+name+".json", capture, 0600), "could not write capture")
+}
+
+func redact(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, child := range value {
+			secret := false
+			for _, key := range secretKeys {
+				secret = secret || strings.Contains(strings.ToLower(name), key)
+			}
+			if _, ok := child.(string); secret && ok {
+				value[name] = redacted
+			} else {
+				value[name] = redact(child)
+			}
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = redact(value[i])
+		}
+	}
+	return value
+}
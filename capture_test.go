@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`"token"`, `"token"`},
+		{`{"name": "spectacle"}`, `{"name": "spectacle"}`},
+		{`{"secret": "s", "Token": "t", "db_password": "p", "private_key": "k"}`, `{"secret": "[redacted]", "Token": "[redacted]", "db_password": "[redacted]", "private_key": "[redacted]"}`},
+		{`{"hook": {"config": {"secret": "s", "url": "u"}}}`, `{"hook": {"config": {"secret": "[redacted]", "url": "u"}}}`},
+		{`{"keys": [{"private_key": "k"}, "token"]}`, `{"keys": [{"private_key": "[redacted]"}, "token"]}`},
+		{`{"token": {"value": "v"}, "secret": 1, "password": null}`, `{"token": {"value": "v"}, "secret": 1, "password": null}`},
+		{`[{"access_token": "a"}]`, `[{"access_token": "[redacted]"}]`},
+	}
+	for _, test := range tests {
+		var payload, want interface{}
+		if err := json.Unmarshal([]byte(test.payload), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		if got := redact(payload); !reflect.DeepEqual(got, want) {
+			t.Errorf("redact(%s) = %v, want %s", test.payload, got, test.want)
+		}
+	}
+}
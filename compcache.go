@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type CompilerCacheStats struct {
+	Tool   string `json:"tool"`
+	Hits   int    `json:"hits"`
+	Misses int    `json:"misses"`
+}
+
+// compilerCacheEnv points the repo's configured compiler caches at
+// persistent per repo dirs, zeroing their stats so they count this build only.
+func compilerCacheEnv(repo Repo, pipeline *Pipeline, env []string) ([]string, error) {
+	result := make([]string, 0, 4)
+	for _, tool := range repo.CompilerCache {
+		tool = strings.TrimSpace(tool)
+		dir := cacheDir + "/" + workspaceName(repo, repo.Name) + "/" + tool
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, errors.Wrap(err, "could not create compiler cache")
+		}
+		os.Chown(dir, 1001, 1001)
+		pipeline.Mounts = append(pipeline.Mounts, dir)
+
+		switch tool {
+		case "ccache":
+			result = append(result, "CCACHE_DIR="+dir)
+			if repo.CompilerCacheSize != "" {
+				result = append(result, "CCACHE_MAXSIZE="+repo.CompilerCacheSize)
+			}
+			zero := exec.Command("ccache", "-z")
+			zero.Env = append(append([]string{}, env...), result...)
+			zero.Run()
+		case "sccache":
+			result = append(result, "SCCACHE_DIR="+dir)
+			if repo.CompilerCacheSize != "" {
+				result = append(result, "SCCACHE_CACHE_SIZE="+repo.CompilerCacheSize)
+			}
+		default:
+			return nil, errors.Errorf("unknown compiler cache %s", tool)
+		}
+	}
+	return result, nil
+}
+
+// compilerCacheStats reads the hits and misses of the build's compiler
+// caches, stopping the sccache server the build may have left behind.
+func compilerCacheStats(repo Repo, env []string) []CompilerCacheStats {
+	stats := make([]CompilerCacheStats, 0, 2)
+	for _, tool := range repo.CompilerCache {
+		switch strings.TrimSpace(tool) {
+		case "ccache":
+			cmd := exec.Command("ccache", "--print-stats")
+			cmd.Env = env
+			out, err := cmd.Output()
+			if err != nil {
+				continue
+			}
+			counters := make(map[string]int)
+			scanner := bufio.NewScanner(bytes.NewReader(out))
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				if len(fields) == 2 {
+					counters[fields[0]], _ = strconv.Atoi(fields[1])
+				}
+			}
+			stats = append(stats, CompilerCacheStats{
+				Tool:   "ccache",
+				Hits:   counters["direct_cache_hit"] + counters["preprocessed_cache_hit"],
+				Misses: counters["cache_miss"],
+			})
+		case "sccache":
+			cmd := exec.Command("sccache", "--show-stats", "--stats-format", "json")
+			cmd.Env = env
+			out, err := cmd.Output()
+			stop := exec.Command("sccache", "--stop-server")
+			stop.Env = env
+			stop.Run()
+			if err != nil {
+				continue
+			}
+			report := struct {
+				Stats struct {
+					CacheHits struct {
+						Counts map[string]int `json:"counts"`
+					} `json:"cache_hits"`
+					CacheMisses struct {
+						Counts map[string]int `json:"counts"`
+					} `json:"cache_misses"`
+				} `json:"stats"`
+			}{}
+			if err := json.Unmarshal(out, &report); err != nil {
+				continue
+			}
+			stat := CompilerCacheStats{Tool: "sccache"}
+			for _, count := range report.Stats.CacheHits.Counts {
+				stat.Hits += count
+			}
+			for _, count := range report.Stats.CacheMisses.Counts {
+				stat.Misses += count
+			}
+			stats = append(stats, stat)
+		}
+	}
+	return stats
+}
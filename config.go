@@ -0,0 +1,540 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/pkg/errors"
+)
+
+type Repo struct {
+	Name   string
+	Secret string `ini:"secret"`
+	Branch string `ini:"branch"`
+	Token  string `ini:"token"`
+	GoMode bool   `ini:"go_mode"`
+	Nix    bool   `ini:"nix"`
+
+	// PullMerge builds pull requests merged into their base
+	PullMerge bool `ini:"pull_merge"`
+
+	// Checkout is clone, worktree to check out of the git mirror or fetch
+	// to fetch only the commit built
+	Checkout  string `ini:"checkout"`
+	GitMirror bool   `ini:"git_mirror"`
+
+	Template    string       `ini:"template"`
+	Environment *EnvTemplate `ini:"-"`
+
+	Concurrency int      `ini:"concurrency"`
+	Runner      string   `ini:"runner"`
+	Labels      []string `ini:"labels" delim:","`
+	Tenant      string   `ini:"tenant"`
+	Backend     string   `ini:"backend"`
+	Public      bool     `ini:"public"`
+	ForkBackend string   `ini:"fork_backend"`
+	ForkSecrets bool     `ini:"fork_secrets"`
+	// ForkApproval holds first time contributors' fork builds for approval
+	ForkApproval bool   `ini:"fork_approval"`
+	Policy       string `ini:"policy"`
+	DryRun       bool   `ini:"dry_run"`
+
+	AppArmor string   `ini:"apparmor"`
+	Seccomp  []string `ini:"seccomp" delim:","`
+	Network  string   `ini:"network"`
+
+	DiskQuota   string `ini:"disk_quota"`
+	CpuLimit    string `ini:"cpu_limit"`
+	MemoryLimit string `ini:"memory_limit"`
+
+	BuildTimeout time.Duration `ini:"build_timeout"`
+	GitLogLevel  string        `ini:"git_log_level"`
+	// Ansi is strip to store step logs without terminal escapes, the
+	// default, or keep
+	Ansi    string `ini:"ansi"`
+	Retries int    `ini:"retries"`
+
+	ProtectedDeploys bool   `ini:"protected_deploys"`
+	VerifyCommits    string `ini:"verify_commits"`
+	Tags             bool   `ini:"tags"`
+	VerifyTags       bool   `ini:"verify_tags"`
+	Keyring          string `ini:"keyring"`
+	AllowedSigners   string `ini:"allowed_signers"`
+
+	AllowTrigger []string `ini:"allow_trigger" delim:","`
+	AllowCancel  []string `ini:"allow_cancel" delim:","`
+	AllowLogs    []string `ini:"allow_logs" delim:","`
+	AllowApprove []string `ini:"allow_approve" delim:","`
+
+	CoverageFile      string  `ini:"coverage_file"`
+	CoverageThreshold float64 `ini:"coverage_threshold"`
+	Junit             string  `ini:"junit"`
+	VulnPolicy        string  `ini:"vuln_policy"`
+
+	Artifacts        []string `ini:"artifacts" delim:","`
+	ReleasePlatforms []string `ini:"release_platforms" delim:","`
+	ReleasePackage   string   `ini:"release_package"`
+	DockerImage      string   `ini:"docker_image"`
+	Dockerfile       string   `ini:"dockerfile"`
+	DockerCache      bool     `ini:"docker_cache"`
+	DockerCacheSize  string   `ini:"docker_cache_size"`
+
+	Registries  []string   `ini:"registries" delim:","`
+	Credentials []Registry `ini:"-"`
+	SignWith    string     `ini:"sign_with"`
+	SignKey     string     `ini:"sign_key"`
+
+	Notify        []string `ini:"notify" delim:","`
+	NotifyRules   []string `ini:"notify_rules" delim:","`
+	DurationAlert int      `ini:"duration_alert"`
+	Bisect        bool     `ini:"bisect"`
+
+	CompilerCache     []string `ini:"compiler_cache" delim:","`
+	CompilerCacheSize string   `ini:"compiler_cache_size"`
+}
+
+// RepoSet is the live set of configured repos, shared by the handlers so
+// repos can be added while running.
+type RepoSet struct {
+	sync.RWMutex
+	repos []Repo
+}
+
+func NewRepoSet(repos []Repo) *RepoSet {
+	return &RepoSet{
+		repos: append([]Repo{}, repos...),
+	}
+}
+
+// Find returns a copy of the named repo's config, or nil.
+func (s *RepoSet) Find(name string) *Repo {
+	s.RLock()
+	defer s.RUnlock()
+
+	if repo := findRepo(s.repos, name); repo != nil {
+		copy := *repo
+		return &copy
+	}
+	return nil
+}
+
+func (s *RepoSet) List() []Repo {
+	s.RLock()
+	defer s.RUnlock()
+
+	return append([]Repo{}, s.repos...)
+}
+
+// Add registers repo unless one by that name already exists.
+func (s *RepoSet) Add(repo Repo) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if findRepo(s.repos, repo.Name) != nil {
+		return false
+	}
+	s.repos = append(s.repos, repo)
+	return true
+}
+
+// Replace swaps in a new set of repos, discovered ones being found again
+// on the next discovery.
+func (s *RepoSet) Replace(repos []Repo) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.repos = append([]Repo{}, repos...)
+}
+
+// ServerConfig holds the server wide settings of the [spectacle] section,
+// flags given on the command line taking precedence.
+type ServerConfig struct {
+	Listen        string `ini:"listen"`
+	Workers       int    `ini:"workers"`
+	Workdir       string `ini:"workdir"`
+	LogLevel      string `ini:"log_level"`
+	LogComponents string `ini:"log_components"`
+	DefaultBranch string `ini:"default_branch"`
+	Validation    string `ini:"validation"`
+	LogIndex      int    `ini:"log_index"`
+
+	QueueWaitAlert  time.Duration `ini:"queue_wait_alert"`
+	QueueWaitNotify []string      `ini:"queue_wait_notify" delim:","`
+
+	ReadTimeout       time.Duration `ini:"read_timeout"`
+	ReadHeaderTimeout time.Duration `ini:"read_header_timeout"`
+	WriteTimeout      time.Duration `ini:"write_timeout"`
+	IdleTimeout       time.Duration `ini:"idle_timeout"`
+	MaxConnections    int           `ini:"max_connections"`
+	Http2             bool          `ini:"http2"`
+	TLSCert           string        `ini:"tls_cert"`
+	TLSKey            string        `ini:"tls_key"`
+
+	ReleaseUrl      string `ini:"release_url"`
+	ReleaseKey      string `ini:"release_key"`
+	ReleaseInsecure bool   `ini:"release_insecure"`
+}
+
+type Config struct {
+	Server     ServerConfig
+	Repos      []Repo
+	Tokens     []Token
+	Tenants    []Tenant
+	Dashboard  DashboardConfig
+	Storage    StorageConfig
+	Hooks      HooksConfig
+	GithubApp  *GithubAppConfig
+	Kubernetes *KubernetesConfig
+	Nomad      *NomadConfig
+	MicroVM    *MicroVMConfig
+	Exporter   *ExporterConfig
+	Logs       *LogShippingConfig
+	Artifacts  *ObjectStoreConfig
+	Discovery  []Discovery
+	Routes     []Route
+	Templates  map[string]*EnvTemplate
+	Registries map[string]Registry
+	Sinks      map[string]*Sink
+	Digests    []*Digest
+}
+
+// loadConfig reads spectacle.ini, where sections are repos named by their
+// full name except for the reserved spectacle, dashboard, storage, hooks,
+// github_app, kubernetes, nomad, microvm, events, logs and artifacts
+// sections and the "digest:", "discover:", "env:", "notify:", "registry:",
+// "route:", "tenant:" and "token:" prefixed ones.
+// Sections may also live in files included from the top of spectacle.ini.
+func loadConfig(path string) (*Config, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read config")
+	}
+	cfg.BlockMode = false
+	if err := includeConfigs(cfg, path); err != nil {
+		return nil, err
+	}
+
+	config := &Config{
+		Server: ServerConfig{
+			Listen:        ":8283",
+			Workdir:       "/tmp",
+			DefaultBranch: "master",
+			LogIndex:      50,
+			ReadTimeout:   10 * time.Second,
+			WriteTimeout:  10 * time.Second,
+			Http2:         true,
+		},
+		Repos:      make([]Repo, 0, 10),
+		Tokens:     make([]Token, 0, 4),
+		Tenants:    make([]Tenant, 0, 4),
+		Templates:  make(map[string]*EnvTemplate),
+		Registries: make(map[string]Registry),
+		Sinks:      make(map[string]*Sink),
+	}
+
+	if err := cfg.Section("spectacle").MapTo(&config.Server); err != nil {
+		return nil, errors.Wrap(err, "failed to map spectacle config")
+	}
+	if v := config.Server.Validation; v != "" && v != "strict" && v != "lenient" {
+		return nil, errors.Errorf("unknown validation %s, expected strict or lenient", v)
+	}
+	if (config.Server.TLSCert == "") != (config.Server.TLSKey == "") {
+		return nil, errors.New("tls_cert and tls_key must be set together")
+	}
+
+	// Templates and registries first so repos may reference ones declared
+	// after them
+	for _, section := range cfg.Sections() {
+		if strings.HasPrefix(section.Name(), "registry:") {
+			registry := Registry{
+				Host: strings.TrimPrefix(section.Name(), "registry:"),
+			}
+			if err := section.MapTo(&registry); err != nil {
+				return nil, errors.Wrap(err, "failed to map registry "+registry.Host)
+			}
+			config.Registries[registry.Host] = registry
+			continue
+		}
+		if !strings.HasPrefix(section.Name(), "env:") {
+			continue
+		}
+		template := &EnvTemplate{
+			Name: strings.TrimPrefix(section.Name(), "env:"),
+		}
+		if err := section.MapTo(template); err != nil {
+			return nil, errors.Wrap(err, "failed to map template "+template.Name)
+		}
+		if err := section.MapTo(&template.Defaults); err != nil {
+			return nil, errors.Wrap(err, "failed to map template defaults")
+		}
+		template.Defaults.Template = ""
+		config.Templates[template.Name] = template
+	}
+
+	for _, section := range cfg.Sections() {
+		name := section.Name()
+		if name == "DEFAULT" || name == "spectacle" || strings.HasPrefix(name, "env:") || strings.HasPrefix(name, "registry:") {
+			continue
+		}
+
+		if name == "github_app" {
+			config.GithubApp = &GithubAppConfig{}
+			if err := section.MapTo(config.GithubApp); err != nil {
+				return nil, errors.Wrap(err, "failed to map github app config")
+			}
+			continue
+		}
+
+		if name == "kubernetes" {
+			config.Kubernetes = &KubernetesConfig{}
+			if err := section.MapTo(config.Kubernetes); err != nil {
+				return nil, errors.Wrap(err, "failed to map kubernetes config")
+			}
+			continue
+		}
+
+		if name == "nomad" {
+			config.Nomad = &NomadConfig{}
+			if err := section.MapTo(config.Nomad); err != nil {
+				return nil, errors.Wrap(err, "failed to map nomad config")
+			}
+			continue
+		}
+
+		if name == "microvm" {
+			config.MicroVM = &MicroVMConfig{}
+			if err := section.MapTo(config.MicroVM); err != nil {
+				return nil, errors.Wrap(err, "failed to map microvm config")
+			}
+			continue
+		}
+
+		if name == "events" {
+			config.Exporter = &ExporterConfig{}
+			if err := section.MapTo(config.Exporter); err != nil {
+				return nil, errors.Wrap(err, "failed to map events config")
+			}
+			continue
+		}
+
+		if name == "logs" {
+			config.Logs = &LogShippingConfig{}
+			if err := section.MapTo(config.Logs); err != nil {
+				return nil, errors.Wrap(err, "failed to map logs config")
+			}
+			if err := section.MapTo(&config.Logs.Store); err != nil {
+				return nil, errors.Wrap(err, "failed to map logs config")
+			}
+			continue
+		}
+
+		if name == "artifacts" {
+			config.Artifacts = &ObjectStoreConfig{}
+			if err := section.MapTo(config.Artifacts); err != nil {
+				return nil, errors.Wrap(err, "failed to map artifacts config")
+			}
+			continue
+		}
+
+		if name == "hooks" {
+			if err := section.MapTo(&config.Hooks); err != nil {
+				return nil, errors.Wrap(err, "failed to map hooks config")
+			}
+			continue
+		}
+
+		if name == "storage" {
+			if err := section.MapTo(&config.Storage); err != nil {
+				return nil, errors.Wrap(err, "failed to map storage config")
+			}
+			continue
+		}
+
+		if name == "dashboard" {
+			if err := section.MapTo(&config.Dashboard); err != nil {
+				return nil, errors.Wrap(err, "failed to map dashboard config")
+			}
+			continue
+		}
+
+		if strings.HasPrefix(name, "discover:") {
+			discovery := Discovery{
+				Org:      strings.TrimPrefix(name, "discover:"),
+				Interval: time.Hour,
+			}
+			if err := section.MapTo(&discovery); err != nil {
+				return nil, errors.Wrap(err, "failed to map discovery config")
+			}
+			if err := mapRepo(section, config, &discovery.Defaults); err != nil {
+				return nil, errors.Wrap(err, "failed to map discovery defaults")
+			}
+			config.Discovery = append(config.Discovery, discovery)
+			continue
+		}
+
+		if strings.HasPrefix(name, "notify:") {
+			sink := &Sink{
+				Name: strings.TrimPrefix(name, "notify:"),
+			}
+			if err := section.MapTo(sink); err != nil {
+				return nil, errors.Wrap(err, "failed to map notification sink")
+			}
+			if err := sink.prepare(); err != nil {
+				return nil, err
+			}
+			config.Sinks[sink.Name] = sink
+			continue
+		}
+
+		if strings.HasPrefix(name, "route:") {
+			route := Route{
+				Name: strings.TrimPrefix(name, "route:"),
+			}
+			if err := section.MapTo(&route); err != nil {
+				return nil, errors.Wrap(err, "failed to map route config")
+			}
+			config.Routes = append(config.Routes, route)
+			continue
+		}
+
+		if strings.HasPrefix(name, "digest:") {
+			digest := &Digest{
+				Name:     strings.TrimPrefix(name, "digest:"),
+				Schedule: "daily",
+			}
+			if err := section.MapTo(digest); err != nil {
+				return nil, errors.Wrap(err, "failed to map digest config")
+			}
+			if err := digest.prepare(); err != nil {
+				return nil, err
+			}
+			config.Digests = append(config.Digests, digest)
+			continue
+		}
+
+		if strings.HasPrefix(name, "tenant:") {
+			tenant := Tenant{
+				Name: strings.TrimPrefix(name, "tenant:"),
+			}
+			if err := section.MapTo(&tenant); err != nil {
+				return nil, errors.Wrap(err, "failed to map tenant config")
+			}
+			config.Tenants = append(config.Tenants, tenant)
+			continue
+		}
+
+		if strings.HasPrefix(name, "token:") {
+			token := Token{
+				Name: strings.TrimPrefix(name, "token:"),
+			}
+			if err := section.MapTo(&token); err != nil {
+				return nil, errors.Wrap(err, "failed to map token config")
+			}
+			config.Tokens = append(config.Tokens, token)
+			continue
+		}
+
+		repo := Repo{}
+		if err := mapRepo(section, config, &repo); err != nil {
+			return nil, errors.Wrap(err, "failed to map repo config")
+		}
+		repo.Name = name
+		if repo.Checkout != "" && repo.Checkout != "clone" && repo.Checkout != "worktree" && repo.Checkout != "fetch" {
+			return nil, errors.Errorf("unknown checkout %s of %s", repo.Checkout, name)
+		}
+		if repo.Ansi != "" && repo.Ansi != "strip" && repo.Ansi != "keep" {
+			return nil, errors.Errorf("unknown ansi %s of %s, expected strip or keep", repo.Ansi, name)
+		}
+		if _, err := parseLevel(repo.GitLogLevel); err != nil {
+			return nil, errors.Wrap(err, "bad git_log_level of "+name)
+		}
+		if repo.Branch == "" {
+			repo.Branch = config.Server.DefaultBranch
+		}
+		config.Repos = append(config.Repos, repo)
+	}
+	return config, nil
+}
+
+// mapRepo maps section onto repo, starting from the defaults of the
+// template it references, and resolves the registries it uses.
+func mapRepo(section *ini.Section, config *Config, repo *Repo) error {
+	if name := section.Key("template").String(); name != "" {
+		template, ok := config.Templates[name]
+		if !ok {
+			return errors.Errorf("unknown template %s", name)
+		}
+		*repo = template.Defaults
+		repo.Environment = template
+	}
+	if err := section.MapTo(repo); err != nil {
+		return err
+	}
+
+	repo.Credentials = nil
+	for _, host := range repo.Registries {
+		registry, ok := config.Registries[strings.TrimSpace(host)]
+		if !ok {
+			return errors.Errorf("unknown registry %s", host)
+		}
+		repo.Credentials = append(repo.Credentials, registry)
+	}
+	return nil
+}
+
+// includeConfigs merges the files matching the comma separated globs of the
+// top level include key into cfg, globs being relative to the including
+// file. Each section may be declared in one file only, so teams owning
+// different files cannot silently override one another.
+func includeConfigs(cfg *ini.File, path string) error {
+	origins := make(map[string]string)
+	for _, section := range cfg.Sections() {
+		origins[section.Name()] = path
+	}
+
+	for _, pattern := range cfg.Section("").Key("include").Strings(",") {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return errors.Wrap(err, "bad include "+pattern)
+		}
+		sort.Strings(files)
+
+		for _, file := range files {
+			included, err := ini.Load(file)
+			if err != nil {
+				return errors.Wrap(err, "could not read included config")
+			}
+			for _, section := range included.Sections() {
+				name := section.Name()
+				if name == ini.DEFAULT_SECTION {
+					if len(section.Keys()) > 0 {
+						return errors.Errorf("%s has keys outside of sections", file)
+					}
+					continue
+				}
+				if origin, ok := origins[name]; ok {
+					return errors.Errorf("section %s of %s already declared in %s", name, file, origin)
+				}
+				origins[name] = file
+
+				merged, err := cfg.NewSection(name)
+				if err != nil {
+					return errors.Wrap(err, "could not include section "+name)
+				}
+				for _, key := range section.Keys() {
+					if _, err := merged.NewKey(key.Name(), key.Value()); err != nil {
+						return errors.Wrap(err, "could not include key "+key.Name())
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var coverageLine = regexp.MustCompile(`coverage: ([0-9.]+)% of statements`)
+
+// collectCoverage reads the repo's declared cover profile, falling back to
+// scraping go test output from the step logs.
+func collectCoverage(job *BuildJob, buildPath string) (float64, bool) {
+	if job.Repo.CoverageFile != "" {
+		coverage, err := parseCoverProfile(filepath.Join(buildPath, job.Repo.CoverageFile))
+		if err != nil {
+			warnf("runner", "├no coverage, %s\n", err.Error())
+			return 0, false
+		}
+		return coverage, true
+	}
+
+	paths := make([]string, 0, len(job.Build.Steps))
+	for _, step := range job.Build.Steps {
+		paths = append(paths, step.Log)
+	}
+	return parseCoverOutput(paths...)
+}
+
+// parseCoverProfile computes statement coverage from a go cover profile,
+// blocks seen more than once (merged profiles) counting as covered if any
+// run covered them.
+func parseCoverProfile(path string) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not open coverage file")
+	}
+	defer file.Close()
+
+	type block struct {
+		statements int
+		covered    bool
+	}
+	blocks := make(map[string]block)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "mode:") || line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return 0, errors.Errorf("malformed coverage line %q", line)
+		}
+		statements, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, errors.Wrap(err, "malformed statement count")
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, errors.Wrap(err, "malformed hit count")
+		}
+
+		b := blocks[fields[0]]
+		b.statements = statements
+		b.covered = b.covered || count > 0
+		blocks[fields[0]] = b
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, errors.Wrap(err, "could not read coverage file")
+	}
+
+	total, covered := 0, 0
+	for _, b := range blocks {
+		total += b.statements
+		if b.covered {
+			covered += b.statements
+		}
+	}
+	if total == 0 {
+		return 0, errors.New("no statements in coverage file")
+	}
+	return 100 * float64(covered) / float64(total), nil
+}
+
+// parseCoverOutput averages the per package "coverage: N% of statements"
+// lines go test prints, reporting false if there were none.
+func parseCoverOutput(paths ...string) (float64, bool) {
+	sum, count := 0.0, 0
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			match := coverageLine.FindStringSubmatch(scanner.Text())
+			if match == nil {
+				continue
+			}
+			if percent, err := strconv.ParseFloat(match[1], 64); err == nil {
+				sum += percent
+				count++
+			}
+		}
+		file.Close()
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return sum / float64(count), true
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+var logOutput = struct {
+	sync.Mutex
+	file *os.File
+}{}
+
+// daemonize starts spectacle again detached from the terminal and exits,
+// returning only in the detached process.
+func daemonize() error {
+	if os.Getenv("SPECTACLE_DAEMON") != "" {
+		return nil
+	}
+	binary, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "could not find binary")
+	}
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), "SPECTACLE_DAEMON=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "could not start daemon")
+	}
+	os.Exit(0)
+	return nil
+}
+
+// openLog (re)opens the log file, letting logrotate move the old one away.
+func openLog(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "could not open log")
+	}
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	log.SetOutput(file)
+	if logOutput.file != nil {
+		logOutput.file.Close()
+	}
+	logOutput.file = file
+	return nil
+}
+
+func writePid(path string) error {
+	return errors.Wrap(ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644), "could not write pid file")
+}
+
+func readPid(path string) int {
+	raw, _ := ioutil.ReadFile(path)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(raw)))
+	return pid
+}
+
+// handleSignals reloads the config on SIGHUP, reopens the log on SIGUSR1 and
+// removes the pid file when stopped.
+func handleSignals(repos *RepoSet) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			reloadConfig(repos)
+		case syscall.SIGUSR1:
+			if *logFile != "" {
+				if err := openLog(*logFile); err != nil {
+					errorf("daemon", "could not reopen log, %s\n", err.Error())
+				}
+			}
+		default:
+			killGroups()
+			if *pidFile != "" && readPid(*pidFile) == os.Getpid() {
+				os.Remove(*pidFile)
+			}
+			os.Exit(0)
+		}
+	}
+}
+
+// reloadConfig picks up changed repos, hooks and log level, the rest of the
+// config only being read at start.
+func reloadConfig(repos *RepoSet) {
+	config, err := loadConfig("spectacle.ini")
+	if err != nil {
+		errorf("daemon", "could not reload config, %s\n", err.Error())
+		reportError(errors.Wrap(err, "could not reload config"), nil)
+		return
+	}
+	if err := setLogLevel(config.Server.LogLevel, config.Server.LogComponents); err != nil {
+		errorf("daemon", "could not reload config, %s\n", err.Error())
+		return
+	}
+	if err := setRoutes(config.Routes); err != nil {
+		errorf("daemon", "could not reload config, %s\n", err.Error())
+		return
+	}
+	repos.Replace(config.Repos)
+	setHooks(config.Hooks)
+	infof("daemon", "reloaded config, %d repos\n", len(config.Repos))
+}
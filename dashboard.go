@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DashboardConfig struct {
+	User           string   `ini:"user"`
+	Password       string   `ini:"password"`
+	TrustHeader    string   `ini:"trust_header"`
+	TrustedProxies []string `ini:"trusted_proxies" delim:","`
+	LocalLogin     bool     `ini:"local_login"`
+
+	OAuthClientId     string   `ini:"oauth_client_id"`
+	OAuthClientSecret string   `ini:"oauth_client_secret"`
+	OAuthOrgs         []string `ini:"oauth_orgs" delim:","`
+	OAuthTriggerTeams []string `ini:"oauth_trigger_teams" delim:","`
+}
+
+type DashboardHandler struct {
+	Config  DashboardConfig
+	Store   Store
+	Repos   *RepoSet
+	Tenants []Tenant
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"seconds": func(d time.Duration) string {
+		return fmt.Sprintf("%.2fs", float64(d)/float64(time.Second))
+	},
+	"add": func(a, b int) int {
+		return a + b
+	},
+	"short": func(sha string) string {
+		if len(sha) > 7 {
+			return sha[:7]
+		}
+		return sha
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>spectacle</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+td, th { padding: 0.2em 1em; text-align: left; }
+.OK { color: green; } .FAIL { color: red; }
+</style>
+</head>
+<body>
+<h1>spectacle</h1>
+{{if .User.Trigger}}<form method="post" action="/trigger">
+<input type="hidden" name="csrf" value="{{.Csrf}}">
+<select name="repo">{{range .Repos}}<option>{{.Name}}</option>{{end}}</select>
+<input type="submit" value="trigger build">
+</form>{{end}}
+<form method="get" action="/search">
+<input type="text" name="q"><input type="submit" value="search logs">
+</form>
+<table>
+<tr><th>repo</th><th>build</th><th>branch</th><th>commit</th><th>status</th><th>queued</th><th>duration</th></tr>
+{{range .Builds}}<tr>
+<td>{{.Repo}}</td>
+<td><a href="/log?repo={{.Repo}}&amp;build={{.Number}}">#{{.Number}}</a></td>
+<td>{{.Branch}}</td>
+<td>{{short .Commit}}</td>
+<td class="{{.Status}}">{{.Status}}{{if and $.User.Trigger (or (eq .Status "APPROVAL") (eq .Status "GATED"))}}
+<form method="post" action="/approve"><input type="hidden" name="csrf" value="{{$.Csrf}}"><input type="hidden" name="repo" value="{{.Repo}}"><input type="hidden" name="build" value="{{.Number}}"><input type="submit" value="approve"></form>{{end}}</td>
+<td>{{.Queued.Format "2006-01-02 15:04:05"}}</td>
+<td>{{seconds .Duration}}</td>
+</tr>{{end}}
+</table>
+<p>{{if gt .Page 1}}<a href="/?repo={{.Repo}}&amp;page={{add .Page -1}}">newer</a> {{end}}{{if .More}}<a href="/?repo={{.Repo}}&amp;page={{add .Page 1}}">older</a>{{end}}</p>
+</body>
+</html>
+`))
+
+var logTemplate = template.Must(template.New("log").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>spectacle</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+pre { background: #111; color: #ddd; padding: 1em; }
+.ansi-bold { font-weight: bold; }
+.ansi-30, .ansi-90 { color: #888; } .ansi-31, .ansi-91 { color: #e55; }
+.ansi-32, .ansi-92 { color: #5c5; } .ansi-33, .ansi-93 { color: #dd5; }
+.ansi-34, .ansi-94 { color: #58f; } .ansi-35, .ansi-95 { color: #d5d; }
+.ansi-36, .ansi-96 { color: #5dd; } .ansi-37, .ansi-97 { color: #fff; }
+</style>
+</head>
+<body>
+<h1><a href="/">spectacle</a></h1>
+<p>{{.Build.Repo}} #{{.Build.Number}} step {{.Step}}</p>
+<pre>{{.Log}}</pre>
+</body>
+</html>
+`))
+
+var searchTemplate = template.Must(template.New("search").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>spectacle</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+td, th { padding: 0.2em 1em; text-align: left; vertical-align: top; }
+.OK { color: green; } .FAIL { color: red; }
+</style>
+</head>
+<body>
+<h1><a href="/">spectacle</a></h1>
+<form method="get" action="/search">
+<input type="text" name="q" value="{{.Query}}"><input type="submit" value="search logs">
+</form>
+<table>
+<tr><th>repo</th><th>build</th><th>branch</th><th>status</th><th>queued</th><th>lines</th></tr>
+{{range .Matches}}<tr>
+<td>{{.Repo}}</td>
+<td><a href="/log?repo={{.Repo}}&amp;build={{.Number}}">#{{.Number}}</a></td>
+<td>{{.Branch}}</td>
+<td class="{{.Status}}">{{.Status}}</td>
+<td>{{.Queued.Format "2006-01-02 15:04:05"}}</td>
+<td>{{range .Lines}}{{.Number}}: {{.Text}}<br>{{end}}</td>
+</tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+func (h DashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "spectacle")
+	repos := h.Repos.List()
+
+	if h.Config.OAuthClientId != "" {
+		switch r.URL.Path {
+		case "/login":
+			h.startOAuth(w, r)
+			return
+		case "/oauth/callback":
+			h.finishOAuth(w, r)
+			return
+		}
+	}
+
+	user, ok := h.authenticate(r)
+	if !ok {
+		if h.Config.OAuthClientId != "" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		if h.Config.User != "" || len(h.Tenants) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="spectacle"`)
+		}
+		http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/":
+		query := r.URL.Query()
+		offset, limit := pageOf(query, 100)
+		page := h.Store.Page(query.Get("repo"), offset, limit)
+		builds := tenantBuilds(repos, user.Tenant, page)
+		visible := make([]Repo, 0, len(repos))
+		for _, repo := range repos {
+			if visibleTo(repos, user.Tenant, repo.Name) {
+				visible = append(visible, repo)
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := dashboardTemplate.Execute(w, map[string]interface{}{
+			"Builds": builds,
+			"Repos":  visible,
+			"User":   user,
+			"Csrf":   csrfToken(user),
+			"Repo":   query.Get("repo"),
+			"Page":   offset/limit + 1,
+			"More":   len(page) == limit,
+		})
+		if err != nil {
+			errorf("http", "could not render dashboard, %s\n", err.Error())
+		}
+	case "/log":
+		if !visibleTo(repos, user.Tenant, r.URL.Query().Get("repo")) {
+			http.Error(w, "404 not found", http.StatusNotFound)
+			return
+		}
+		if repo := findRepo(repos, r.URL.Query().Get("repo")); repo != nil && !repo.Permits("logs", user.Name) {
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+			return
+		}
+		if !h.serveColoredLog(w, r) {
+			serveLog(h.Store, w, r)
+		}
+	case "/search":
+		if logIndex == nil {
+			http.Error(w, "404 not found", http.StatusNotFound)
+			return
+		}
+		query := r.URL.Query().Get("q")
+		matches := logIndex.Search(query, func(name string) bool {
+			repo := findRepo(repos, name)
+			return visibleTo(repos, user.Tenant, name) && (repo == nil || repo.Permits("logs", user.Name))
+		})
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := searchTemplate.Execute(w, map[string]interface{}{
+			"Query":   query,
+			"Matches": matches,
+		})
+		if err != nil {
+			errorf("http", "could not render search, %s\n", err.Error())
+		}
+	case "/trigger":
+		h.serveTrigger(user, w, r)
+	case "/approve":
+		h.serveApprove(user, w, r)
+	case "/logout":
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "/", http.StatusFound)
+	default:
+		http.Error(w, "404 not found", http.StatusNotFound)
+	}
+}
+
+// serveColoredLog renders the log of a step with the colors its output had,
+// reporting false when no copy of it kept them.
+func (h DashboardHandler) serveColoredLog(w http.ResponseWriter, r *http.Request) bool {
+	query := r.URL.Query()
+	number, _ := strconv.Atoi(query.Get("build"))
+	build, ok := h.Store.Get(query.Get("repo"), number)
+	if !ok || query.Get("step") == "" {
+		return false
+	}
+	for _, result := range build.Steps {
+		if result.Name != query.Get("step") || result.Colored == "" {
+			continue
+		}
+		raw, err := ioutil.ReadFile(result.Colored)
+		if err != nil {
+			return false
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = logTemplate.Execute(w, map[string]interface{}{
+			"Build": build,
+			"Step":  result.Name,
+			"Log":   template.HTML(ansiHtml(raw)),
+		})
+		if err != nil {
+			errorf("http", "could not render log, %s\n", err.Error())
+		}
+		return true
+	}
+	return false
+}
+
+// allowPost checks a form was posted from the dashboard itself, from the
+// same origin with the user's csrf token, rather than by another site
+// riding on the user's credentials.
+func allowPost(user dashboardUser, w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin != "" {
+		if parsed, err := url.Parse(origin); err != nil || parsed.Host != r.Host {
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(csrfToken(user))) != 1 {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (h DashboardHandler) serveTrigger(user dashboardUser, w http.ResponseWriter, r *http.Request) {
+	if !allowPost(user, w, r) {
+		return
+	} else if !user.Trigger {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+
+	repo := h.Repos.Find(r.FormValue("repo"))
+	if repo == nil || !visibleTo(h.Repos.List(), user.Tenant, repo.Name) {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	} else if !repo.Permits("trigger", user.Name) {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+
+	build, err := queueBuild(repo, Build{
+		Repo:   repo.Name,
+		Branch: repo.Branch,
+	})
+	if err != nil {
+		refuseBuild(w, err)
+		return
+	}
+	infof("queue", "manual build #%d queued for %s by %s\n", build.Number, build.Repo, user.Name)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (h DashboardHandler) serveApprove(user dashboardUser, w http.ResponseWriter, r *http.Request) {
+	if !allowPost(user, w, r) {
+		return
+	} else if !user.Trigger {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+
+	repo := h.Repos.Find(r.FormValue("repo"))
+	if repo == nil || !visibleTo(h.Repos.List(), user.Tenant, repo.Name) {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	} else if !repo.Permits("approve", user.Name) {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+
+	number, _ := strconv.Atoi(r.FormValue("build"))
+	if _, err := approve(repo, number, user.Name); err == errQueueFull {
+		refuseBuild(w, err)
+		return
+	} else if err != nil {
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// authenticate accepts a GitHub login session, the configured or a tenant's
+// basic auth user, or the user named in the trusted header when the request
+// comes from a trusted proxy. Without any of them configured local requests
+// are let in only with local_login, as behind a reverse proxy on the same
+// host every request would be local.
+func (h DashboardHandler) authenticate(r *http.Request) (dashboardUser, bool) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	if h.Config.OAuthClientId != "" {
+		if user, ok := readSession(r); ok {
+			return user, true
+		}
+	}
+
+	if h.Config.TrustHeader != "" {
+		if user := r.Header.Get(h.Config.TrustHeader); user != "" {
+			for _, proxy := range h.Config.TrustedProxies {
+				if strings.TrimSpace(proxy) == host {
+					return dashboardUser{Name: user, Trigger: true}, true
+				}
+			}
+		}
+	}
+
+	if user, password, ok := r.BasicAuth(); ok {
+		if tenant, ok := tenantLogin(h.Tenants, user, password); ok {
+			return dashboardUser{Name: user, Trigger: true, Tenant: tenant.Name}, true
+		}
+	}
+
+	if h.Config.User != "" {
+		user, password, ok := r.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(user), []byte(h.Config.User)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(h.Config.Password)) == 1 {
+			return dashboardUser{Name: user, Trigger: true}, true
+		}
+		return dashboardUser{}, false
+	}
+
+	if h.Config.LocalLogin && h.Config.TrustHeader == "" && h.Config.OAuthClientId == "" && len(h.Tenants) == 0 {
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return dashboardUser{Name: "local", Trigger: true}, true
+		}
+	}
+	return dashboardUser{}, false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/url"
+	"time"
+)
+
+// deployRefusal explains why a build may not run deploy steps, empty if it
+// may. Fork pull requests never deploy unless the repo trusts forks with its
+// secrets. With protected deploys only pushes to protected branches that weren't
+// forced and whose commit came in through a merged pull request get through.
+func deployRefusal(job *BuildJob) string {
+	if !trusted(job) {
+		return "fork pull requests never deploy"
+	} else if !job.Repo.ProtectedDeploys {
+		return ""
+	} else if job.Build.Pull > 0 {
+		return "pull request builds never deploy"
+	} else if job.Build.Forced {
+		return "force pushed"
+	} else if job.token == "" {
+		return "no token to verify branch protection"
+	}
+
+	branch := struct {
+		Protected bool `json:"protected"`
+	}{}
+	if err := githubGet(job.token, "/repos/"+job.Name+"/branches/"+url.PathEscape(job.Branch), &branch); err != nil {
+		return "could not verify branch protection, " + err.Error()
+	} else if !branch.Protected {
+		return "branch " + job.Branch + " is not protected"
+	}
+
+	pulls := []struct {
+		MergedAt *time.Time `json:"merged_at"`
+	}{}
+	if err := githubGet(job.token, "/repos/"+job.Name+"/commits/"+job.Build.Commit+"/pulls", &pulls); err != nil {
+		return "could not look up pull requests, " + err.Error()
+	}
+	for _, pull := range pulls {
+		if pull.MergedAt != nil {
+			return ""
+		}
+	}
+	return "commit did not come through a merged pull request"
+}
+
+// trusted reports whether the job may use the repo's secrets, which fork pull
+// requests may not unless fork_secrets is set.
+func trusted(job *BuildJob) bool {
+	return !job.Build.Fork || job.Repo.ForkSecrets
+}
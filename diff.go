@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+type BuildDiff struct {
+	Repo          string        `json:"repo"`
+	From          BuildSummary  `json:"from"`
+	To            BuildSummary  `json:"to"`
+	CompareUrl    string        `json:"compare_url,omitempty"`
+	Commits       []DiffCommit  `json:"commits,omitempty"`
+	DurationDelta time.Duration `json:"duration_delta"`
+	Steps         []StepChange  `json:"steps,omitempty"`
+	Tests         []TestChange  `json:"tests,omitempty"`
+}
+
+type BuildSummary struct {
+	Number   int           `json:"number"`
+	Branch   string        `json:"branch"`
+	Commit   string        `json:"commit"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+}
+
+type DiffCommit struct {
+	Sha     string `json:"sha"`
+	Author  string `json:"author"`
+	Message string `json:"message"`
+}
+
+type StepChange struct {
+	Name          string        `json:"name"`
+	From          string        `json:"from"`
+	To            string        `json:"to"`
+	DurationDelta time.Duration `json:"duration_delta"`
+}
+
+type TestChange struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func summarize(build Build) BuildSummary {
+	return BuildSummary{build.Number, build.Branch, build.Commit, build.Status, build.Duration}
+}
+
+func stepStatus(step StepResult) string {
+	if step.Skipped != "" {
+		return "skipped"
+	} else if step.TimedOut {
+		return "timed out"
+	} else if step.ExitCode != 0 {
+		return "failed"
+	}
+	return "passed"
+}
+
+// lastGreen finds the latest passing build of repo older than before.
+func lastGreen(store Store, repo string, before int) (Build, bool) {
+	for _, build := range store.List(repo) {
+		if build.Number < before && build.Status == "OK" {
+			return build, true
+		}
+	}
+	return Build{}, false
+}
+
+// diffBuilds compares two builds of repo, listing the commits between them
+// when github can be asked, each step's status in both along with how much
+// slower or faster it got, and the tests whose status changed.
+func diffBuilds(repo *Repo, from, to Build) BuildDiff {
+	diff := BuildDiff{
+		Repo:          repo.Name,
+		From:          summarize(from),
+		To:            summarize(to),
+		DurationDelta: to.Duration - from.Duration,
+	}
+
+	if from.Commit != "" && to.Commit != "" && from.Commit != to.Commit {
+		diff.CompareUrl = "https://github.com/" + repo.Name + "/compare/" + from.Commit + "..." + to.Commit
+		if token, err := repoToken(*repo); err == nil && token != "" {
+			compare := struct {
+				Commits []struct {
+					Sha    string `json:"sha"`
+					Commit struct {
+						Message string `json:"message"`
+						Author  struct {
+							Name string `json:"name"`
+						} `json:"author"`
+					} `json:"commit"`
+				} `json:"commits"`
+			}{}
+			if err := githubGet(token, "/repos/"+repo.Name+"/compare/"+from.Commit+"..."+to.Commit, &compare); err != nil {
+				warnf("http", "could not compare %s, %s", repo.Name, err.Error())
+			}
+			for _, commit := range compare.Commits {
+				diff.Commits = append(diff.Commits, DiffCommit{
+					Sha:     commit.Sha,
+					Author:  commit.Commit.Author.Name,
+					Message: strings.SplitN(commit.Commit.Message, "\n", 2)[0],
+				})
+			}
+		}
+	}
+
+	before := make(map[string]StepResult)
+	for _, step := range from.Steps {
+		before[step.Name] = step
+	}
+	for _, step := range to.Steps {
+		old, ok := before[step.Name]
+		change := StepChange{Name: step.Name, From: "missing", To: stepStatus(step), DurationDelta: step.Duration}
+		if ok {
+			change.From = stepStatus(old)
+			change.DurationDelta = step.Duration - old.Duration
+			delete(before, step.Name)
+		}
+		diff.Steps = append(diff.Steps, change)
+	}
+	for _, step := range from.Steps {
+		if _, ok := before[step.Name]; ok {
+			diff.Steps = append(diff.Steps, StepChange{Name: step.Name, From: stepStatus(step), To: "missing", DurationDelta: -step.Duration})
+		}
+	}
+
+	tests := make(map[string]string)
+	for _, result := range from.Tests {
+		tests[strings.TrimPrefix(result.Suite+"."+result.Name, ".")] = result.Status
+	}
+	for _, result := range to.Tests {
+		name := strings.TrimPrefix(result.Suite+"."+result.Name, ".")
+		if old, ok := tests[name]; !ok {
+			diff.Tests = append(diff.Tests, TestChange{name, "missing", result.Status})
+		} else if old != result.Status {
+			diff.Tests = append(diff.Tests, TestChange{name, old, result.Status})
+		}
+		delete(tests, name)
+	}
+	for _, result := range from.Tests {
+		name := strings.TrimPrefix(result.Suite+"."+result.Name, ".")
+		if _, ok := tests[name]; ok {
+			diff.Tests = append(diff.Tests, TestChange{name, result.Status, "missing"})
+		}
+	}
+	return diff
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Discovery enumerates an org's repos, registering those with a spectacle.sh
+// using Defaults for everything but the name.
+type Discovery struct {
+	Org      string
+	Token    string        `ini:"token"`
+	Interval time.Duration `ini:"interval"`
+	Defaults Repo
+}
+
+func discoverRepos(discovery Discovery, repos *RepoSet) {
+	for {
+		added, err := discoverOnce(discovery, repos)
+		if err != nil {
+			warnf("daemon", "discovery of %s failed, %s\n", discovery.Org, err.Error())
+		}
+		for _, name := range added {
+			infof("daemon", "discovered repo %s\n", name)
+		}
+		time.Sleep(discovery.Interval)
+	}
+}
+
+func discoverOnce(discovery Discovery, repos *RepoSet) ([]string, error) {
+	added := make([]string, 0)
+	for page := 1; ; page++ {
+		listed := []struct {
+			FullName      string `json:"full_name"`
+			DefaultBranch string `json:"default_branch"`
+			Archived      bool   `json:"archived"`
+		}{}
+		if err := githubGet(discovery.Token, "/orgs/"+discovery.Org+"/repos?per_page=100&page="+strconv.Itoa(page), &listed); err != nil {
+			return added, errors.Wrap(err, "could not list repos")
+		}
+		if len(listed) == 0 {
+			return added, nil
+		}
+
+		for _, candidate := range listed {
+			if candidate.Archived || repos.Find(candidate.FullName) != nil {
+				continue
+			}
+			res, err := githubRequest(discovery.Token, "GET", "/repos/"+candidate.FullName+"/contents/spectacle.sh", nil)
+			if err != nil {
+				continue
+			}
+			res.Body.Close()
+
+			repo := discovery.Defaults
+			repo.Name = candidate.FullName
+			if repo.Branch == "" {
+				repo.Branch = candidate.DefaultBranch
+			}
+			if repo.Token == "" {
+				repo.Token = discovery.Token
+			}
+			if repos.Add(repo) {
+				added = append(added, repo.Name)
+			}
+		}
+	}
+}
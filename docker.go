@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+var semverTag = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(-.+)?$`)
+
+var unsafeImageTag = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// dockerStep builds the checkout's Dockerfile as the repo's docker image and
+// pushes it under every tag derived from the build. Images of pull requests
+// are only built, so they can't overwrite the tags of the branches they are
+// named like.
+func dockerStep(ctx context.Context, workspace Workspace, result *StepResult, log io.Writer) error {
+	image := workspace.Repo.DockerImage
+	if image == "" {
+		return errors.New("no docker image configured")
+	}
+	dockerfile := workspace.Repo.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+
+	args := []string{"build", "-f", dockerfile}
+	tags := imageTags(workspace.Env)
+	for _, tag := range tags {
+		args = append(args, "-t", image+":"+tag)
+	}
+	cache := ""
+	if workspace.Repo.DockerCache {
+		var err error
+		if cache, err = dockerCache(ctx, workspace, log); err != nil {
+			return err
+		}
+		args = append([]string{"buildx", "build", "--builder", dockerBuilder, "--load", "--cache-from", "type=local,src=" + cache}, args[1:]...)
+		if workspace.Trusted {
+			args = append(args, "--cache-to", "type=local,mode=max,dest="+cache+".new")
+		}
+	}
+	args = append(args, ".")
+	if err := runDocker(ctx, workspace, log, args...); err != nil {
+		if cache != "" {
+			os.RemoveAll(cache + ".new")
+		}
+		return errors.Wrap(err, "docker build failed")
+	}
+	if cache != "" && workspace.Trusted {
+		if err := rotateDockerCache(workspace.Repo, cache, log); err != nil {
+			return err
+		}
+	}
+
+	if !workspace.Trusted || lookupEnv(workspace.Env, "SPECTACLE_PULL") != "0" {
+		fmt.Fprintf(log, "not pushing %s of a pull request\n", image)
+		return nil
+	}
+	for _, tag := range tags {
+		if err := runDocker(ctx, workspace, log, "push", image+":"+tag); err != nil {
+			return errors.Wrap(err, "docker push failed")
+		}
+		fmt.Fprintf(log, "pushed %s:%s\n", image, tag)
+	}
+	return nil
+}
+
+// imageTags derives image tags from the build, the short commit always and
+// the branch for branch builds. Semver tags add the version, and for releases
+// the minor and major versions along with latest.
+func imageTags(env []string) []string {
+	commit := lookupEnv(env, "SPECTACLE_COMMIT")
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	tags := []string{commit}
+
+	tag := lookupEnv(env, "SPECTACLE_TAG")
+	if tag == "" {
+		if branch := lookupEnv(env, "SPECTACLE_BRANCH"); branch != "" {
+			tags = append(tags, unsafeImageTag.ReplaceAllString(branch, "-"))
+		}
+		return tags
+	}
+
+	version := semverTag.FindStringSubmatch(tag)
+	if version == nil {
+		return append(tags, unsafeImageTag.ReplaceAllString(tag, "-"))
+	}
+	tags = append(tags, version[1]+"."+version[2]+"."+version[3]+version[4])
+	if version[4] == "" {
+		tags = append(tags, version[1]+"."+version[2], version[1], "latest")
+	}
+	return tags
+}
+
+const dockerBuilder = "spectacle"
+
+// dockerCache prepares the repo's BuildKit layer cache, creating the builder
+// able to export it if missing.
+func dockerCache(ctx context.Context, workspace Workspace, log io.Writer) (string, error) {
+	if exec.CommandContext(ctx, "docker", "buildx", "inspect", dockerBuilder).Run() != nil {
+		if err := runDocker(ctx, workspace, log, "buildx", "create", "--name", dockerBuilder, "--driver", "docker-container"); err != nil {
+			return "", errors.Wrap(err, "could not create docker builder")
+		}
+	}
+	cache := cacheDir + "/" + workspaceName(workspace.Repo, workspace.Repo.Name) + "/docker"
+	if err := os.MkdirAll(cache, os.ModePerm); err != nil {
+		return "", errors.Wrap(err, "could not create docker cache")
+	}
+	return cache, nil
+}
+
+// rotateDockerCache replaces the cache with the one this build exported,
+// which holds only the layers it used, dropping it when over its size.
+func rotateDockerCache(repo Repo, cache string, log io.Writer) error {
+	if err := os.RemoveAll(cache); err != nil {
+		return errors.Wrap(err, "could not remove old docker cache")
+	}
+	if err := os.Rename(cache+".new", cache); err != nil {
+		return errors.Wrap(err, "could not replace docker cache")
+	}
+	if repo.DockerCacheSize == "" {
+		return nil
+	}
+	limit, err := parseSize(repo.DockerCacheSize)
+	if err != nil {
+		return errors.Wrap(err, "bad docker cache size")
+	}
+	if size := diskUsage(cache); size > limit {
+		fmt.Fprintf(log, "docker cache of %d bytes over %s, pruned\n", size, repo.DockerCacheSize)
+		return errors.Wrap(os.RemoveAll(cache), "could not prune docker cache")
+	}
+	return nil
+}
+
+func runDocker(ctx context.Context, workspace Workspace, log io.Writer, args ...string) error {
+	cmd := exec.Command("docker", args...)
+	cmd.Dir = workspace.Dir
+	cmd.Env = workspace.Env
+	cmd.Stdout = log
+	cmd.Stderr = log
+	return runGroup(ctx, cmd)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestImageTags(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		env  []string
+		want []string
+	}{
+		{[]string{"SPECTACLE_COMMIT=" + sha, "SPECTACLE_BRANCH=main"}, []string{"0123456", "main"}},
+		{[]string{"SPECTACLE_COMMIT=" + sha, "SPECTACLE_BRANCH=feature/x+y"}, []string{"0123456", "feature-x-y"}},
+		{[]string{"SPECTACLE_COMMIT=" + sha}, []string{"0123456"}},
+		{[]string{"SPECTACLE_COMMIT=abc"}, []string{"abc"}},
+		{[]string{"SPECTACLE_COMMIT=" + sha, "SPECTACLE_TAG=v1.2.3"}, []string{"0123456", "1.2.3", "1.2", "1", "latest"}},
+		{[]string{"SPECTACLE_COMMIT=" + sha, "SPECTACLE_TAG=2.0.1"}, []string{"0123456", "2.0.1", "2.0", "2", "latest"}},
+		{[]string{"SPECTACLE_COMMIT=" + sha, "SPECTACLE_TAG=v1.2.3-rc.1"}, []string{"0123456", "1.2.3-rc.1"}},
+		{[]string{"SPECTACLE_COMMIT=" + sha, "SPECTACLE_TAG=nightly/2020"}, []string{"0123456", "nightly-2020"}},
+		{[]string{"SPECTACLE_COMMIT=" + sha, "SPECTACLE_TAG=v1.2", "SPECTACLE_BRANCH=main"}, []string{"0123456", "v1.2"}},
+	}
+	for _, test := range tests {
+		if got := imageTags(test.env); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("imageTags(%q) = %q, want %q", test.env, got, test.want)
+		}
+	}
+}
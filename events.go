@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const recentEvents = 1000
+
+type Event struct {
+	Id     int64     `json:"id"`
+	Type   string    `json:"type"`
+	Repo   string    `json:"repo"`
+	Number int       `json:"number"`
+	Step   string    `json:"step,omitempty"`
+	Status string    `json:"status,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// events fans build lifecycle events out to subscribers, keeping the latest
+// so reconnecting streams can resume where they left off.
+var events = struct {
+	sync.Mutex
+	next        int64
+	recent      []Event
+	subscribers map[chan Event]bool
+}{
+	subscribers: make(map[chan Event]bool),
+}
+
+func publish(event Event) {
+	events.Lock()
+	defer events.Unlock()
+
+	events.next++
+	event.Id = events.next
+	event.Time = time.Now()
+	if len(events.recent) >= recentEvents {
+		events.recent = append(events.recent[:0], events.recent[1:]...)
+	}
+	events.recent = append(events.recent, event)
+
+	// Slow subscribers miss events rather than hold up builds
+	for subscriber := range events.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// subscribe returns the kept events after the given id along with a channel
+// of those to come.
+func subscribe(after int64) ([]Event, chan Event) {
+	events.Lock()
+	defer events.Unlock()
+
+	backlog := make([]Event, 0)
+	for _, event := range events.recent {
+		if event.Id > after {
+			backlog = append(backlog, event)
+		}
+	}
+	subscriber := make(chan Event, 100)
+	events.subscribers[subscriber] = true
+	return backlog, subscriber
+}
+
+func unsubscribe(subscriber chan Event) {
+	events.Lock()
+	delete(events.subscribers, subscriber)
+	events.Unlock()
+}
+
+// serveEvents streams events as server sent events, optionally for one
+// repo. Streams resume from Last-Event-ID, so clients reconnecting after
+// the server's write timeout lose nothing.
+func (h ApiHandler) serveEvents(token *Token, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	repo := r.URL.Query().Get("repo")
+	after, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	backlog, subscriber := subscribe(after)
+	defer unsubscribe(subscriber)
+
+	// The server's write_timeout is meant for ordinary responses, a stream
+	// is ended by the client going away instead
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		warnf("http", "├could not clear write deadline of event stream, %s\n", err.Error())
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, "retry: 1000\n\n")
+	flusher.Flush()
+
+	send := func(event Event) error {
+		if repo != "" && event.Repo != repo || !visibleTo(h.Repos.List(), token.Tenant, event.Repo) {
+			return nil
+		}
+		raw, _ := json.Marshal(event)
+		_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, raw)
+		flusher.Flush()
+		return err
+	}
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(5 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event := <-subscriber:
+			if err := send(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type ExporterConfig struct {
+	Nats        string `ini:"nats"`
+	NatsSubject string `ini:"nats_subject"`
+	KafkaRest   string `ini:"kafka_rest"`
+	KafkaTopic  string `ini:"kafka_topic"`
+}
+
+// Exporter forwards build events to a NATS subject and a Kafka topic, the
+// latter through a Kafka REST proxy. Events are dropped rather than queued
+// while either is unreachable.
+type Exporter struct {
+	sync.Mutex
+	config ExporterConfig
+	nats   net.Conn
+}
+
+func NewExporter(config ExporterConfig) (*Exporter, error) {
+	if config.Nats == "" && config.KafkaRest == "" {
+		return nil, errors.New("events exporter has neither nats nor kafka_rest")
+	}
+	if config.Nats != "" {
+		if _, err := url.Parse(config.Nats); err != nil {
+			return nil, errors.Wrap(err, "bad nats url")
+		}
+	}
+	if config.NatsSubject == "" {
+		config.NatsSubject = "spectacle.builds"
+	}
+	if config.KafkaTopic == "" {
+		config.KafkaTopic = "spectacle-builds"
+	}
+	return &Exporter{
+		config: config,
+	}, nil
+}
+
+func (e *Exporter) Run() {
+	_, subscriber := subscribe(0)
+	for event := range subscriber {
+		raw, _ := json.Marshal(event)
+		if e.config.Nats != "" {
+			if err := e.publishNats(raw); err != nil {
+				warnf("daemon", "could not publish event to nats, %s\n", err.Error())
+			}
+		}
+		if e.config.KafkaRest != "" {
+			if err := e.publishKafka(event.Repo, raw); err != nil {
+				warnf("daemon", "could not publish event to kafka, %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// connectNats dials the server and answers its pings until the connection
+// drops, the next publish dialing anew.
+func (e *Exporter) connectNats() (net.Conn, error) {
+	server, _ := url.Parse(e.config.Nats)
+	conn, err := net.DialTimeout("tcp", server.Host, 10*time.Second)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect")
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return nil, errors.New("not a nats server")
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "spectacle",
+	}
+	if password, ok := server.User.Password(); ok {
+		options["user"] = server.User.Username()
+		options["pass"] = password
+	} else if server.User != nil {
+		options["auth_token"] = server.User.Username()
+	}
+	raw, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", raw); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not connect")
+	}
+
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			if strings.HasPrefix(line, "PING") {
+				e.Lock()
+				fmt.Fprint(conn, "PONG\r\n")
+				e.Unlock()
+			} else if strings.HasPrefix(line, "-ERR") {
+				warnf("daemon", "nats error, %s\n", strings.TrimSpace(line))
+			}
+		}
+		e.Lock()
+		if e.nats == conn {
+			e.nats = nil
+		}
+		e.Unlock()
+		conn.Close()
+	}()
+	return conn, nil
+}
+
+func (e *Exporter) publishNats(payload []byte) error {
+	e.Lock()
+	conn := e.nats
+	e.Unlock()
+	if conn == nil {
+		var err error
+		if conn, err = e.connectNats(); err != nil {
+			return err
+		}
+		e.Lock()
+		e.nats = conn
+		e.Unlock()
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintf(conn, "PUB %s %d\r\n%s\r\n", e.config.NatsSubject, len(payload), payload); err != nil {
+		conn.Close()
+		e.nats = nil
+		return errors.Wrap(err, "publish failed")
+	}
+	return nil
+}
+
+func (e *Exporter) publishKafka(key string, payload []byte) error {
+	raw, _ := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{
+			{"key": key, "value": json.RawMessage(payload)},
+		},
+	})
+	res, err := notifyClient.Post(strings.TrimSuffix(e.config.KafkaRest, "/")+"/topics/"+url.PathEscape(e.config.KafkaTopic), "application/vnd.kafka.json.v2+json", bytes.NewReader(raw))
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExporterPublishesToNats(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type received struct {
+		connect map[string]interface{}
+		pong    string
+		pub     string
+		payload string
+		err     error
+	}
+	done := make(chan received, 1)
+	go func() {
+		got := received{}
+		defer func() { done <- got }()
+		conn, err := listener.Accept()
+		if err != nil {
+			got.err = err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		reader := bufio.NewReader(conn)
+		io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			got.err = err
+			return
+		}
+		json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")), &got.connect)
+		if got.pub, err = reader.ReadString('\n'); err != nil {
+			got.err = err
+			return
+		}
+		if got.payload, err = reader.ReadString('\n'); err != nil {
+			got.err = err
+			return
+		}
+		io.WriteString(conn, "PING\r\n")
+		got.pong, got.err = reader.ReadString('\n')
+	}()
+
+	e, err := NewExporter(ExporterConfig{Nats: "nats://ci:secret@" + listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.publishNats([]byte(`{"repo":"a"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-done
+	if got.err != nil {
+		t.Fatal(got.err)
+	}
+	if got.connect["user"] != "ci" || got.connect["pass"] != "secret" || got.connect["verbose"] != false {
+		t.Errorf("CONNECT options %v", got.connect)
+	}
+	if got.pong != "PONG\r\n" {
+		t.Errorf("answered ping with %q", got.pong)
+	}
+	if got.pub != "PUB spectacle.builds 12\r\n" || got.payload != "{\"repo\":\"a\"}\r\n" {
+		t.Errorf("published %q %q", got.pub, got.payload)
+	}
+}
+
+func TestNewExporterNeedsATarget(t *testing.T) {
+	if _, err := NewExporter(ExporterConfig{}); err == nil {
+		t.Errorf("NewExporter accepted neither nats nor kafka_rest")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const feedSize = 50
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Id      string    `xml:"id"`
+	Title   string    `xml:"title"`
+	Updated time.Time `xml:"updated"`
+	Link    *atomLink `xml:"link,omitempty"`
+	Summary string    `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated time.Time   `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// serveFeed sends an Atom feed of the latest finished builds, of one repo
+// or of all visible ones.
+func (h ApiHandler) serveFeed(token *Token, w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get("repo")
+	feed := atomFeed{
+		Id:     "urn:spectacle:builds",
+		Title:  "spectacle builds",
+		Author: "spectacle",
+	}
+	if repo != "" {
+		feed.Id += ":" + repo
+		feed.Title = repo + " builds"
+	}
+
+	for _, build := range tenantBuilds(h.Repos.List(), token.Tenant, h.Store.List(repo)) {
+		if build.Status == "QUEUED" || build.Status == "RUNNING" || build.Status == awaitingApproval || build.Status == awaitingGate {
+			continue
+		}
+		finished := build.Started.Add(build.Duration)
+		if build.Started.IsZero() {
+			finished = build.Queued
+		}
+		entry := atomEntry{
+			Id:      fmt.Sprintf("urn:spectacle:build:%s:%d", build.Repo, build.Number),
+			Title:   fmt.Sprintf("%s #%d %s", build.Repo, build.Number, build.Status),
+			Updated: finished.UTC(),
+			Summary: fmt.Sprintf("%s of %.7s on %s in %.2fs", build.Status, build.Commit, build.Branch, float64(build.Duration)/float64(time.Second)),
+		}
+		if link := buildLogUrl(build); link != "" {
+			entry.Link = &atomLink{Href: link}
+		}
+		if entry.Updated.After(feed.Updated) {
+			feed.Updated = entry.Updated
+		}
+		feed.Entries = append(feed.Entries, entry)
+		if len(feed.Entries) == feedSize {
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(feed)
+}
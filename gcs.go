@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+const gcsMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// GCSBucket keeps objects in a Google Cloud Storage bucket, authenticating
+// as the service account of the credentials file, or with workload identity
+// through the metadata server when there is none.
+type GCSBucket struct {
+	sync.Mutex
+	bucket  string
+	prefix  string
+	api     string
+	account *serviceAccount
+	client  *http.Client
+	token   string
+	expires time.Time
+}
+
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenUri    string `json:"token_uri"`
+	key         *rsa.PrivateKey
+}
+
+// NewGCSBucket opens bucket with the service account json in credentials,
+// defaulting to GOOGLE_APPLICATION_CREDENTIALS.
+func NewGCSBucket(bucket, prefix, credentials string) (*GCSBucket, error) {
+	if bucket == "" {
+		return nil, errors.New("gcs needs a bucket")
+	}
+	g := &GCSBucket{
+		bucket: bucket,
+		prefix: strings.Trim(prefix, "/"),
+		api:    "https://storage.googleapis.com",
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if credentials == "" {
+		credentials = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credentials == "" {
+		return g, nil
+	}
+
+	raw, err := ioutil.ReadFile(credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read gcs credentials")
+	}
+	g.account = &serviceAccount{}
+	if err := json.Unmarshal(raw, g.account); err != nil {
+		return nil, errors.Wrap(err, "could not parse gcs credentials")
+	}
+	block, _ := pem.Decode([]byte(g.account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("gcs credentials key is not pem")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse gcs credentials key")
+	}
+	var ok bool
+	if g.account.key, ok = key.(*rsa.PrivateKey); !ok {
+		return nil, errors.New("gcs credentials key is not rsa")
+	}
+	if g.account.TokenUri == "" {
+		g.account.TokenUri = "https://oauth2.googleapis.com/token"
+	}
+	return g, nil
+}
+
+// accessToken returns an oauth token for the bucket, cached until shortly
+// before it expires.
+func (g *GCSBucket) accessToken() (string, error) {
+	g.Lock()
+	defer g.Unlock()
+	if time.Until(g.expires) > time.Minute {
+		return g.token, nil
+	}
+
+	var req *http.Request
+	if g.account != nil {
+		now := time.Now()
+		jwt, err := signJwt(g.account.key, map[string]interface{}{
+			"iss":   g.account.ClientEmail,
+			"scope": gcsScope,
+			"aud":   g.account.TokenUri,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		})
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {jwt},
+		}
+		req, _ = http.NewRequest("POST", g.account.TokenUri, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, _ = http.NewRequest("GET", gcsMetadataToken, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "could not get gcs token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("could not get gcs token, %s", resp.Status)
+	}
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "could not decode gcs token")
+	}
+	g.token = token.AccessToken
+	g.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return g.token, nil
+}
+
+func (g *GCSBucket) name(key string) string {
+	if g.prefix != "" {
+		return g.prefix + "/" + key
+	}
+	return key
+}
+
+func (g *GCSBucket) Put(key string, body []byte, contentType string) error {
+	target := g.api + "/upload/storage/v1/b/" + url.PathEscape(g.bucket) + "/o?uploadType=media&name=" + url.QueryEscape(g.name(key))
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "bad gcs key "+key)
+	}
+	req.Header.Set("Content-Type", contentType)
+	_, err = g.do(req)
+	return errors.Wrap(err, "could not put "+key)
+}
+
+func (g *GCSBucket) Get(key string) ([]byte, error) {
+	target := g.api + "/storage/v1/b/" + url.PathEscape(g.bucket) + "/o/" + url.PathEscape(g.name(key)) + "?alt=media"
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad gcs key "+key)
+	}
+	body, err := g.do(req)
+	return body, errors.Wrap(err, "could not get "+key)
+}
+
+func (g *GCSBucket) do(req *http.Request) ([]byte, error) {
+	token, err := g.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return nil, errors.New(strings.TrimSpace(resp.Status + " " + string(raw)))
+	}
+	return raw, err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGCSBucketWithServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	tokens := 0
+	objects := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokens++
+			parts := strings.Split(r.FormValue("assertion"), ".")
+			if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+				http.Error(w, "bad grant", http.StatusBadRequest)
+				return
+			}
+			sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], signature); err != nil {
+				http.Error(w, "bad signature", http.StatusUnauthorized)
+				return
+			}
+			claims := map[string]interface{}{}
+			raw, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			json.Unmarshal(raw, &claims)
+			if claims["iss"] != "ci@project.iam.gserviceaccount.com" || claims["scope"] != gcsScope {
+				http.Error(w, "bad claims", http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/artifacts/o" && r.URL.Query().Get("uploadType") == "media":
+			body, _ := ioutil.ReadAll(r.Body)
+			objects[r.URL.Query().Get("name")] = string(body)
+		case r.Method == "GET" && strings.HasPrefix(r.URL.EscapedPath(), "/storage/v1/b/artifacts/o/") && r.URL.Query().Get("alt") == "media":
+			name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/artifacts/o/")
+			if body, ok := objects[name]; ok {
+				w.Write([]byte(body))
+			} else {
+				http.NotFound(w, r)
+			}
+		default:
+			http.Error(w, "unexpected "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	credentials := filepath.Join(t.TempDir(), "gcs.json")
+	raw, _ := json.Marshal(map[string]string{
+		"client_email": "ci@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    server.URL + "/token",
+	})
+	if err := ioutil.WriteFile(credentials, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGCSBucket("artifacts", "/ci/", credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.api = server.URL
+
+	if err := g.Put("a b/c.tar", []byte("tar"), "application/x-tar"); err != nil {
+		t.Fatal(err)
+	}
+	if objects["ci/a b/c.tar"] != "tar" {
+		t.Errorf("stored objects %v", objects)
+	}
+	body, err := g.Get("a b/c.tar")
+	if err != nil || string(body) != "tar" {
+		t.Errorf("Get = %q, %v", body, err)
+	}
+	if _, err := g.Get("missing"); err == nil {
+		t.Errorf("Get of a missing object succeeded")
+	}
+	if tokens != 1 {
+		t.Errorf("requested %d tokens, want 1", tokens)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const githubApi = "https://api.github.com"
+
+var githubClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+func githubRequest(token, method, path string, body interface{}) (*http.Response, error) {
+	return githubRequestAuth("token "+token, method, path, body)
+}
+
+// githubRequestAuth sends an api request with the given Authorization
+// header, failing on any non 2xx response.
+func githubRequestAuth(authorization, method, path string, body interface{}) (*http.Response, error) {
+	raw := []byte{}
+	if body != nil {
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			return nil, errors.Wrap(err, "could not encode request")
+		}
+	}
+
+	req, err := http.NewRequest(method, githubApi+path, bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create request")
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := githubClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request failed")
+	}
+	if res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, errors.Errorf("unexpected status %s", res.Status)
+	}
+	return res, nil
+}
+
+func githubGet(token, path string, v interface{}) error {
+	return githubGetAuth("token "+token, path, v)
+}
+
+func githubGetAuth(authorization, path string, v interface{}) error {
+	res, err := githubRequestAuth(authorization, "GET", path, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not get "+path)
+	}
+	defer res.Body.Close()
+	return errors.Wrap(json.NewDecoder(res.Body).Decode(v), "could not decode "+path)
+}
+
+// githubGetAll decodes every page of a listing into the slice v points to,
+// following the Link header's next page as long as it stays on the api.
+func githubGetAll(token, path string, v interface{}) error {
+	all := reflect.ValueOf(v).Elem()
+	for path != "" {
+		res, err := githubRequest(token, "GET", path, nil)
+		if err != nil {
+			return errors.Wrap(err, "could not get "+path)
+		}
+		page := reflect.New(all.Type())
+		err = json.NewDecoder(res.Body).Decode(page.Interface())
+		res.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "could not decode "+path)
+		}
+		all.Set(reflect.AppendSlice(all, page.Elem()))
+		path = nextPage(res.Header.Get("Link"))
+	}
+	return nil
+}
+
+// nextPage returns the api path of a Link header's next page, if any.
+func nextPage(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		fields := strings.Split(part, ";")
+		target := strings.Trim(strings.TrimSpace(fields[0]), "<>")
+		for _, param := range fields[1:] {
+			if strings.TrimSpace(param) == `rel="next"` && strings.HasPrefix(target, githubApi+"/") {
+				return strings.TrimPrefix(target, githubApi)
+			}
+		}
+	}
+	return ""
+}
+
+// postStatus sets a commit status context, states being one of pending,
+// success, failure or error.
+func postStatus(token, repo, sha, context, state, description string) error {
+	if token == "" || sha == "" {
+		return nil
+	}
+
+	res, err := githubRequest(token, "POST", "/repos/"+repo+"/statuses/"+sha, map[string]string{
+		"state":       state,
+		"context":     context,
+		"description": description,
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not post status")
+	}
+	res.Body.Close()
+	return nil
+}
+
+const commentMarker = "<!-- spectacle -->"
+
+// upsertComment keeps a single spectacle comment on an issue or pull request,
+// editing the previous one if found.
+func upsertComment(token, repo string, number int, body string) error {
+	login, err := tokenLogin(token)
+	if err != nil {
+		return errors.Wrap(err, "could not find comment author")
+	}
+	comments := []struct {
+		Id   int    `json:"id"`
+		Body string `json:"body"`
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}{}
+	if err := githubGet(token, "/repos/"+repo+"/issues/"+strconv.Itoa(number)+"/comments?per_page=100", &comments); err != nil {
+		return errors.Wrap(err, "could not list comments")
+	}
+
+	method, path := "POST", "/repos/"+repo+"/issues/"+strconv.Itoa(number)+"/comments"
+	for _, comment := range comments {
+		if comment.User.Login == login && strings.HasPrefix(comment.Body, commentMarker) {
+			method, path = "PATCH", "/repos/"+repo+"/issues/comments/"+strconv.Itoa(comment.Id)
+			break
+		}
+	}
+
+	res, err := githubRequest(token, method, path, map[string]string{
+		"body": commentMarker + "\n" + body,
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not write comment")
+	}
+	res.Body.Close()
+	return nil
+}
+
+// tokenLogins caches who comments are written as, by token, or "app" for
+// the app's bot user.
+var tokenLogins = struct {
+	sync.Mutex
+	logins map[string]string
+}{
+	logins: make(map[string]string),
+}
+
+// tokenLogin returns the login comments made with token are written as, the
+// app's bot user when running as an app, so only those are ever updated.
+func tokenLogin(token string) (string, error) {
+	key := token
+	if githubApp != nil {
+		key = "app"
+	}
+	tokenLogins.Lock()
+	defer tokenLogins.Unlock()
+	if login, ok := tokenLogins.logins[key]; ok {
+		return login, nil
+	}
+
+	var login string
+	if githubApp != nil {
+		jwt, err := githubApp.jwt()
+		if err != nil {
+			return "", err
+		}
+		app := struct {
+			Slug string `json:"slug"`
+		}{}
+		if err := githubGetAuth("Bearer "+jwt, "/app", &app); err != nil {
+			return "", err
+		}
+		login = app.Slug + "[bot]"
+	} else {
+		user := struct {
+			Login string `json:"login"`
+		}{}
+		if err := githubGet(token, "/user", &user); err != nil {
+			return "", err
+		}
+		login = user.Login
+	}
+	tokenLogins.logins[key] = login
+	return login, nil
+}
+
+func commentSummary(job *BuildJob) error {
+	if job.token == "" {
+		return nil
+	}
+
+	build := job.Build
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "**spectacle** build #%d of %.7s: **%s** in %.2fs\n\n", build.Number, build.Commit, build.Status, float64(build.Duration)/float64(time.Second))
+	if len(build.Steps) > 0 {
+		fmt.Fprintln(body, "| step | exit | duration |")
+		fmt.Fprintln(body, "|---|---|---|")
+		for _, step := range build.Steps {
+			fmt.Fprintf(body, "| %s | %d | %.2fs |\n", step.Name, step.ExitCode, float64(step.Duration)/float64(time.Second))
+		}
+		fmt.Fprintln(body)
+	}
+	for _, step := range build.Steps {
+		if step.ExitCode != 0 || step.TimedOut {
+			fmt.Fprintf(body, "Failed step: `%s`\n\n", step.Name)
+		} else if step.Flaky {
+			fmt.Fprintf(body, "Flaky step: `%s` passed on attempt %d\n\n", step.Name, step.Attempts)
+		}
+	}
+	if len(build.FailedTests) > 0 {
+		fmt.Fprintf(body, "Failed tests: `%s`\n\n", strings.Join(build.FailedTests, "`, `"))
+	}
+	for _, step := range build.Steps {
+		if len(step.Findings) > 0 {
+			fmt.Fprintf(body, "Vulnerabilities: `%s`\n\n", strings.Join(step.Findings, "`, `"))
+		}
+	}
+	for _, stats := range build.CompilerCache {
+		fmt.Fprintf(body, "%s: %d hits, %d misses\n\n", stats.Tool, stats.Hits, stats.Misses)
+	}
+	if link := buildLogUrl(build); link != "" {
+		fmt.Fprintf(body, "[Build log](%s)\n", link)
+	}
+
+	return upsertComment(job.token, job.Name, build.Pull, body.String())
+}
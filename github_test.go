@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestNextPage(t *testing.T) {
+	tests := []struct {
+		link string
+		want string
+	}{
+		{"", ""},
+		{`<https://api.github.com/user/orgs?per_page=100&page=2>; rel="next", <https://api.github.com/user/orgs?per_page=100&page=3>; rel="last"`, "/user/orgs?per_page=100&page=2"},
+		{`<https://api.github.com/user/orgs?per_page=100&page=1>; rel="prev", <https://api.github.com/user/orgs?per_page=100&page=1>; rel="first"`, ""},
+		{`<https://example.com/user/orgs?page=2>; rel="next"`, ""},
+	}
+	for _, test := range tests {
+		if got := nextPage(test.link); got != test.want {
+			t.Errorf("nextPage(%q) = %q, want %q", test.link, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type GithubAppConfig struct {
+	AppId         int    `ini:"app_id"`
+	PrivateKey    string `ini:"private_key"`
+	WebhookSecret string `ini:"webhook_secret"`
+}
+
+// GithubApp mints installation tokens for repos the app is installed on,
+// caching them until shortly before they expire.
+type GithubApp struct {
+	sync.Mutex
+	config GithubAppConfig
+	key    *rsa.PrivateKey
+	tokens map[string]installationToken
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var githubApp *GithubApp
+
+func NewGithubApp(config GithubAppConfig) (*GithubApp, error) {
+	raw, err := ioutil.ReadFile(config.PrivateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read app private key")
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("app private key is not pem")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse app private key")
+	}
+
+	return &GithubApp{
+		config: config,
+		key:    key,
+		tokens: make(map[string]installationToken),
+	}, nil
+}
+
+// jwt signs the short lived RS256 token authenticating as the app itself.
+func (a *GithubApp) jwt() (string, error) {
+	now := time.Now()
+	return signJwt(a.key, map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.Itoa(a.config.AppId),
+	})
+}
+
+func signJwt(key *rsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	raw, _ := json.Marshal(claims)
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(raw)
+
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", errors.Wrap(err, "could not sign jwt")
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Token returns an installation token scoped to the app's installation on
+// repo.
+func (a *GithubApp) Token(repo string) (string, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if cached, ok := a.tokens[repo]; ok && time.Until(cached.ExpiresAt) > 5*time.Minute {
+		return cached.Token, nil
+	}
+
+	jwt, err := a.jwt()
+	if err != nil {
+		return "", err
+	}
+	installation := struct {
+		Id int `json:"id"`
+	}{}
+	if err := githubGetAuth("Bearer "+jwt, "/repos/"+repo+"/installation", &installation); err != nil {
+		return "", errors.Wrap(err, "app not installed on "+repo)
+	}
+
+	res, err := githubRequestAuth("Bearer "+jwt, "POST", "/app/installations/"+strconv.Itoa(installation.Id)+"/access_tokens", nil)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create installation token")
+	}
+	defer res.Body.Close()
+	token := installationToken{}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "could not decode installation token")
+	}
+	a.tokens[repo] = token
+	return token.Token, nil
+}
+
+// repoToken picks the token used to talk to GitHub on behalf of repo, an
+// installation token when running as an app and the configured one otherwise.
+func repoToken(repo Repo) (string, error) {
+	if githubApp != nil {
+		return githubApp.Token(repo.Name)
+	}
+	return repo.Token, nil
+}
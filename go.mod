@@ -2,5 +2,7 @@ module "github.com/perlw/spectacle"
 
 require (
 	"github.com/go-ini/ini" v1.33.0
+	"github.com/lib/pq" v1.12.3
 	"github.com/pkg/errors" v0.8.0
+	"modernc.org/sqlite" v1.59.0
 )
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const vulnReport = "govulncheck.json"
+
+// vulncheckStep runs govulncheck on the checkout, recording the vulnerabilities
+// the code actually calls as findings. They only fail the step when the
+// repo's vuln_policy is fail.
+func vulncheckStep(ctx context.Context, workspace Workspace, result *StepResult, log io.Writer) error {
+	cmd := exec.Command("govulncheck", "-json", "./...")
+	cmd.Dir = workspace.Dir
+	cmd.Env = workspace.Env
+	cmd.Stderr = log
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	if err := runGroup(ctx, cmd); err != nil {
+		return errors.Wrap(err, "govulncheck failed")
+	}
+	out := stdout.Bytes()
+	if err := ioutil.WriteFile(workspace.Dir+"/"+vulnReport, out, 0644); err != nil {
+		return errors.Wrap(err, "could not write report")
+	}
+	result.Outputs = append(result.Outputs, vulnReport)
+
+	called := make(map[string]bool)
+	decoder := json.NewDecoder(bytes.NewReader(out))
+	for decoder.More() {
+		message := struct {
+			Finding *struct {
+				Osv   string `json:"osv"`
+				Trace []struct {
+					Function string `json:"function"`
+				} `json:"trace"`
+			} `json:"finding"`
+		}{}
+		if err := decoder.Decode(&message); err != nil {
+			return errors.Wrap(err, "could not decode report")
+		}
+		if message.Finding != nil && len(message.Finding.Trace) > 0 && message.Finding.Trace[0].Function != "" {
+			called[message.Finding.Osv] = true
+		}
+	}
+	for id := range called {
+		result.Findings = append(result.Findings, id)
+	}
+	sort.Strings(result.Findings)
+
+	for _, id := range result.Findings {
+		fmt.Fprintf(log, "vulnerable: %s\n", id)
+	}
+	if len(result.Findings) > 0 && workspace.Repo.VulnPolicy == "fail" {
+		return errors.Errorf("%d vulnerabilities found", len(result.Findings))
+	}
+	return nil
+}
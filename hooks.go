@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type HooksConfig struct {
+	PreBuild  string        `ini:"pre_build"`
+	PostBuild string        `ini:"post_build"`
+	Timeout   time.Duration `ini:"timeout"`
+}
+
+// hooks are replaced on reload while builds run them.
+var hooks = struct {
+	sync.RWMutex
+	config HooksConfig
+}{}
+
+func setHooks(config HooksConfig) {
+	hooks.Lock()
+	hooks.config = config
+	hooks.Unlock()
+}
+
+func currentHooks() HooksConfig {
+	hooks.RLock()
+	defer hooks.RUnlock()
+	return hooks.config
+}
+
+// runHook runs a host command around a job with the job in its env, the
+// build's status being set once it has finished.
+func runHook(command string, job *BuildJob) error {
+	if command == "" {
+		return nil
+	}
+	timeout := currentHooks().Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"SPECTACLE_REPO="+job.Name,
+		"SPECTACLE_BRANCH="+job.Branch,
+		"SPECTACLE_TAG="+job.Build.Tag,
+		"SPECTACLE_COMMIT="+job.Build.Commit,
+		"SPECTACLE_PULL="+strconv.Itoa(job.Build.Pull),
+		"SPECTACLE_BUILD_NUMBER="+strconv.Itoa(job.Build.Number),
+		"SPECTACLE_STATUS="+job.Build.Status,
+		"SPECTACLE_LOG="+job.Build.Log,
+	)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := runGroup(ctx, cmd); err != nil {
+		return errors.Wrapf(err, "hook failed, %s", bytes.TrimSpace(out.Bytes()))
+	}
+	return nil
+}
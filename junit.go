@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type TestResult struct {
+	Suite   string  `json:"suite"`
+	Name    string  `json:"name"`
+	Status  string  `json:"status"`
+	Time    float64 `json:"time"`
+	Message string  `json:"message,omitempty"`
+}
+
+type junitCase struct {
+	Name      string  `xml:"name,attr"`
+	Classname string  `xml:"classname,attr"`
+	Time      float64 `xml:"time,attr"`
+	Failure   *struct {
+		Message string `xml:"message,attr"`
+	} `xml:"failure"`
+	Error *struct {
+		Message string `xml:"message,attr"`
+	} `xml:"error"`
+	Skipped *struct{} `xml:"skipped"`
+}
+
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Cases  []junitCase  `xml:"testcase"`
+	Suites []junitSuite `xml:"testsuite"`
+}
+
+// parseJunit reads a report whose root is either <testsuites> or a single
+// <testsuite>, both decoding into the same shape.
+func parseJunit(path string) ([]TestResult, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read report")
+	}
+
+	root := junitSuite{}
+	if err := xml.Unmarshal(raw, &root); err != nil {
+		return nil, errors.Wrap(err, "malformed report")
+	}
+
+	results := make([]TestResult, 0, 100)
+	var walk func(suite junitSuite)
+	walk = func(suite junitSuite) {
+		for _, c := range suite.Cases {
+			result := TestResult{
+				Suite:  suite.Name,
+				Name:   c.Name,
+				Status: "passed",
+				Time:   c.Time,
+			}
+			if result.Suite == "" {
+				result.Suite = c.Classname
+			}
+			switch {
+			case c.Failure != nil:
+				result.Status = "failed"
+				result.Message = c.Failure.Message
+			case c.Error != nil:
+				result.Status = "error"
+				result.Message = c.Error.Message
+			case c.Skipped != nil:
+				result.Status = "skipped"
+			}
+			results = append(results, result)
+		}
+		for _, child := range suite.Suites {
+			walk(child)
+		}
+	}
+	walk(root)
+	return results, nil
+}
+
+// collectJunit parses every report matching the repo's declared glob.
+func collectJunit(job *BuildJob, buildPath string) []TestResult {
+	if job.Repo.Junit == "" {
+		return nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(buildPath, job.Repo.Junit))
+	if err != nil {
+		warnf("runner", "├bad junit path, %s\n", err.Error())
+		return nil
+	}
+
+	results := make([]TestResult, 0, 100)
+	for _, path := range paths {
+		tests, err := parseJunit(path)
+		if err != nil {
+			warnf("runner", "├skipped junit report %s, %s\n", filepath.Base(path), err.Error())
+			continue
+		}
+		results = append(results, tests...)
+	}
+	return results
+}
+
+// failedTests lists suite qualified names of failed and errored tests.
+func failedTests(results []TestResult) []string {
+	names := make([]string, 0)
+	for _, result := range results {
+		if result.Status == "failed" || result.Status == "error" {
+			names = append(names, strings.TrimPrefix(result.Suite+"."+result.Name, "."))
+		}
+	}
+	return names
+}
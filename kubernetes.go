@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+type KubernetesConfig struct {
+	Server    string   `ini:"server"`
+	TokenFile string   `ini:"token_file"`
+	CaFile    string   `ini:"ca_file"`
+	Namespace string   `ini:"namespace"`
+	Image     string   `ini:"image"`
+	Cpu       string   `ini:"cpu"`
+	Memory    string   `ini:"memory"`
+	Labels    []string `ini:"labels" delim:","`
+
+	StartTimeout time.Duration `ini:"start_timeout"`
+}
+
+// Kubernetes runs builds as Jobs, talking to the api server with the
+// in-cluster service account unless configured otherwise.
+type Kubernetes struct {
+	config KubernetesConfig
+	token  string
+	client *http.Client
+}
+
+func NewKubernetes(config KubernetesConfig) (*Kubernetes, error) {
+	if config.Server == "" {
+		config.Server = "https://kubernetes.default.svc"
+	}
+	if config.TokenFile == "" {
+		config.TokenFile = serviceAccountDir + "/token"
+	}
+	if config.CaFile == "" {
+		config.CaFile = serviceAccountDir + "/ca.crt"
+	}
+	if config.Namespace == "" {
+		config.Namespace = "default"
+	}
+	if config.Image == "" {
+		return nil, errors.New("kubernetes backend has no image")
+	}
+	if config.StartTimeout <= 0 {
+		config.StartTimeout = 5 * time.Minute
+	}
+
+	token, err := ioutil.ReadFile(config.TokenFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read kubernetes token")
+	}
+	ca, err := ioutil.ReadFile(config.CaFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read kubernetes ca")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kubernetes ca is not pem")
+	}
+
+	return &Kubernetes{
+		config: config,
+		token:  strings.TrimSpace(string(token)),
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+func (k *Kubernetes) request(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	raw := []byte{}
+	if body != nil {
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			return nil, errors.Wrap(err, "could not encode request")
+		}
+	}
+
+	req, err := http.NewRequest(method, k.config.Server+path, bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request failed")
+	}
+	if res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, errors.Errorf("unexpected status %s", res.Status)
+	}
+	return res, nil
+}
+
+func (k *Kubernetes) get(ctx context.Context, path string, v interface{}) error {
+	res, err := k.request(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return errors.Wrap(json.NewDecoder(res.Body).Decode(v), "could not decode response")
+}
+
+// Run submits the job, follows its pod's log once it starts and waits for
+// the job to complete, deleting it if the build is cancelled. The token to
+// clone with is kept out of the job spec in a secret living as long as the
+// build.
+func (k *Kubernetes) Run(ctx context.Context, job *BuildJob, log io.Writer) error {
+	name := remoteName(job)
+	jobs := "/apis/batch/v1/namespaces/" + k.config.Namespace + "/jobs"
+	pods := "/api/v1/namespaces/" + k.config.Namespace + "/pods"
+	secrets := "/api/v1/namespaces/" + k.config.Namespace + "/secrets"
+
+	env := make([]map[string]interface{}, 0, 8)
+	for key, value := range remoteEnv(job) {
+		env = append(env, map[string]interface{}{"name": key, "value": value})
+	}
+	if token := remoteToken(job); token != "" {
+		res, err := k.request(ctx, "POST", secrets, map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]interface{}{
+				"name":   name,
+				"labels": map[string]string{"app": "spectacle"},
+			},
+			"stringData": map[string]string{"token": token},
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not create token secret")
+		}
+		res.Body.Close()
+		defer (func() {
+			res, err := k.request(context.Background(), "DELETE", secrets+"/"+name, nil)
+			if err == nil {
+				res.Body.Close()
+			}
+		})()
+		env = append(env, map[string]interface{}{
+			"name": "SPECTACLE_TOKEN",
+			"valueFrom": map[string]interface{}{
+				"secretKeyRef": map[string]string{"name": name, "key": "token"},
+			},
+		})
+	}
+	// Repo limits win over the backend's, which win over the global ones
+	resources := map[string]string{}
+	for _, limit := range [][]string{
+		{"cpu", job.Repo.CpuLimit, k.config.Cpu, *cpuLimit},
+		{"memory", job.Repo.MemoryLimit, k.config.Memory, *memoryLimit},
+	} {
+		for _, value := range limit[1:] {
+			if value != "" {
+				resources[limit[0]] = value
+				break
+			}
+		}
+	}
+	manifest := map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]interface{}{
+			"name":   name,
+			"labels": map[string]string{"app": "spectacle"},
+		},
+		"spec": map[string]interface{}{
+			"backoffLimit":            0,
+			"ttlSecondsAfterFinished": 3600,
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"restartPolicy": "Never",
+					"containers": []map[string]interface{}{{
+						"name":      "build",
+						"image":     k.config.Image,
+						"command":   []string{"sh", "-c", remoteScript},
+						"env":       env,
+						"resources": map[string]interface{}{"limits": resources},
+					}},
+				},
+			},
+		},
+	}
+	res, err := k.request(ctx, "POST", jobs, manifest)
+	if err != nil {
+		return errors.Wrap(err, "could not create job")
+	}
+	res.Body.Close()
+	started := false
+	defer (func() {
+		if ctx.Err() != nil || !started {
+			res, err := k.request(context.Background(), "DELETE", jobs+"/"+name+"?propagationPolicy=Background", nil)
+			if err == nil {
+				res.Body.Close()
+			}
+		}
+	})()
+
+	// Wait for the pod to start before following its log, giving up on
+	// images that can't be pulled or containers that can't be created
+	pod := ""
+	deadline := time.Now().Add(k.config.StartTimeout)
+	for pod == "" {
+		list := struct {
+			Items []struct {
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+				Status struct {
+					Phase             string `json:"phase"`
+					ContainerStatuses []struct {
+						State struct {
+							Waiting *struct {
+								Reason  string `json:"reason"`
+								Message string `json:"message"`
+							} `json:"waiting"`
+						} `json:"state"`
+					} `json:"containerStatuses"`
+				} `json:"status"`
+			} `json:"items"`
+		}{}
+		if err := k.get(ctx, pods+"?labelSelector="+url.QueryEscape("job-name="+name), &list); err != nil {
+			return errors.Wrap(err, "could not find pod")
+		}
+		for _, item := range list.Items {
+			if item.Status.Phase != "Pending" {
+				pod = item.Metadata.Name
+			}
+			for _, container := range item.Status.ContainerStatuses {
+				if waiting := container.State.Waiting; waiting != nil {
+					switch waiting.Reason {
+					case "ErrImagePull", "ImagePullBackOff", "CreateContainerConfigError":
+						return errors.Errorf("pod %s can't start, %s: %s", item.Metadata.Name, waiting.Reason, waiting.Message)
+					}
+				}
+			}
+		}
+		if pod == "" {
+			if time.Now().After(deadline) {
+				return errors.Errorf("pod of job %s did not start within %s", name, k.config.StartTimeout)
+			}
+			if err := sleepContext(ctx, 2*time.Second); err != nil {
+				return err
+			}
+		}
+	}
+	started = true
+
+	res, err = k.request(ctx, "GET", pods+"/"+pod+"/log?follow=true", nil)
+	if err != nil {
+		return errors.Wrap(err, "could not follow log")
+	}
+	_, err = io.Copy(log, res.Body)
+	res.Body.Close()
+	if err != nil {
+		return errors.Wrap(err, "could not follow log")
+	}
+
+	for {
+		status := struct {
+			Status struct {
+				Succeeded int `json:"succeeded"`
+				Failed    int `json:"failed"`
+			} `json:"status"`
+		}{}
+		if err := k.get(ctx, jobs+"/"+name, &status); err != nil {
+			return errors.Wrap(err, "could not read job status")
+		}
+		if status.Status.Succeeded > 0 {
+			return nil
+		} else if status.Status.Failed > 0 {
+			return errors.New("job failed")
+		}
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return errors.New("cancelled")
+	}
+}
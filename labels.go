@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// localLabels are the capabilities of this instance's workers, and
+// backendLabels those of each configured backend.
+var localLabels = map[string]bool{}
+var backendLabels = map[string]map[string]bool{}
+
+// noRunnerError refuses builds asking for labels no runner has.
+type noRunnerError []string
+
+func (e noRunnerError) Error() string {
+	return "no matching runner for labels " + strings.Join(e, ",")
+}
+
+func labelSet(labels []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, label := range labels {
+		if label = strings.TrimSpace(label); label != "" {
+			set[label] = true
+		}
+	}
+	return set
+}
+
+func labelList(set map[string]bool) []string {
+	list := make([]string, 0, len(set))
+	for label := range set {
+		list = append(list, label)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// detectLabels gathers the labels of this instance, its os and arch along
+// with docker and nix when installed, besides the configured ones.
+func detectLabels(configured string) map[string]bool {
+	labels := labelSet(strings.Split(configured, ","))
+	labels[runtime.GOOS+"-"+runtime.GOARCH] = true
+	for _, tool := range []string{"docker", "nix"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			labels[tool] = true
+		}
+	}
+	return labels
+}
+
+func hasLabels(have map[string]bool, want []string) bool {
+	for _, label := range want {
+		if label = strings.TrimSpace(label); label != "" && !have[label] {
+			return false
+		}
+	}
+	return true
+}
+
+// jobLabels lists the labels a job asks for, its repo's and those of the
+// route it took.
+func jobLabels(job BuildJob) []string {
+	return labelList(labelSet(append(append([]string{}, job.Repo.Labels...), job.Build.Labels...)))
+}
+
+// pinnedRunner names the runner a job must run on, if any.
+func pinnedRunner(job BuildJob) string {
+	if job.Build.Runner != "" {
+		return job.Build.Runner
+	}
+	return job.Repo.Runner
+}
+
+// pickRunner decides where a job runs, on the backend picked for it by
+// policy, fork or repo, else locally or on a backend with its labels. Fork
+// builds are refused rather than run on this host, where they could read
+// spectacle.ini whatever secrets are withheld, unless the repo's
+// fork_backend is local.
+func pickRunner(job *BuildJob) (string, error) {
+	name := job.Repo.Backend
+	if job.Build.Fork {
+		name = forkBackend(job.Repo)
+	}
+	if job.Build.Backend != "" {
+		name = job.Build.Backend
+	}
+	if job.Build.Fork && (name == "" || name == "local") && job.Repo.ForkBackend != "local" {
+		return "", errors.New("fork builds need an isolating backend like microvm, or fork_backend=local to run them on this host")
+	}
+	if name == "local" {
+		return runnerFor(jobLabels(*job), "", true)
+	}
+	return runnerFor(jobLabels(*job), name, false)
+}
+
+// runnerFor finds a runner with labels, backend being the one asked for if
+// any and local forcing this instance's workers.
+func runnerFor(labels []string, backend string, local bool) (string, error) {
+	if local || backend == "" {
+		if hasLabels(localLabels, labels) {
+			return "", nil
+		} else if local {
+			return "", errors.Errorf("local workers lack labels %s", strings.Join(labels, ","))
+		}
+	} else if _, ok := backends[backend]; !ok {
+		return "", errors.Errorf("unknown backend %s", backend)
+	} else if !hasLabels(backendLabels[backend], labels) {
+		return "", errors.Errorf("backend %s lacks labels %s", backend, strings.Join(labels, ","))
+	} else {
+		return backend, nil
+	}
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if hasLabels(backendLabels[name], labels) {
+			return name, nil
+		}
+	}
+	return "", noRunnerError(labels)
+}
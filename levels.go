@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[string]int{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// logLevels holds the level logged at, overridden per component (http,
+// queue, runner, git, store, daemon) and for git per repo.
+var logLevels = struct {
+	sync.RWMutex
+	global     int
+	components map[string]int
+}{
+	global:     levelInfo,
+	components: make(map[string]int),
+}
+
+func parseLevel(level string) (int, error) {
+	if level == "" {
+		return levelInfo, nil
+	}
+	value, ok := levelNames[level]
+	if !ok {
+		return 0, errors.Errorf("unknown log level %s", level)
+	}
+	return value, nil
+}
+
+// setLogLevel sets how verbose the log is, components listed as
+// component:level pairs separated by commas.
+func setLogLevel(level, components string) error {
+	global, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	levels := make(map[string]int)
+	for _, pair := range strings.Split(components, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("bad log component %s", pair)
+		}
+		if levels[parts[0]], err = parseLevel(parts[1]); err != nil {
+			return err
+		}
+	}
+
+	logLevels.Lock()
+	logLevels.global = global
+	logLevels.components = levels
+	logLevels.Unlock()
+	return nil
+}
+
+// logEnabled reports whether component logs at level, the repo's git level
+// taking precedence for git.
+func logEnabled(level int, component string, repo *Repo) bool {
+	if repo != nil && component == "git" && repo.GitLogLevel != "" {
+		if threshold, err := parseLevel(repo.GitLogLevel); err == nil {
+			return level >= threshold
+		}
+	}
+	logLevels.RLock()
+	defer logLevels.RUnlock()
+
+	threshold, ok := logLevels.components[component]
+	if !ok {
+		threshold = logLevels.global
+	}
+	return level >= threshold
+}
+
+func logf(level int, component string, repo *Repo, format string, args ...interface{}) {
+	if logEnabled(level, component, repo) {
+		log.Printf(format, args...)
+	}
+}
+
+func debugf(component, format string, args ...interface{}) {
+	logf(levelDebug, component, nil, format, args...)
+}
+
+func infof(component, format string, args ...interface{}) {
+	logf(levelInfo, component, nil, format, args...)
+}
+
+func warnf(component, format string, args ...interface{}) {
+	logf(levelWarn, component, nil, format, args...)
+}
+
+func errorf(component, format string, args ...interface{}) {
+	logf(levelError, component, nil, format, args...)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const maxSearchLines = 5
+
+// LogIndex maps the words of the logs of each repo's latest builds to the
+// builds whose logs hold them, so searches only read the logs that may
+// match. Queries match whole words, the lines holding the query being found
+// in the candidate logs.
+type LogIndex struct {
+	sync.Mutex
+	retain int
+	builds map[string][]int
+	words  map[string]map[string]bool
+	keys   map[string][]string
+}
+
+type LogMatch struct {
+	Repo   string    `json:"repo"`
+	Number int       `json:"number"`
+	Branch string    `json:"branch"`
+	Commit string    `json:"commit"`
+	Status string    `json:"status"`
+	Queued time.Time `json:"queued"`
+	Lines  []LogLine `json:"lines"`
+}
+
+type LogLine struct {
+	Number int    `json:"number"`
+	Text   string `json:"text"`
+}
+
+var logIndex *LogIndex
+
+// NewLogIndex indexes the logs of the latest retain finished builds of each
+// repo in the background.
+func NewLogIndex(retain int, repos []Repo) *LogIndex {
+	index := &LogIndex{
+		retain: retain,
+		builds: make(map[string][]int),
+		words:  make(map[string]map[string]bool),
+		keys:   make(map[string][]string),
+	}
+	go func() {
+		for _, repo := range repos {
+			builds := store.List(repo.Name)
+			finished := make([]Build, 0, retain)
+			for _, build := range builds {
+				if len(finished) == retain {
+					break
+				} else if build.Status == "OK" || build.Status == "FAIL" || build.Status == "CANCELLED" {
+					finished = append(finished, build)
+				}
+			}
+			for i := len(finished) - 1; i >= 0; i-- {
+				index.Add(finished[i])
+			}
+		}
+	}()
+	return index
+}
+
+func logWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// Add indexes the log of a finished build, dropping the repo's oldest
+// indexed build once more than retain are.
+func (x *LogIndex) Add(build Build) {
+	f, err := os.Open(build.Log)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		for _, word := range logWords(scanner.Text()) {
+			seen[word] = true
+		}
+	}
+
+	key := jobKey(build.Repo, build.Number)
+	x.Lock()
+	defer x.Unlock()
+	x.drop(key)
+	for word := range seen {
+		if x.words[word] == nil {
+			x.words[word] = make(map[string]bool)
+		}
+		x.words[word][key] = true
+		x.keys[key] = append(x.keys[key], word)
+	}
+	x.builds[build.Repo] = append(x.builds[build.Repo], build.Number)
+	for len(x.builds[build.Repo]) > x.retain {
+		x.drop(jobKey(build.Repo, x.builds[build.Repo][0]))
+		x.builds[build.Repo] = x.builds[build.Repo][1:]
+	}
+}
+
+func (x *LogIndex) drop(key string) {
+	for _, word := range x.keys[key] {
+		delete(x.words[word], key)
+		if len(x.words[word]) == 0 {
+			delete(x.words, word)
+		}
+	}
+	delete(x.keys, key)
+}
+
+// candidates lists the indexed builds whose logs hold every word of query.
+func (x *LogIndex) candidates(query string) []string {
+	x.Lock()
+	defer x.Unlock()
+
+	var result map[string]bool
+	for _, word := range logWords(query) {
+		next := make(map[string]bool)
+		for key := range x.words[word] {
+			if result == nil || result[key] {
+				next[key] = true
+			}
+		}
+		result = next
+	}
+	keys := make([]string, 0, len(result))
+	for key := range result {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Search finds the lines holding query in the indexed logs of the builds
+// allowed, oldest build first.
+func (x *LogIndex) Search(query string, allowed func(repo string) bool) []LogMatch {
+	needle := strings.ToLower(strings.TrimSpace(query))
+	matches := make([]LogMatch, 0, 10)
+	if needle == "" {
+		return matches
+	}
+	for _, key := range x.candidates(needle) {
+		i := strings.LastIndex(key, "#")
+		number, _ := strconv.Atoi(key[i+1:])
+		build, ok := store.Get(key[:i], number)
+		if !ok || !allowed(build.Repo) {
+			continue
+		}
+		if lines := grepLog(build.Log, needle); len(lines) > 0 {
+			matches = append(matches, LogMatch{
+				Repo:   build.Repo,
+				Number: build.Number,
+				Branch: build.Branch,
+				Commit: build.Commit,
+				Status: build.Status,
+				Queued: build.Queued,
+				Lines:  lines,
+			})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Queued.Before(matches[j].Queued)
+	})
+	return matches
+}
+
+func grepLog(path, needle string) []LogLine {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	lines := make([]LogLine, 0, maxSearchLines)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for number := 1; scanner.Scan() && len(lines) < maxSearchLines; number++ {
+		if strings.Contains(strings.ToLower(scanner.Text()), needle) {
+			lines = append(lines, LogLine{number, scanner.Text()})
+		}
+	}
+	return lines
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LogShippingConfig is the [logs] section, the keys of object store sinks
+// being mapped to Store.
+type LogShippingConfig struct {
+	Sink      string            `ini:"sink"`
+	Url       string            `ini:"url"`
+	Tenant    string            `ini:"tenant"`
+	ChunkSize int               `ini:"chunk_size"`
+	Interval  time.Duration     `ini:"interval"`
+	Store     ObjectStoreConfig `ini:"-"`
+}
+
+type logChunk struct {
+	Repo string
+	Log  string
+	Seq  int
+	Time time.Time
+	Data []byte
+}
+
+type logSink interface {
+	ship(chunk logChunk) error
+}
+
+// LogShipper ships step logs off the build host while they are written, in
+// chunks of chunk_size or what was written in the last interval, so they
+// survive the host going away mid build.
+type LogShipper struct {
+	chunkSize int
+	interval  time.Duration
+	sink      logSink
+}
+
+var logShipper *LogShipper
+
+func NewLogShipper(config LogShippingConfig) (*LogShipper, error) {
+	shipper := &LogShipper{
+		chunkSize: config.ChunkSize,
+		interval:  config.Interval,
+	}
+	if shipper.chunkSize <= 0 {
+		shipper.chunkSize = 64 * 1024
+	}
+	if shipper.interval <= 0 {
+		shipper.interval = 5 * time.Second
+	}
+
+	switch config.Sink {
+	case "s3", "gcs", "azure":
+		config.Store.Backend = config.Sink
+		store, err := openObjectStore(config.Store)
+		if err != nil {
+			return nil, err
+		}
+		shipper.sink = objectLogs{store}
+	case "loki":
+		if config.Url == "" {
+			return nil, errors.New("loki log shipping needs a url")
+		}
+		shipper.sink = lokiLogs{
+			url:    strings.TrimSuffix(config.Url, "/") + "/loki/api/v1/push",
+			tenant: config.Tenant,
+			client: &http.Client{Timeout: 30 * time.Second},
+		}
+	default:
+		return nil, errors.Errorf("unknown log sink %s, expected loki, s3, gcs or azure", config.Sink)
+	}
+	return shipper, nil
+}
+
+// Open starts shipping the log named name of repo, what is written to the
+// returned log shipped until it is closed.
+func (s *LogShipper) Open(repo, name string) *ShippedLog {
+	l := &ShippedLog{
+		shipper: s,
+		repo:    repo,
+		name:    name,
+		full:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// ShippedLog buffers what is written to it for the shipper, writes never
+// waiting on the sink.
+type ShippedLog struct {
+	sync.Mutex
+	shipper *LogShipper
+	repo    string
+	name    string
+	buffer  []byte
+	seq     int
+	full    chan struct{}
+	closed  chan struct{}
+	done    chan struct{}
+}
+
+func (l *ShippedLog) Write(p []byte) (int, error) {
+	l.Lock()
+	l.buffer = append(l.buffer, p...)
+	full := len(l.buffer) >= l.shipper.chunkSize
+	l.Unlock()
+	if full {
+		select {
+		case l.full <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// Close ships what is left and waits for it to be shipped.
+func (l *ShippedLog) Close() error {
+	close(l.closed)
+	<-l.done
+	return nil
+}
+
+func (l *ShippedLog) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.shipper.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.full:
+		case <-l.closed:
+			l.flush()
+			return
+		}
+		l.flush()
+	}
+}
+
+// flush ships the buffer, retrying a few times before dropping the chunk.
+func (l *ShippedLog) flush() {
+	l.Lock()
+	data := l.buffer
+	l.buffer = nil
+	l.Unlock()
+	if len(data) == 0 {
+		return
+	}
+
+	l.seq++
+	chunk := logChunk{
+		Repo: l.repo,
+		Log:  l.name,
+		Seq:  l.seq,
+		Time: time.Now(),
+		Data: data,
+	}
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err = l.shipper.sink.ship(chunk); err == nil {
+			return
+		}
+	}
+	warnf("runner", "├could not ship chunk %d of log %s, %s\n", chunk.Seq, l.name, err.Error())
+}
+
+// objectLogs puts each chunk as an object of its own,
+// <repo>/<log>/<seq>.log, objects having no appends.
+type objectLogs struct {
+	store ObjectStore
+}
+
+func (o objectLogs) ship(chunk logChunk) error {
+	key := fmt.Sprintf("%s/%s/%06d.log", chunk.Repo, chunk.Log, chunk.Seq)
+	return o.store.Put(key, chunk.Data, "text/plain; charset=utf-8")
+}
+
+// lokiLogs pushes the lines of each chunk to a stream labeled with the repo
+// and log, lines timed a nanosecond apart to keep their order.
+type lokiLogs struct {
+	url    string
+	tenant string
+	client *http.Client
+}
+
+func (l lokiLogs) ship(chunk logChunk) error {
+	values := [][]string{}
+	for i, line := range strings.Split(strings.TrimSuffix(string(chunk.Data), "\n"), "\n") {
+		values = append(values, []string{strconv.FormatInt(chunk.Time.UnixNano()+int64(i), 10), line})
+	}
+	raw, _ := json.Marshal(map[string]interface{}{
+		"streams": []interface{}{
+			map[string]interface{}{
+				"stream": map[string]string{
+					"job":  "spectacle",
+					"repo": chunk.Repo,
+					"log":  chunk.Log,
+				},
+				"values": values,
+			},
+		},
+	})
+
+	req, err := http.NewRequest("POST", l.url, bytes.NewReader(raw))
+	if err != nil {
+		return errors.Wrap(err, "bad loki url")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", l.tenant)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not push to loki")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("could not push to loki, " + strings.TrimSpace(resp.Status+" "+string(message)))
+	}
+	return nil
+}
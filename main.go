@@ -1,246 +1,613 @@
 package main
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/go-ini/ini"
-	"github.com/pkg/errors"
 )
 
-type Repo struct {
-	Name   string
-	Secret string `ini:"secret"`
-	Branch string `ini:"branch"`
-}
+var publicUrl = flag.String("url", "", "public base url of spectacle, used for log links")
+var workers = flag.Int("workers", 1, "number of builds to run at once")
+var otlpEndpoint = flag.String("otlp", "", "OTLP/HTTP collector url traces are exported to, disabled if empty")
+var captureDir = flag.String("capture", "", "directory rejected hooks are dumped to for debugging, with secrets redacted")
+var dryRun = flag.Bool("dry-run", false, "handle hooks without queueing builds, logging what would have been")
+var runnerLabels = flag.String("labels", "", "labels of this instance's runner besides its detected os-arch, docker and nix")
+var runnerName = flag.String("runner", "", "name of this instance's runner, repos pinned to other runners are left to those")
+var queueSize = flag.Int("queue", 100, "max queued builds before hooks are refused")
+var cpuLimit = flag.String("cpu-limit", "", "default cpus a build may use, unlimited if empty")
+var memoryLimit = flag.String("memory-limit", "", "default memory a build may use, unlimited if empty")
+var redisQueue = flag.String("redis", "", "redis url of a build queue shared with other instances, local queue if empty")
+var visibility = flag.Duration("visibility", 2*time.Minute, "how long a shared queue claim lasts without being renewed")
+var pluginDir = flag.String("plugins", "", "directory of executables providing extra step types, none if empty")
+var wasmRuntime = flag.String("wasm-runtime", "wasmtime", "runtime running wasm policy modules with \"run\"")
+var sentryDsn = flag.String("sentry", "", "sentry dsn panics and infrastructure errors are reported to, disabled if empty")
+var maxPayload = flag.Int64("max-payload", 25<<20, "max size in bytes of a hook's body, larger ones are refused")
+var pidFile = flag.String("pidfile", "", "file the pid is written to, none if empty")
+var daemon = flag.Bool("daemon", false, "detach from the terminal and run in the background")
+var logFile = flag.String("log", "", "file logged to, reopened on SIGUSR1, stderr if empty")
+var buildCache = flag.String("cache", "", "directory of the build cache shared by builds, disabled if empty")
 
 type GithubPayload struct {
 	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Forced     bool   `json:"forced"`
+	Deleted    bool   `json:"deleted"`
 	Repository struct {
 		Name     string `json:"name"`
 		FullName string `json:"full_name"`
 	} `json:"repository"`
-}
-
-type BuildJob struct {
-	Name   string
-	Url    string
-	Branch string
-}
-
-var worker chan BuildJob
-
-func queueWork(job BuildJob) {
-	go (func() {
-		worker <- job
-	})()
-}
-
-func jobRunner() {
-	worker = make(chan BuildJob)
-
-	for {
-		job := <-worker
-
-		start := time.Now()
-		log.Printf("┌running build job on %s|%s\n", job.Name, job.Branch)
-
-		err := (func() error {
-			// Set up working directory and prepare
-			tmpDir := "/tmp/spectacle-" + strings.Replace(job.Name, "/", "-", -1)
-			buildPath := tmpDir + "/src/github.com/" + job.Name
-			if info, _ := os.Stat(tmpDir); info != nil {
-				if err := os.RemoveAll(tmpDir); err != nil {
-					log.Printf("├could not remove temporary files, %s", err.Error())
-					return errors.Wrap(err, "remove failed")
-				}
-			}
-			os.MkdirAll(buildPath, os.ModePerm)
-			filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
-				if err == nil {
-					err = os.Chown(path, 1001, 1001)
-				}
-				return err
-			})
-
-			// Fetch code
-			gitCmd := exec.Command("git", "clone", job.Url, buildPath)
-			if err := gitCmd.Run(); err != nil {
-				log.Printf("├failed to prepare for build, %s", err.Error())
-				return errors.Wrap(err, "git command failed")
-			}
-
-			// Find and run build/service script
-			if _, err := os.Stat(buildPath + "/spectacle.sh"); os.IsNotExist(err) {
-				log.Println("├no spectacle.sh, aborting")
-				return errors.Wrap(err, "missing spectacle.sh")
-			}
-			buildCmd := exec.Command("sh", "spectacle.sh")
-			buildCmd.Dir = buildPath
-			buildCmd.Env = []string{
-				"HOME=/home/spectacle",
-				"GOPATH=" + tmpDir,
-				"PATH=/usr/local/sbin:/usr/local/bin:/usr/bin",
-			}
-			if err := buildCmd.Run(); err != nil {
-				log.Printf("├failed to complete, %s", err.Error())
-				return errors.Wrap(err, "error when running spectacle.sh")
-			}
-
-			return nil
-		})()
-
-		status := "OK"
-		if err != nil {
-			status = "FAIL"
-		}
-		log.Printf("└[%s] in %.2fs\n", status, float64(time.Since(start))/float64(time.Second))
-	}
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Head struct {
+			Ref  string `json:"ref"`
+			Sha  string `json:"sha"`
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+		AuthorAssociation string `json:"author_association"`
+	} `json:"pull_request"`
+
+	Issue struct {
+		Number      int       `json:"number"`
+		PullRequest *struct{} `json:"pull_request"`
+	} `json:"issue"`
+	Comment struct {
+		Body              string `json:"body"`
+		AuthorAssociation string `json:"author_association"`
+	} `json:"comment"`
 }
 
 type HookHandler struct {
-	Repos []Repo
+	Repos  *RepoSet
+	Strict bool
 }
 
 func (h HookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", "spectacle")
 
 	start := time.Now()
-	log.Printf("┌%s", r.URL.Path)
+	infof("http", "┌%s", r.URL.Path)
+
+	delivery := newDelivery(r, start)
+	span := startSpan(r.Header.Get("traceparent"), "hook")
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = recorder
+	var raw []byte
 	defer func() {
-		log.Printf("└done in %.2fms", float64(time.Since(start))/float64(time.Millisecond))
+		delivery.Status = recorder.status
+		span.Set("github.event", delivery.Event)
+		span.Set("spectacle.repo", delivery.Repo)
+		span.Set("spectacle.reason", delivery.Reason)
+		span.Set("http.status_code", strconv.Itoa(delivery.Status))
+		span.End()
+		if err := store.AddDelivery(delivery); err != nil {
+			errorf("http", "├could not record delivery, %s", err.Error())
+		}
+		if *captureDir != "" && delivery.Status >= 400 {
+			if raw == nil {
+				raw, _ = ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+			}
+			if err := captureDelivery(*captureDir, delivery, raw); err != nil {
+				warnf("http", "├%s", err.Error())
+			}
+		}
+		infof("http", "└done in %.2fms", float64(time.Since(start))/float64(time.Millisecond))
 	}()
 
 	if r.URL.Path != "/hook" {
+		delivery.Reason = "unknown path"
 		http.Error(w, "404 not found", http.StatusNotFound)
 		return
 	} else if r.Method != "POST" {
+		delivery.Reason = "method not allowed"
 		http.Error(w, "405 forbidden", http.StatusMethodNotAllowed)
 		return
-	} else if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, "400 bad request", http.StatusBadRequest)
+	}
+	form := false
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if charset := strings.ToLower(params["charset"]); charset != "" && charset != "utf-8" {
+		mediaType = ""
+	}
+	switch {
+	case err != nil:
+		delivery.Reason = "malformed content type"
+		badRequest(w, h.Strict, "content type is malformed, "+err.Error())
 		return
-	} else if len(r.Header.Get("X-Hub-Signature")) < 45 {
-		http.Error(w, "400 bad request", http.StatusBadRequest)
+	case mediaType == "application/json":
+	case mediaType == "application/x-www-form-urlencoded":
+		form = true
+	default:
+		delivery.Reason = "unsupported content type"
+		badRequest(w, h.Strict, "content type must be application/json or application/x-www-form-urlencoded")
+		return
+	}
+	if len(r.Header.Get("X-Hub-Signature")) < 45 {
+		delivery.Reason = "missing signature"
+		badRequest(w, h.Strict, "X-Hub-Signature header is missing, set a secret on the hook")
 		return
 	}
 
-	raw, _ := ioutil.ReadAll(r.Body)
+	if r.ContentLength > *maxPayload {
+		delivery.Reason = "payload too large"
+		http.Error(w, "413 request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 
+	// The payload is decoded as it is read, the body kept only as far as
+	// the cap for the signature. Form encoded hooks carry the json in a
+	// field, signed as a whole
+	body := &bytes.Buffer{}
+	tee := io.TeeReader(io.LimitReader(r.Body, *maxPayload+1), body)
 	payload := GithubPayload{}
-	err := json.Unmarshal(raw, &payload)
+	if !form {
+		err = json.NewDecoder(tee).Decode(&payload)
+	}
+	io.Copy(ioutil.Discard, tee)
+	raw = body.Bytes()
+	if int64(body.Len()) > *maxPayload {
+		delivery.Reason = "payload too large"
+		http.Error(w, "413 request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if form {
+		values, parseErr := url.ParseQuery(body.String())
+		if parseErr != nil || values.Get("payload") == "" {
+			delivery.Reason = "malformed form payload"
+			badRequest(w, h.Strict, "form encoded hooks must carry the json in a payload field")
+			return
+		}
+		raw = []byte(values.Get("payload"))
+		err = json.NewDecoder(bytes.NewReader(raw)).Decode(&payload)
+	}
+	delivery.Payload = string(raw)
+	if len(raw) > maxAuditPayload {
+		delivery.Payload = string(raw[:maxAuditPayload])
+	}
 	if err != nil {
+		delivery.Reason = "malformed payload, " + err.Error()
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	delivery.Repo = payload.Repository.FullName
 
 	// Find config
-	repo, ok := (func() (*Repo, bool) {
-		for _, repo := range h.Repos {
-			if repo.Name == payload.Repository.FullName {
-				return &repo, true
-			}
+	repo := h.Repos.Find(payload.Repository.FullName)
+	if repo == nil {
+		delivery.Reason = "unknown repo"
+		if payload.Repository.FullName == "" {
+			badRequest(w, h.Strict, "repository.full_name is missing")
+		} else {
+			badRequest(w, h.Strict, "repository "+payload.Repository.FullName+" is not configured")
 		}
-		return nil, false
-	})()
-
-	if !ok {
-		http.Error(w, "400 bad request", http.StatusBadRequest)
 		return
 	}
 
 	// Verify signature
-	mac := hmac.New(sha1.New, []byte(repo.Secret))
-	mac.Write(raw)
+	secret := repo.Secret
+	if secret == "" && githubApp != nil {
+		secret = githubApp.config.WebhookSecret
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body.Bytes())
 	sum := mac.Sum(nil)
 	actual := make([]byte, 20)
 	hex.Decode(actual, []byte(r.Header.Get("X-Hub-Signature")[5:]))
 	if !hmac.Equal(sum, actual) {
+		delivery.Reason = "signature mismatch"
 		http.Error(w, "403 forbidden", http.StatusForbidden)
 		return
 	}
 
-	// Handle event
-	event := r.Header.Get("X-GitHub-Event")
-	log.Printf("├incoming hook: %s|%s\n", repo.Name, event)
+	if h.Strict {
+		if problems := validatePayload(delivery.Event, payload); len(problems) > 0 {
+			delivery.Reason = "invalid payload, " + strings.Join(problems, ", ")
+			badRequest(w, true, problems...)
+			return
+		}
+	}
+
+	if delivery.Id != "" {
+		if err := store.SavePayload(delivery.Id, raw); err != nil {
+			warnf("http", "├could not keep payload, %s", err.Error())
+		}
+	}
+	h.handle(w, repo, delivery.Event, raw, payload, &delivery, span)
+}
+
+// handle acts on a verified hook, also used to replay deliveries.
+func (h HookHandler) handle(w http.ResponseWriter, repo *Repo, event string, raw []byte, payload GithubPayload, delivery *Delivery, span *Span) {
+	infof("http", "├incoming hook: %s|%s\n", repo.Name, event)
 	switch event {
 	case "ping":
-		log.Println("├ping")
+		debugf("http", "├ping")
+		delivery.Reason = "ping"
 	case "watch":
-		log.Println("├to be implemented")
+		infof("http", "├to be implemented\n")
+		delivery.Reason = "watch not implemented"
 	case "push":
-		if !strings.HasSuffix(payload.Ref, repo.Branch) {
-			log.Printf("├ignored ref \"%s\"\n", payload.Ref)
+		tag := ""
+		if strings.HasPrefix(payload.Ref, "refs/tags/") && repo.Tags && !payload.Deleted {
+			tag = strings.TrimPrefix(payload.Ref, "refs/tags/")
+		} else if !strings.HasSuffix(payload.Ref, repo.Branch) || payload.Deleted {
+			debugf("http", "├ignored ref \"%s\"\n", payload.Ref)
+			delivery.Reason = "ignored ref " + payload.Ref
 			break
 		}
 
-		log.Println("├queued build")
-		queueWork(BuildJob{
-			Name:   repo.Name,
-			Url:    "https://github.com/" + repo.Name,
-			Branch: repo.Branch,
-		})
+		branch := repo.Branch
+		if tag != "" {
+			branch = tag
+		}
+		build := Build{
+			Repo:   repo.Name,
+			Branch: branch,
+			Tag:    tag,
+			Commit: payload.After,
+			Forced: payload.Forced,
+			Author: payload.Sender.Login,
+			Trace:  span.Traceparent(),
+		}
+		if !h.admit(w, repo, event, raw, &build, delivery) {
+			return
+		}
+		build, err := queueBuild(repo, build)
+		if err != nil {
+			delivery.Reason = "not queued, " + err.Error()
+			refuseBuild(w, err)
+			return
+		}
+		infof("http", "├queued build #%d\n", build.Number)
+		delivery.Reason = fmt.Sprintf("queued build #%d", build.Number)
+	case "pull_request":
+		if payload.Action != "opened" && payload.Action != "synchronize" && payload.Action != "reopened" {
+			debugf("http", "├ignored action \"%s\"\n", payload.Action)
+			delivery.Reason = "ignored action " + payload.Action
+			break
+		} else if payload.PullRequest.Base.Ref != repo.Branch {
+			debugf("http", "├ignored base \"%s\"\n", payload.PullRequest.Base.Ref)
+			delivery.Reason = "ignored base " + payload.PullRequest.Base.Ref
+			break
+		}
+
+		build := Build{
+			Repo:   repo.Name,
+			Branch: payload.PullRequest.Head.Ref,
+			Commit: payload.PullRequest.Head.Sha,
+			Pull:   payload.Number,
+			Fork:   payload.PullRequest.Head.Repo.FullName != repo.Name,
+			Author: payload.Sender.Login,
+			Trace:  span.Traceparent(),
+		}
+		if !h.admit(w, repo, event, raw, &build, delivery) {
+			return
+		}
+		if build.Fork && repo.ForkApproval && firstTimer(payload.PullRequest.AuthorAssociation) {
+			build, err := holdBuild(repo, build)
+			if err != nil {
+				delivery.Reason = "not held, " + err.Error()
+				refuseBuild(w, err)
+				return
+			}
+			infof("http", "├held build #%d of first time contributor %s for approval\n", build.Number, build.Author)
+			delivery.Reason = fmt.Sprintf("build #%d awaits approval", build.Number)
+			break
+		}
+		build, err := queueBuild(repo, build)
+		if err != nil {
+			delivery.Reason = "not queued, " + err.Error()
+			refuseBuild(w, err)
+			return
+		}
+		infof("http", "├queued build #%d for pull request #%d\n", build.Number, build.Pull)
+		delivery.Reason = fmt.Sprintf("queued build #%d", build.Number)
+	case "issue_comment":
+		if payload.Action != "created" || payload.Issue.PullRequest == nil || !isApproveComment(payload.Comment.Body) {
+			debugf("http", "├ignored comment")
+			delivery.Reason = "ignored comment"
+			break
+		} else if !maintainer(payload.Comment.AuthorAssociation) || !repo.Permits("approve", payload.Sender.Login) {
+			infof("http", "├ignored approval by %s\n", payload.Sender.Login)
+			delivery.Reason = "approval by " + payload.Sender.Login + " not allowed"
+			break
+		}
+		approved := approvePull(repo, payload.Issue.Number, payload.Sender.Login)
+		infof("http", "├approved %d builds of pull request #%d\n", len(approved), payload.Issue.Number)
+		delivery.Reason = fmt.Sprintf("approved %d builds", len(approved))
 	default:
-		log.Println("├unhandled")
+		debugf("http", "├unhandled")
+		delivery.Reason = "unhandled event"
 	}
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// admit runs the repo's policy on a build about to be queued, answering the
+// hook itself unless the build is accepted and not a dry run.
+func (h HookHandler) admit(w http.ResponseWriter, repo *Repo, event string, raw []byte, build *Build, delivery *Delivery) bool {
+	accept, reason, err := applyPolicy(repo, event, raw, build)
+	if err != nil {
+		warnf("http", "├%s", err.Error())
+		delivery.Reason = "policy failed"
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return false
+	} else if !accept {
+		infof("http", "├rejected by policy, %s\n", reason)
+		delivery.Reason = "rejected by policy, " + reason
+		w.WriteHeader(http.StatusAccepted)
+		return false
+	}
+	if *dryRun || repo.DryRun {
+		infof("http", "├dry run, would queue %s at %s\n", build.Branch, build.Commit)
+		delivery.Reason = fmt.Sprintf("dry run, would queue %s at %s", build.Branch, build.Commit)
+		w.WriteHeader(http.StatusAccepted)
+		return false
+	}
+	return true
+}
+
+// refuseBuild answers a hook whose build could not be queued, asking the
+// sender to back off when the queue is full and telling it when no runner
+// has the labels the build asks for.
+func refuseBuild(w http.ResponseWriter, err error) {
+	warnf("http", "├could not queue build, %s", err.Error())
+	if err == errQueueFull {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "429 too many requests", http.StatusTooManyRequests)
+		return
+	} else if _, ok := err.(noRunnerError); ok {
+		http.Error(w, "503 "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "500 internal server error", http.StatusInternalServerError)
+}
+
 func main() {
-	handler := HookHandler{
-		Repos: make([]Repo, 0, 10),
+	flag.Parse()
+	if flag.Arg(0) == "sandbox" {
+		log.Fatal(runSandboxed(strings.Split(flag.Arg(1), ","), flag.Args()[2:]))
+	}
+
+	if *sentryDsn != "" {
+		var err error
+		if sentry, err = NewSentry(*sentryDsn); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	cfg, err := ini.Load("spectacle.ini")
+	config, err := loadConfig("spectacle.ini")
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "could not read config"))
+		reportFatal(err)
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if !set["workers"] && config.Server.Workers > 0 {
+		*workers = config.Server.Workers
+	}
+	workDir = strings.TrimSuffix(config.Server.Workdir, "/")
+	cacheDir = workDir + "/spectacle-cache"
+	goModCache = workDir + "/spectacle-gomod"
+	if host, port, err := net.SplitHostPort(config.Server.Listen); err == nil {
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		cacheUrl = "http://" + net.JoinHostPort(host, port) + "/cache/"
+	}
+	if err := setLogLevel(config.Server.LogLevel, config.Server.LogComponents); err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "upgrade" {
+		pid, _ := strconv.Atoi(flag.Arg(1))
+		if pid == 0 && *pidFile != "" {
+			pid = readPid(*pidFile)
+		}
+		if err := upgrade(config.Server, pid); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "register" {
+		if err := registerHooks(config.Repos); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *daemon {
+		if *logFile == "" {
+			log.Fatal("daemon needs -log")
+		}
+		if err := daemonize(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *logFile != "" {
+		if err := openLog(*logFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *pidFile != "" {
+		if err := writePid(*pidFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	store, err = openStore(config.Storage)
+	if err != nil {
+		reportFatal(err)
+	}
+
+	setHooks(config.Hooks)
+	sinks = config.Sinks
+	for _, sink := range sinks {
+		if sink.QuietHours != "" {
+			go sink.releaseHeld()
+		}
+	}
+	for _, digest := range config.Digests {
+		go digest.Run()
+	}
+	if queueWaitAlert = config.Server.QueueWaitAlert; queueWaitAlert > 0 {
+		go watchQueueWait(config.Server.QueueWaitNotify)
+	}
+	repos := NewRepoSet(config.Repos)
+	go handleSignals(repos)
+	if config.Server.LogIndex > 0 {
+		logIndex = NewLogIndex(config.Server.LogIndex, config.Repos)
+	}
+	handler := HookHandler{
+		Repos:  repos,
+		Strict: config.Server.Validation == "strict",
+	}
+	if config.GithubApp != nil {
+		if githubApp, err = NewGithubApp(*config.GithubApp); err != nil {
+			log.Fatal(err)
+		}
 	}
-	cfg.BlockMode = false
 
-	for _, section := range cfg.Sections() {
-		name := section.Name()
-		if name == "DEFAULT" {
-			continue
+	if config.Kubernetes != nil {
+		if backends["kubernetes"], err = NewKubernetes(*config.Kubernetes); err != nil {
+			log.Fatal(err)
 		}
+		backendLabels["kubernetes"] = labelSet(config.Kubernetes.Labels)
+	}
 
-		repo := Repo{
-			Name: name,
+	if config.Nomad != nil {
+		if backends["nomad"], err = NewNomad(*config.Nomad); err != nil {
+			log.Fatal(err)
 		}
-		if err := section.MapTo(&repo); err != nil {
-			log.Fatal(errors.Wrap(err, "failed to map repo config"))
+		backendLabels["nomad"] = labelSet(config.Nomad.Labels)
+	}
+
+	if config.MicroVM != nil {
+		if backends["microvm"], err = NewMicroVM(*config.MicroVM); err != nil {
+			log.Fatal(err)
 		}
-		handler.Repos = append(handler.Repos, repo)
+		backendLabels["microvm"] = labelSet(config.MicroVM.Labels)
 	}
 
-	names := []string{}
-	for _, repo := range handler.Repos {
+	if config.Exporter != nil {
+		exporter, err := NewExporter(*config.Exporter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go exporter.Run()
+	}
+
+	if config.Artifacts != nil {
+		if artifactStore, err = openObjectStore(*config.Artifacts); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.Logs != nil {
+		if logShipper, err = NewLogShipper(*config.Logs); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := setRoutes(config.Routes); err != nil {
+		log.Fatal(err)
+	}
+	localLabels = detectLabels(*runnerLabels)
+	infof("daemon", "runner labels: %s\n", strings.Join(labelList(localLabels), ", "))
+	names, refused := []string{}, []string{}
+	for _, repo := range repos.List() {
 		names = append(names, repo.Name)
+		if backend := forkBackend(repo); (backend == "" || backend == "local") && repo.ForkBackend != "local" {
+			refused = append(refused, repo.Name)
+		}
+	}
+	infof("daemon", "registered repos: %s\n", strings.Join(names, ", "))
+	if len(refused) > 0 {
+		warnf("daemon", "fork builds of %s will be refused, configure an isolating backend like microvm or set fork_backend=local\n", strings.Join(refused, ", "))
+	}
+	if len(config.Tokens) == 0 {
+		warnf("daemon", "no api tokens configured, api is unreachable\n")
+	}
+
+	if *buildCache != "" {
+		if blobCache, err = NewBlobCache(*buildCache); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, discovery := range config.Discovery {
+		go discoverRepos(discovery, repos)
 	}
-	log.Println("registered repos:", strings.Join(names, ", "))
 
-	go jobRunner()
+	if *otlpEndpoint != "" {
+		go exportSpans(*otlpEndpoint)
+	}
 
-	server := &http.Server{
-		Addr:           ":8283",
-		Handler:        handler,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+	if *pluginDir != "" {
+		if err := loadPlugins(*pluginDir); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	log.Println("going up...")
-	err = server.ListenAndServe()
+	if *redisQueue != "" {
+		if sharedQueue, err = NewSharedQueue(*redisQueue, *visibility, repos); err != nil {
+			log.Fatal(err)
+		}
+		go sharedQueue.Run()
+	}
+
+	for i := 0; i < *workers; i++ {
+		go jobRunner()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/hook", handler)
+	mux.Handle("/api/", ApiHandler{
+		Store:  store,
+		Repos:  repos,
+		Tokens: config.Tokens,
+	})
+	if blobCache != nil {
+		mux.Handle("/cache/", blobCache)
+	}
+	mux.Handle("/status", StatusHandler{
+		Store: store,
+		Repos: repos,
+	})
+	mux.Handle("/", DashboardHandler{
+		Config:  config.Dashboard,
+		Store:   store,
+		Repos:   repos,
+		Tenants: config.Tenants,
+	})
+
+	server := newServer(config.Server, panicReporter{mux})
+
+	infof("daemon", "going up...\n")
+	err = serve(server, config.Server)
 	if err != nil {
 		log.Fatal("could not start server,", err)
 	}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+type MicroVMConfig struct {
+	Image  string   `ini:"image"`
+	Kernel string   `ini:"kernel"`
+	Cpus   string   `ini:"cpus"`
+	Memory string   `ini:"memory"`
+	Size   string   `ini:"size"`
+	Labels []string `ini:"labels" delim:","`
+}
+
+// MicroVM boots a firecracker vm per build with ignite, for code not trusted
+// to run on the host. The checkout is made on the host and copied in so the
+// vm never sees a token.
+type MicroVM struct {
+	config MicroVMConfig
+}
+
+func NewMicroVM(config MicroVMConfig) (*MicroVM, error) {
+	if config.Image == "" {
+		return nil, errors.New("microvm backend has no image")
+	}
+	if _, err := exec.LookPath("ignite"); err != nil {
+		return nil, errors.Wrap(err, "microvm backend needs ignite")
+	}
+	return &MicroVM{
+		config: config,
+	}, nil
+}
+
+func (m *MicroVM) Run(ctx context.Context, job *BuildJob, log io.Writer) error {
+	name := remoteName(job)
+
+	dir, err := ioutil.TempDir("", "spectacle-vm-")
+	if err != nil {
+		return errors.Wrap(err, "could not create checkout dir")
+	}
+	defer os.RemoveAll(dir)
+	if err := checkout(job, dir+"/src", log); err != nil {
+		return err
+	}
+	if err := runGit(job, log, job.Url, "-C", dir+"/src", "remote", "set-url", "origin", job.Url); err != nil {
+		return errors.Wrap(err, "could not strip token from checkout")
+	}
+
+	args := []string{"run", m.config.Image, "--name", name, "--ssh"}
+	if m.config.Kernel != "" {
+		args = append(args, "--kernel-image", m.config.Kernel)
+	}
+	if m.config.Cpus != "" {
+		args = append(args, "--cpus", m.config.Cpus)
+	}
+	if m.config.Memory != "" {
+		args = append(args, "--memory", m.config.Memory)
+	}
+	if m.config.Size != "" {
+		args = append(args, "--size", m.config.Size)
+	}
+	if err := ignite(ctx, log, args...); err != nil {
+		return errors.Wrap(err, "could not boot vm")
+	}
+	defer exec.Command("ignite", "rm", "-f", name).Run()
+
+	if err := ignite(ctx, log, "cp", dir+"/src", name+":/src"); err != nil {
+		return errors.Wrap(err, "could not copy checkout into vm")
+	}
+
+	env := remoteEnv(job)
+	delete(env, "SPECTACLE_CLONE_URL")
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	script := &bytes.Buffer{}
+	for _, key := range keys {
+		script.WriteString("export " + key + "=" + shellQuote(env[key]) + "\n")
+	}
+	script.WriteString("cd /src && sh spectacle.sh\n")
+
+	return errors.Wrap(ignite(ctx, log, "exec", name, "sh", "-c", script.String()), "build failed in vm")
+}
+
+func ignite(ctx context.Context, log io.Writer, args ...string) error {
+	cmd := exec.Command("ignite", args...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	return runGroup(ctx, cmd)
+}
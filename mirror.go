@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// mirrors serializes updates of each repo's mirror.
+var mirrors = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{
+	locks: make(map[string]*sync.Mutex),
+}
+
+func mirrorLock(dir string) *sync.Mutex {
+	mirrors.Lock()
+	defer mirrors.Unlock()
+
+	lock, ok := mirrors.locks[dir]
+	if !ok {
+		lock = &sync.Mutex{}
+		mirrors.locks[dir] = lock
+	}
+	return lock
+}
+
+func mirrorDir(repo Repo) string {
+	return cacheDir + "/" + workspaceName(repo, repo.Name) + "/mirror.git"
+}
+
+// updateMirror brings the repo's bare mirror up to date with a fetch,
+// cloning it on first use. Checkouts borrow its objects so only what the
+// mirror lacks goes over the network.
+func updateMirror(job *BuildJob, cloneUrl string, logFile io.Writer) (string, error) {
+	dir := mirrorDir(job.Repo)
+	lock := mirrorLock(dir)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := os.Stat(dir + "/HEAD"); err != nil {
+		os.RemoveAll(dir)
+		if err := runGit(job, logFile, cloneUrl, "clone", "--mirror", cloneUrl, dir); err != nil {
+			os.RemoveAll(dir)
+			return "", errors.Wrap(err, "could not create mirror")
+		}
+		// Tokens expire, so fetches pass the url along each time
+		if err := runGit(job, logFile, cloneUrl, "-C", dir, "remote", "set-url", "origin", job.Url); err != nil {
+			return "", errors.Wrap(err, "could not create mirror")
+		}
+		return dir, nil
+	}
+	if err := runGit(job, logFile, cloneUrl, "-C", dir, "fetch", "--prune", cloneUrl, "+refs/*:refs/*"); err != nil {
+		return "", errors.Wrap(err, "could not update mirror")
+	}
+	// Worktrees of finished builds are removed along with their workspace
+	if err := runGit(job, logFile, cloneUrl, "-C", dir, "worktree", "prune"); err != nil {
+		return "", errors.Wrap(err, "could not prune worktrees")
+	}
+	return dir, nil
+}
+
+// addWorktree checks ref out of the mirror into dir as a worktree, sharing
+// the mirror's objects rather than copying them. Whatever runs in the
+// worktree can write to the mirror, so it is only for trusted builds.
+func addWorktree(job *BuildJob, cloneUrl, mirror, dir, ref string, logFile io.Writer) error {
+	lock := mirrorLock(mirror)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return runGit(job, logFile, cloneUrl, "-C", mirror, "worktree", "add", "--detach", dir, ref)
+}
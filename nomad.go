@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type NomadConfig struct {
+	Address string   `ini:"address"`
+	Token   string   `ini:"token"`
+	Job     string   `ini:"job"`
+	Task    string   `ini:"task"`
+	Labels  []string `ini:"labels" delim:","`
+}
+
+// Nomad dispatches builds to a parameterized batch job, the build script
+// being sent as the dispatch payload. The job is expected to take a required
+// payload, write it out with dispatch_payload and run it with sh.
+// The token to clone with is kept out of the payload, as an item of the
+// job's nomad/jobs/<job> variable named by the dispatch's spectacle_token
+// meta. Jobs building private repos are expected to take that meta as
+// optional and render the item to SPECTACLE_TOKEN with an env template,
+// {{ with nomadVar "nomad/jobs/<job>" }}SPECTACLE_TOKEN={{ index . (env "NOMAD_META_spectacle_token") }}{{ end }}.
+type Nomad struct {
+	config NomadConfig
+	client *http.Client
+}
+
+func NewNomad(config NomadConfig) (*Nomad, error) {
+	if config.Address == "" {
+		config.Address = "http://127.0.0.1:4646"
+	}
+	if config.Task == "" {
+		config.Task = "build"
+	}
+	if config.Job == "" {
+		return nil, errors.New("nomad backend has no job")
+	}
+	return &Nomad{
+		config: config,
+		client: &http.Client{},
+	}, nil
+}
+
+func (n *Nomad) request(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	res, err := n.send(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, errors.Errorf("unexpected status %s", res.Status)
+	}
+	return res, nil
+}
+
+// send is request leaving the status to the caller.
+func (n *Nomad) send(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	raw := []byte{}
+	if body != nil {
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			return nil, errors.Wrap(err, "could not encode request")
+		}
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(n.config.Address, "/")+path, bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create request")
+	}
+	req = req.WithContext(ctx)
+	if n.config.Token != "" {
+		req.Header.Set("X-Nomad-Token", n.config.Token)
+	}
+
+	res, err := n.client.Do(req)
+	return res, errors.Wrap(err, "request failed")
+}
+
+func (n *Nomad) call(ctx context.Context, method, path string, body, v interface{}) error {
+	res, err := n.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return errors.Wrap(json.NewDecoder(res.Body).Decode(v), "could not decode response")
+}
+
+// Run dispatches the job, follows the task's output once its allocation
+// starts and waits for it to finish, stopping it if the build is cancelled.
+func (n *Nomad) Run(ctx context.Context, job *BuildJob, log io.Writer) error {
+	env := remoteEnv(job)
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	script := &bytes.Buffer{}
+	script.WriteString("exec 2>&1\n")
+	for _, key := range keys {
+		script.WriteString("export " + key + "=" + shellQuote(env[key]) + "\n")
+	}
+	script.WriteString(remoteScript)
+
+	dispatch := map[string]interface{}{
+		"Payload": script.Bytes(),
+	}
+	if token := remoteToken(job); token != "" {
+		name := remoteName(job)
+		if err := n.updateToken(ctx, name, token); err != nil {
+			return errors.Wrap(err, "could not store token")
+		}
+		defer n.updateToken(context.Background(), name, "")
+		dispatch["Meta"] = map[string]string{"spectacle_token": name}
+	}
+
+	dispatched := struct {
+		DispatchedJobID string
+	}{}
+	if err := n.call(ctx, "POST", "/v1/job/"+url.PathEscape(n.config.Job)+"/dispatch", dispatch, &dispatched); err != nil {
+		return errors.Wrap(err, "could not dispatch job")
+	}
+	jobPath := "/v1/job/" + url.PathEscape(dispatched.DispatchedJobID)
+	defer (func() {
+		if ctx.Err() != nil {
+			n.call(context.Background(), "DELETE", jobPath, nil, nil)
+		}
+	})()
+
+	type allocation struct {
+		ID           string
+		ClientStatus string
+	}
+	current := func() (allocation, error) {
+		allocations := []allocation{}
+		if err := n.call(ctx, "GET", jobPath+"/allocations", nil, &allocations); err != nil {
+			return allocation{}, errors.Wrap(err, "could not list allocations")
+		}
+		if len(allocations) == 0 {
+			return allocation{ClientStatus: "pending"}, nil
+		}
+		return allocations[0], nil
+	}
+
+	alloc, err := current()
+	for ; err == nil && alloc.ClientStatus == "pending"; alloc, err = current() {
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("task", n.config.Task)
+	query.Set("type", "stdout")
+	query.Set("follow", "true")
+	query.Set("origin", "start")
+	query.Set("plain", "true")
+	res, err := n.request(ctx, "GET", "/v1/client/fs/logs/"+alloc.ID+"?"+query.Encode(), nil)
+	if err != nil {
+		return errors.Wrap(err, "could not follow log")
+	}
+	io.Copy(log, res.Body)
+	res.Body.Close()
+
+	for {
+		switch alloc.ClientStatus {
+		case "complete":
+			return nil
+		case "failed", "lost":
+			return errors.Errorf("allocation %s", alloc.ClientStatus)
+		}
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return err
+		}
+		if alloc, err = current(); err != nil {
+			return err
+		}
+	}
+}
+
+// updateToken sets the token item name of the job's variable, removing it
+// when token is empty, retrying when other builds update it meanwhile.
+func (n *Nomad) updateToken(ctx context.Context, name, token string) error {
+	path := "/v1/var/nomad/jobs/" + url.PathEscape(n.config.Job)
+	for attempt := 0; attempt < 10; attempt++ {
+		variable := struct {
+			Items       map[string]string
+			ModifyIndex uint64
+		}{}
+		res, err := n.send(ctx, "GET", path, nil)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode == http.StatusOK {
+			err = json.NewDecoder(res.Body).Decode(&variable)
+		} else if res.StatusCode != http.StatusNotFound {
+			err = errors.Errorf("unexpected status %s", res.Status)
+		}
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if variable.Items == nil {
+			variable.Items = map[string]string{}
+		}
+		if token != "" {
+			variable.Items[name] = token
+		} else {
+			delete(variable.Items, name)
+		}
+		cas := "?cas=" + strconv.FormatUint(variable.ModifyIndex, 10)
+		if len(variable.Items) > 0 {
+			res, err = n.send(ctx, "PUT", path+cas, map[string]interface{}{
+				"Path":  "nomad/jobs/" + n.config.Job,
+				"Items": variable.Items,
+			})
+		} else {
+			res, err = n.send(ctx, "DELETE", path+cas, nil)
+		}
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 300 {
+			return nil
+		} else if res.StatusCode != http.StatusConflict {
+			return errors.Errorf("unexpected status %s", res.Status)
+		}
+	}
+	return errors.New("variable kept changing")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
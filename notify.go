@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Sink is a chat webhook notifications are posted to as {"text": ...},
+// which slack and compatible services accept. Finished builds are rendered
+// with the sink's text/template, given a buildNotice.
+//
+// A sink sends at most max_per_hour messages, repeated failures of a branch
+// being collapsed into the first, and during quiet_hours, like 22:00-07:00,
+// holds back everything but failures to send as one digest afterwards.
+type Sink struct {
+	Name       string
+	Url        string `ini:"url"`
+	Template   string `ini:"template"`
+	MaxPerHour int    `ini:"max_per_hour"`
+	QuietHours string `ini:"quiet_hours"`
+
+	template   *template.Template
+	quietStart int
+	quietEnd   int
+
+	sync.Mutex
+	sent    []time.Time
+	dropped int
+	held    []string
+	failing map[string]int
+}
+
+const defaultNotice = `{{.Repo}} #{{.Number}} on {{.Branch}}: {{.Status}} in {{.Duration}}{{if .FailedStep}}, {{.FailedStep}} failed{{end}}{{if .LogUrl}} {{.LogUrl}}{{end}}`
+
+type buildNotice struct {
+	Repo       string
+	Number     int
+	Branch     string
+	Tag        string
+	Commit     string
+	Pull       int
+	Status     string
+	Duration   time.Duration
+	LogUrl     string
+	FailedStep string
+}
+
+var sinks = map[string]*Sink{}
+
+var notifyClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// prepare parses the sink's message template, the default one unless
+// configured, and its quiet hours.
+func (s *Sink) prepare() error {
+	text := s.Template
+	if text == "" {
+		text = defaultNotice
+	}
+	var err error
+	if s.template, err = template.New(s.Name).Parse(text); err != nil {
+		return errors.Wrap(err, "bad template for sink "+s.Name)
+	}
+	s.failing = make(map[string]int)
+
+	if s.QuietHours == "" {
+		return nil
+	}
+	var startHour, startMinute, endHour, endMinute int
+	if _, err := fmt.Sscanf(s.QuietHours, "%d:%d-%d:%d", &startHour, &startMinute, &endHour, &endMinute); err != nil {
+		return errors.Wrap(err, "bad quiet hours for sink "+s.Name)
+	}
+	s.quietStart = startHour*60 + startMinute
+	s.quietEnd = endHour*60 + endMinute
+	return nil
+}
+
+func (s *Sink) quiet(now time.Time) bool {
+	if s.QuietHours == "" {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if s.quietStart <= s.quietEnd {
+		return minute >= s.quietStart && minute < s.quietEnd
+	}
+	return minute >= s.quietStart || minute < s.quietEnd
+}
+
+// deliver sends message unless held back for quiet hours or over the
+// hourly limit, dropped messages being counted in the next one sent.
+func (s *Sink) deliver(message string, critical bool) {
+	s.Lock()
+	now := time.Now()
+	if !critical && s.quiet(now) {
+		s.held = append(s.held, message)
+		s.Unlock()
+		return
+	}
+
+	recent := s.sent[:0]
+	for _, sent := range s.sent {
+		if now.Sub(sent) < time.Hour {
+			recent = append(recent, sent)
+		}
+	}
+	s.sent = recent
+	if s.MaxPerHour > 0 && len(s.sent) >= s.MaxPerHour {
+		s.dropped++
+		s.Unlock()
+		return
+	}
+	if s.dropped > 0 {
+		message += fmt.Sprintf("\n(%d notifications dropped)", s.dropped)
+		s.dropped = 0
+	}
+	s.sent = append(s.sent, now)
+	s.Unlock()
+
+	go (func() {
+		if err := s.post(message); err != nil {
+			warnf("runner", "could not notify %s, %s\n", s.Name, err.Error())
+		}
+	})()
+}
+
+// releaseHeld sends what quiet hours held back once they are over.
+func (s *Sink) releaseHeld() {
+	for range time.Tick(time.Minute) {
+		s.Lock()
+		held := s.held
+		if s.quiet(time.Now()) || len(held) == 0 {
+			s.Unlock()
+			continue
+		}
+		s.held = nil
+		s.Unlock()
+
+		s.deliver(strings.Join(held, "\n"), true)
+	}
+}
+
+// collapse reports whether a failure repeats one already sent for key, and
+// on recovery how many failures were collapsed.
+func (s *Sink) collapse(key string, failed bool) (bool, int) {
+	s.Lock()
+	defer s.Unlock()
+
+	count, repeated := s.failing[key]
+	if failed {
+		s.failing[key] = count + 1
+		return repeated, 0
+	}
+	delete(s.failing, key)
+	if count > 0 {
+		count--
+	}
+	return false, count
+}
+
+// notify sends message to each of the repo's sinks.
+func notify(repo Repo, message string) {
+	for _, name := range repo.Notify {
+		sink, ok := sinks[strings.TrimSpace(name)]
+		if !ok {
+			warnf("runner", "unknown notification sink %s for %s\n", name, repo.Name)
+			continue
+		}
+		sink.deliver(message, false)
+	}
+}
+
+// notifyBuild tells the repo's sinks a build finished, bisect builds
+// excepted.
+func notifyBuild(job *BuildJob) {
+	if job.Build.Bisect {
+		return
+	}
+
+	notice := buildNotice{
+		Repo:     job.Build.Repo,
+		Number:   job.Build.Number,
+		Branch:   job.Build.Branch,
+		Tag:      job.Build.Tag,
+		Commit:   job.Build.Commit,
+		Pull:     job.Build.Pull,
+		Status:   job.Build.Status,
+		Duration: job.Build.Duration,
+		LogUrl:   buildLogUrl(job.Build),
+	}
+	for _, step := range job.Build.Steps {
+		if step.ExitCode != 0 || step.TimedOut {
+			notice.FailedStep = step.Name
+		}
+	}
+	failed := notice.Status == "FAIL"
+	key := notice.Repo + "|" + notice.Branch
+
+	for _, name := range routeBuild(job.Repo, job.Build) {
+		if name == "author" {
+			if err := notifyAuthor(job, notice); err != nil {
+				warnf("runner", "could not notify author of %s #%d, %s\n", notice.Repo, notice.Number, err.Error())
+			}
+			continue
+		}
+		sink, ok := sinks[name]
+		if !ok {
+			continue
+		}
+		repeated, collapsed := sink.collapse(key, failed)
+		if repeated {
+			continue
+		}
+
+		message := &bytes.Buffer{}
+		if err := sink.template.Execute(message, notice); err != nil {
+			errorf("runner", "could not render notification for %s, %s\n", sink.Name, err.Error())
+			continue
+		}
+		if collapsed > 0 {
+			fmt.Fprintf(message, "\n(after %d more failures)", collapsed)
+		}
+		sink.deliver(message.String(), failed)
+	}
+}
+
+// routeBuild picks the sinks told about a build by the first of the repo's
+// notify_rules matching it, all of the repo's sinks without rules. Rules
+// read status:kind=sinks, with kind a branch name, pr or tag, sinks joined
+// by + and either part * to match anything, as in FAIL:main=ops+dev,
+// FAIL:pr=author and OK:*=none.
+func routeBuild(repo Repo, build Build) []string {
+	if len(repo.NotifyRules) == 0 {
+		names := make([]string, 0, len(repo.Notify))
+		for _, name := range repo.Notify {
+			names = append(names, strings.TrimSpace(name))
+		}
+		return names
+	}
+
+	kind := build.Branch
+	if build.Pull > 0 {
+		kind = "pr"
+	} else if build.Tag != "" {
+		kind = "tag"
+	}
+	for _, rule := range repo.NotifyRules {
+		parts := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		match := strings.SplitN(parts[0], ":", 2)
+		if match[0] != "*" && match[0] != build.Status {
+			continue
+		}
+		if len(match) == 2 && match[1] != "*" && match[1] != kind {
+			continue
+		}
+		if parts[1] == "none" {
+			return nil
+		}
+		return strings.Split(parts[1], "+")
+	}
+	return nil
+}
+
+// notifyAuthor mentions whoever pushed or opened the pull request, on the
+// pull request or else on the commit.
+func notifyAuthor(job *BuildJob, notice buildNotice) error {
+	if job.token == "" || job.Build.Author == "" {
+		return nil
+	}
+	body := fmt.Sprintf("@%s build #%d: **%s**", job.Build.Author, notice.Number, notice.Status)
+	if notice.FailedStep != "" {
+		body += fmt.Sprintf(", `%s` failed", notice.FailedStep)
+	}
+	if notice.LogUrl != "" {
+		body += fmt.Sprintf(" ([log](%s))", notice.LogUrl)
+	}
+
+	path := "/repos/" + job.Name + "/commits/" + job.Build.Commit + "/comments"
+	if job.Build.Pull > 0 {
+		path = "/repos/" + job.Name + "/issues/" + strconv.Itoa(job.Build.Pull) + "/comments"
+	}
+	res, err := githubRequest(job.token, "POST", path, map[string]string{"body": body})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// buildLogUrl links the build's log, empty without a public url.
+func buildLogUrl(build Build) string {
+	if *publicUrl == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/api/log?repo=%s&build=%d", strings.TrimSuffix(*publicUrl, "/"), url.QueryEscape(build.Repo), build.Number)
+}
+
+func (s *Sink) post(message string) error {
+	raw, _ := json.Marshal(map[string]string{"text": message})
+	res, err := notifyClient.Post(s.Url, "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
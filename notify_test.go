@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRouteBuild(t *testing.T) {
+	rules := []string{"FAIL:main=ops+dev", "FAIL:pr=author", "OK:*=none", "*:tag=releases", "FAIL=dev"}
+	tests := []struct {
+		repo  Repo
+		build Build
+		want  []string
+	}{
+		{Repo{Notify: []string{"slack", " mail "}}, Build{Status: "FAIL"}, []string{"slack", "mail"}},
+		{Repo{}, Build{Status: "OK"}, []string{}},
+		{Repo{NotifyRules: rules}, Build{Status: "FAIL", Branch: "main"}, []string{"ops", "dev"}},
+		{Repo{NotifyRules: rules}, Build{Status: "FAIL", Branch: "main", Pull: 3}, []string{"author"}},
+		{Repo{NotifyRules: rules}, Build{Status: "OK", Branch: "main"}, nil},
+		{Repo{NotifyRules: rules}, Build{Status: "CANCELLED", Tag: "v1.0.0"}, []string{"releases"}},
+		{Repo{NotifyRules: rules}, Build{Status: "FAIL", Branch: "feature"}, []string{"dev"}},
+		{Repo{NotifyRules: rules}, Build{Status: "CANCELLED", Branch: "feature"}, nil},
+		{Repo{NotifyRules: []string{"broken", " FAIL:*=x "}}, Build{Status: "FAIL"}, []string{"x"}},
+	}
+	for _, test := range tests {
+		if got := routeBuild(test.repo, test.build); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("routeBuild(%q, %+v) = %q, want %q", test.repo.NotifyRules, test.build, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const sessionCookie = "spectacle-session"
+
+const sessionLifetime = 12 * time.Hour
+
+// sessionKey signs session cookies, sessions not surviving restarts.
+var sessionKey = (func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+})()
+
+type dashboardUser struct {
+	Name    string
+	Trigger bool
+	Tenant  string
+}
+
+// csrfToken is the token the dashboard's forms post along, tied to the user
+// and lasting as long as sessions do.
+func csrfToken(user dashboardUser) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("csrf|" + user.Name + "|" + user.Tenant))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signSession(user dashboardUser, expires time.Time) string {
+	value := base64.RawURLEncoding.EncodeToString([]byte(user.Name + "|" + strconv.FormatBool(user.Trigger) + "|" + user.Tenant + "|" + strconv.FormatInt(expires.Unix(), 10)))
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(value))
+	return value + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func readSession(r *http.Request) (dashboardUser, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return dashboardUser{}, false
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return dashboardUser{}, false
+	}
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(parts[0]))
+	actual, _ := hex.DecodeString(parts[1])
+	if !hmac.Equal(mac.Sum(nil), actual) {
+		return dashboardUser{}, false
+	}
+
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	fields := strings.Split(string(raw), "|")
+	if len(fields) != 4 {
+		return dashboardUser{}, false
+	}
+	expires, _ := strconv.ParseInt(fields[3], 10, 64)
+	if time.Now().Unix() > expires {
+		return dashboardUser{}, false
+	}
+	trigger, _ := strconv.ParseBool(fields[1])
+	return dashboardUser{Name: fields[0], Trigger: trigger, Tenant: fields[2]}, true
+}
+
+// startOAuth sends the user to GitHub, the state being kept in a cookie to be
+// matched on callback.
+func (h DashboardHandler) startOAuth(w http.ResponseWriter, r *http.Request) {
+	state := make([]byte, 16)
+	rand.Read(state)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie + "-state",
+		Value:    hex.EncodeToString(state),
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{}
+	query.Set("client_id", h.Config.OAuthClientId)
+	query.Set("scope", "read:org")
+	query.Set("state", hex.EncodeToString(state))
+	http.Redirect(w, r, "https://github.com/login/oauth/authorize?"+query.Encode(), http.StatusFound)
+}
+
+func (h DashboardHandler) finishOAuth(w http.ResponseWriter, r *http.Request) {
+	state, err := r.Cookie(sessionCookie + "-state")
+	if err != nil || state.Value == "" || state.Value != r.URL.Query().Get("state") {
+		http.Error(w, "400 bad request", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.oauthUser(r.URL.Query().Get("code"))
+	if err != nil {
+		warnf("http", "oauth login failed, %s\n", err.Error())
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    signSession(user, time.Now().Add(sessionLifetime)),
+		Path:     "/",
+		MaxAge:   int(sessionLifetime / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	infof("http", "dashboard login by %s\n", user.Name)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// oauthUser trades the callback code for a token and resolves the user,
+// requiring membership in one of the configured orgs, or in one of a
+// tenant's orgs which binds the user to that tenant.
+func (h DashboardHandler) oauthUser(code string) (dashboardUser, error) {
+	form := url.Values{}
+	form.Set("client_id", h.Config.OAuthClientId)
+	form.Set("client_secret", h.Config.OAuthClientSecret)
+	form.Set("code", code)
+	req, err := http.NewRequest("POST", "https://github.com/login/oauth/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return dashboardUser{}, errors.Wrap(err, "could not create request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err := githubClient.Do(req)
+	if err != nil {
+		return dashboardUser{}, errors.Wrap(err, "token exchange failed")
+	}
+	grant := struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&grant)
+	res.Body.Close()
+	if err != nil || grant.AccessToken == "" {
+		return dashboardUser{}, errors.Errorf("no token granted %s", grant.Error)
+	}
+
+	profile := struct {
+		Login string `json:"login"`
+	}{}
+	if err := githubGet(grant.AccessToken, "/user", &profile); err != nil {
+		return dashboardUser{}, err
+	}
+	orgs := []struct {
+		Login string `json:"login"`
+	}{}
+	if err := githubGetAll(grant.AccessToken, "/user/orgs?per_page=100", &orgs); err != nil {
+		return dashboardUser{}, err
+	}
+	teams := []struct {
+		Slug         string `json:"slug"`
+		Organization struct {
+			Login string `json:"login"`
+		} `json:"organization"`
+	}{}
+	if err := githubGetAll(grant.AccessToken, "/user/teams?per_page=100", &teams); err != nil {
+		return dashboardUser{}, err
+	}
+
+	user := dashboardUser{Name: profile.Login}
+	member := false
+	for _, org := range orgs {
+		for _, allowed := range h.Config.OAuthOrgs {
+			member = member || strings.EqualFold(org.Login, strings.TrimSpace(allowed))
+		}
+	}
+	for _, team := range teams {
+		for _, allowed := range h.Config.OAuthTriggerTeams {
+			user.Trigger = user.Trigger || strings.EqualFold(team.Organization.Login+"/"+team.Slug, strings.TrimSpace(allowed))
+		}
+	}
+	if member {
+		return user, nil
+	}
+
+	for _, tenant := range h.Tenants {
+		for _, org := range orgs {
+			for _, allowed := range tenant.OAuthOrgs {
+				if strings.EqualFold(org.Login, strings.TrimSpace(allowed)) {
+					user.Tenant = tenant.Name
+					return user, nil
+				}
+			}
+		}
+	}
+	return user, errors.Errorf("%s is not a member of an allowed org", user.Name)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/pkg/errors"
+)
+
+const pipelineFile = "spectacle.pipeline"
+
+const defaultStepTimeout = 30 * time.Minute
+
+var goModCache = "/tmp/spectacle-gomod"
+
+type Step struct {
+	Name    string
+	Run     string        `ini:"run"`
+	Timeout time.Duration `ini:"timeout"`
+	Deploy  bool          `ini:"deploy"`
+	Image   string        `ini:"image"`
+	Uses    string        `ini:"uses"`
+	Retries int           `ini:"retries"`
+
+	// Approval "required" pauses the build before the step until approved
+	Approval string `ini:"approval"`
+
+	// With holds the section's other keys, passed to plugin steps
+	With map[string]string `ini:"-"`
+}
+
+var stepKeys = map[string]bool{
+	"run":      true,
+	"timeout":  true,
+	"deploy":   true,
+	"image":    true,
+	"uses":     true,
+	"retries":  true,
+	"approval": true,
+}
+
+type Pipeline struct {
+	Steps    []Step
+	Services []Service
+	Env      []string
+	Mounts   []string
+}
+
+// Workspace is where a job's steps run, Root being shared with step
+// containers along with Mounts. Nix names the kind of nix environment steps
+// without an image run in, if any. Untrusted workspaces may read but not
+// write shared caches.
+type Workspace struct {
+	Repo    Repo
+	Root    string
+	Dir     string
+	Env     []string
+	Mounts  []string
+	Nix     string
+	Trusted bool
+}
+
+type StepResult struct {
+	Name     string        `json:"name"`
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration"`
+	Log      string        `json:"log"`
+	Stdout   string        `json:"stdout,omitempty"`
+	Colored  string        `json:"colored,omitempty"`
+	TimedOut bool          `json:"timed_out,omitempty"`
+	Skipped  string        `json:"skipped,omitempty"`
+	Outputs  []string      `json:"outputs,omitempty"`
+	Findings []string      `json:"findings,omitempty"`
+	Attempts int           `json:"attempts,omitempty"`
+	Flaky    bool          `json:"flaky,omitempty"`
+
+	ApprovedBy string `json:"approved_by,omitempty"`
+}
+
+// loadPipeline reads the steps declared in the checkout, every section being
+// one step run in file order, except "service:" sections which declare
+// containers. Steps either run a command or use a builtin or plugin step.
+// Without a pipeline file spectacle.sh is the single step, or in go mode the
+// standard vet, test and build when there is no script either, with modCache
+// as the module cache.
+func loadPipeline(buildPath string, goMode bool, modCache string) (*Pipeline, error) {
+	if _, err := os.Stat(buildPath + "/" + pipelineFile); os.IsNotExist(err) {
+		if _, err := os.Stat(buildPath + "/spectacle.sh"); os.IsNotExist(err) {
+			if goMode {
+				return goPipeline(modCache), nil
+			}
+			return nil, errors.New("missing spectacle.sh")
+		}
+		return &Pipeline{
+			Steps: []Step{{Name: "spectacle.sh", Run: "sh spectacle.sh"}},
+		}, nil
+	}
+
+	cfg, err := ini.Load(buildPath + "/" + pipelineFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read pipeline")
+	}
+
+	pipeline := &Pipeline{
+		Steps:    make([]Step, 0, 10),
+		Services: make([]Service, 0, 2),
+	}
+	for _, section := range cfg.Sections() {
+		name := section.Name()
+		if name == "DEFAULT" {
+			continue
+		}
+
+		if strings.HasPrefix(name, "service:") {
+			service := Service{
+				Name: strings.TrimPrefix(name, "service:"),
+			}
+			if err := section.MapTo(&service); err != nil {
+				return nil, errors.Wrap(err, "failed to map service "+service.Name)
+			}
+			if service.Image == "" {
+				return nil, errors.Errorf("service %s has no image", service.Name)
+			}
+			pipeline.Services = append(pipeline.Services, service)
+			continue
+		}
+
+		step := Step{
+			Name: name,
+		}
+		if err := section.MapTo(&step); err != nil {
+			return nil, errors.Wrap(err, "failed to map step "+name)
+		}
+		_, builtin := builtinSteps[step.Uses]
+		if _, plugin := plugins[step.Uses]; step.Uses != "" && !builtin && !plugin {
+			return nil, errors.Errorf("step %s uses unknown %s", name, step.Uses)
+		}
+		step.With = make(map[string]string)
+		for _, key := range section.Keys() {
+			if !stepKeys[key.Name()] {
+				step.With[key.Name()] = key.Value()
+			}
+		}
+		if step.Approval != "" && step.Approval != "required" {
+			return nil, errors.Errorf("step %s has unknown approval %s", name, step.Approval)
+		}
+		if step.Run == "" && step.Uses == "" {
+			return nil, errors.Errorf("step %s has nothing to run", name)
+		}
+		pipeline.Steps = append(pipeline.Steps, step)
+	}
+	if len(pipeline.Steps) == 0 {
+		return nil, errors.New("pipeline has no steps")
+	}
+	return pipeline, nil
+}
+
+// nixEnvironment reports the nix environment the checkout declares, a flake
+// taking precedence over shell.nix.
+func nixEnvironment(buildPath string) string {
+	if _, err := os.Stat(buildPath + "/flake.nix"); err == nil {
+		return "flake"
+	}
+	if _, err := os.Stat(buildPath + "/shell.nix"); err == nil {
+		return "shell"
+	}
+	return ""
+}
+
+// goModCacheFor picks the module cache of a job, one per repo for trusted
+// builds and a throwaway one in the build dir for the others, since go only
+// checks go.sum on download and a shared writable cache would let one build
+// poison the modules of the next.
+func goModCacheFor(job *BuildJob, tmpDir string) string {
+	if !trusted(job) {
+		return tmpDir + "/gomod"
+	}
+	return goModCache + "/" + workspaceName(job.Repo, job.Name)
+}
+
+func goPipeline(modCache string) *Pipeline {
+	return &Pipeline{
+		Steps: []Step{
+			{Name: "vet", Run: "go vet ./..."},
+			{Name: "test", Run: "go test -cover ./..."},
+			{Name: "build", Run: "go build ./..."},
+		},
+		Env: []string{
+			"GOMODCACHE=" + modCache,
+			"GOFLAGS=-modcacherw",
+		},
+	}
+}
+
+// runStep runs step in the workspace, inside a container sharing the
+// workspace when the step has an image.
+func runStep(ctx context.Context, step Step, workspace Workspace, logPath string) (StepResult, error) {
+	if step.Uses != "" {
+		return runBuiltin(ctx, step, workspace, logPath)
+	}
+
+	result := StepResult{
+		Name: step.Name,
+		Log:  logPath,
+	}
+	if step.Timeout == 0 {
+		step.Timeout = defaultStepTimeout
+	}
+
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return result, errors.Wrap(err, "could not create step log")
+	}
+	defer logFile.Close()
+
+	start := time.Now()
+	args := sandboxed(workspace.Repo, []string{"sh", "-c", step.Run})
+	container := ""
+	switch {
+	case step.Image == "" && workspace.Nix == "flake":
+		args = sandboxed(workspace.Repo, []string{"nix", "--extra-experimental-features", "nix-command flakes", "develop", "--command", "sh", "-c", step.Run})
+	case step.Image == "" && workspace.Nix == "shell":
+		args = sandboxed(workspace.Repo, []string{"nix-shell", "--run", step.Run})
+	case step.Image != "":
+		container = "spectacle-step-" + strconv.FormatInt(start.UnixNano(), 36)
+		network := "host"
+		if workspace.Repo.Network == "none" {
+			network = "none"
+		}
+		args = []string{"docker", "run", "--rm", "--name", container, "--network", network, "--user", "1001:1001", "-w", workspace.Dir, "-v", workspace.Root + ":" + workspace.Root}
+		if workspace.Repo.AppArmor != "" {
+			args = append(args, "--security-opt", "apparmor="+workspace.Repo.AppArmor)
+		}
+		cpu, memory := limits(workspace.Repo)
+		if cpu != "" {
+			args = append(args, "--cpus", cpu)
+		}
+		if memory > 0 {
+			args = append(args, "--memory", strconv.FormatInt(memory, 10))
+		}
+		for _, mount := range workspace.Mounts {
+			args = append(args, "-v", mount+":"+mount)
+		}
+		for _, env := range workspace.Env {
+			args = append(args, "-e", env)
+		}
+		args = append(args, step.Image, "sh", "-c", step.Run)
+	}
+	// Stdout is also kept untagged on its own for scripts printing machine
+	// readable output
+	result.Stdout = strings.TrimSuffix(logPath, ".log") + ".stdout"
+	stdoutFile, err := os.Create(result.Stdout)
+	if err != nil {
+		return result, errors.Wrap(err, "could not create step stdout")
+	}
+	defer stdoutFile.Close()
+	// Terminal escapes are stripped from the log unless the repo keeps them,
+	// the dashboard rendering the colors from a copy keeping them
+	var colored io.Writer
+	if workspace.Repo.Ansi != "keep" {
+		result.Colored = strings.TrimSuffix(logPath, ".log") + ".ansi"
+		coloredFile, err := os.Create(result.Colored)
+		if err != nil {
+			return result, errors.Wrap(err, "could not create colored step log")
+		}
+		defer coloredFile.Close()
+		colored = coloredFile
+	}
+	var logWriter io.Writer = logFile
+	if logShipper != nil {
+		shipped := logShipper.Open(workspace.Repo.Name, strings.TrimSuffix(filepath.Base(logPath), ".log"))
+		defer shipped.Close()
+		logWriter = io.MultiWriter(logFile, shipped)
+	}
+	stdout, stderr := tagStreams(logWriter, colored, start)
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = workspace.Dir
+	cmd.Env = workspace.Env
+	cmd.Stdout = io.MultiWriter(stdout, stdoutFile)
+	cmd.Stderr = stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		result.ExitCode = -1
+		return result, errors.Wrap(err, "could not start step "+step.Name)
+	}
+	pid := cmd.Process.Pid
+	trackGroup(pid, func() {
+		killGroup(pid)
+		removeContainer(container)
+	})
+	defer untrackGroup(pid)
+
+	done := make(chan error, 1)
+	go (func() {
+		done <- cmd.Wait()
+	})()
+
+	// Kill the whole process group so children don't outlive the step
+	timer := time.NewTimer(step.Timeout)
+	select {
+	case err = <-done:
+		timer.Stop()
+	case <-timer.C:
+		killGroup(pid)
+		removeContainer(container)
+		<-done
+		result.TimedOut = true
+		err = errors.Errorf("timed out after %s", step.Timeout)
+	case <-ctx.Done():
+		timer.Stop()
+		killGroup(pid)
+		removeContainer(container)
+		<-done
+		err = errors.New("cancelled")
+	}
+	result.Duration = time.Since(start)
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			result.ExitCode = status.ExitStatus()
+		}
+	} else if err != nil {
+		result.ExitCode = -1
+	}
+	return result, errors.Wrap(err, "step "+step.Name+" failed")
+}
+
+// removeContainer stops a step container, killing the docker client leaving
+// the container itself running.
+func removeContainer(container string) {
+	if container != "" {
+		exec.Command("docker", "rm", "-f", container).Run()
+	}
+}
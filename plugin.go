@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// plugins maps step types to the executables implementing them, found in
+// the plugin dir at startup.
+var plugins = map[string]string{}
+
+type pluginRequest struct {
+	Step string            `json:"step"`
+	Repo string            `json:"repo"`
+	Dir  string            `json:"dir"`
+	Env  []string          `json:"env"`
+	With map[string]string `json:"with"`
+}
+
+type pluginResponse struct {
+	Outputs []string `json:"outputs"`
+	Error   string   `json:"error"`
+}
+
+// loadPlugins registers every executable in dir as a step type named after
+// it, builtin step types taking precedence.
+func loadPlugins(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "could not read plugin dir")
+	}
+	for _, file := range files {
+		if file.IsDir() || file.Mode()&0111 == 0 {
+			continue
+		}
+		name := file.Name()
+		if _, ok := builtinSteps[name]; ok {
+			warnf("runner", "plugin %s shadowed by builtin step\n", name)
+			continue
+		}
+		path, err := filepath.Abs(dir + "/" + name)
+		if err != nil {
+			return errors.Wrap(err, "could not resolve plugin "+name)
+		}
+		plugins[name] = path
+	}
+	return nil
+}
+
+// runPlugin runs a plugin step, passing it the step as json on stdin and
+// reading its outputs back from stdout. What it writes to stderr is logged.
+func runPlugin(ctx context.Context, step Step, workspace Workspace, result *StepResult, log io.Writer) error {
+	request, _ := json.Marshal(pluginRequest{
+		Step: step.Name,
+		Repo: workspace.Repo.Name,
+		Dir:  workspace.Dir,
+		Env:  workspace.Env,
+		With: step.With,
+	})
+
+	cmd := exec.Command(plugins[step.Uses])
+	cmd.Dir = workspace.Dir
+	cmd.Env = workspace.Env
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stderr = log
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	err := runGroup(ctx, cmd)
+
+	response := pluginResponse{}
+	if len(bytes.TrimSpace(out.Bytes())) > 0 {
+		if err := json.Unmarshal(out.Bytes(), &response); err != nil {
+			return errors.Wrap(err, "plugin "+step.Uses+" sent bad response")
+		}
+	}
+	result.Outputs = append(result.Outputs, response.Outputs...)
+	if err != nil {
+		return errors.Wrap(err, "plugin "+step.Uses+" failed")
+	} else if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const policyTimeout = 5 * time.Second
+
+type policyRequest struct {
+	Event   string          `json:"event"`
+	Repo    string          `json:"repo"`
+	Build   Build           `json:"build"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type policyDecision struct {
+	Accept  bool              `json:"accept"`
+	Reason  string            `json:"reason"`
+	Env     map[string]string `json:"env"`
+	Backend string            `json:"backend"`
+}
+
+// applyPolicy runs the repo's wasm policy module on a hook about to queue
+// build, the module reading the request as json on stdin and writing its
+// decision to stdout. Accepted builds get the env the module computed and
+// may be moved to another backend. A failing module rejects the hook.
+func applyPolicy(repo *Repo, event string, raw []byte, build *Build) (bool, string, error) {
+	if repo.Policy == "" {
+		return true, "", nil
+	}
+
+	request, _ := json.Marshal(policyRequest{
+		Event:   event,
+		Repo:    repo.Name,
+		Build:   *build,
+		Payload: raw,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), policyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, *wasmRuntime, "run", repo.Policy)
+	cmd.Stdin = bytes.NewReader(request)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return false, "", errors.Wrapf(err, "policy failed, %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	decision := policyDecision{}
+	if err := json.Unmarshal(out, &decision); err != nil {
+		return false, "", errors.Wrap(err, "policy sent bad decision")
+	}
+	if !decision.Accept {
+		return false, decision.Reason, nil
+	}
+	names := make([]string, 0, len(decision.Env))
+	for name := range decision.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		build.Env = append(build.Env, name+"="+decision.Env[name])
+	}
+	if decision.Backend != "" {
+		if _, ok := backends[decision.Backend]; !ok && decision.Backend != "local" {
+			return false, "", errors.Errorf("policy chose unknown backend %s", decision.Backend)
+		}
+		build.Backend = decision.Backend
+	}
+	return true, decision.Reason, nil
+}
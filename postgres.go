@@ -0,0 +1,52 @@
+package main
+
+import (
+	"database/sql"
+	"net/url"
+	"os"
+
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Postgres queries a PostgreSQL database through lib/pq, arguments being
+// sent as bound parameters of the extended protocol rather than quoted into
+// the query.
+type Postgres struct {
+	db *sql.DB
+}
+
+// NewPostgres connects to the database at the postgres:// url address. The
+// sslmode defaults to require, allow and prefer being refused as they fall
+// back to plaintext without telling.
+func NewPostgres(address string) (*Postgres, error) {
+	server, err := url.Parse(address)
+	if err != nil || (server.Scheme != "postgres" && server.Scheme != "postgresql") {
+		return nil, errors.Errorf("bad postgres url %s", address)
+	}
+	mode := server.Query().Get("sslmode")
+	if mode == "" {
+		mode = os.Getenv("PGSSLMODE")
+	}
+	switch mode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		return nil, errors.Errorf("postgres sslmode %s is not supported, use disable, require, verify-ca or verify-full", mode)
+	}
+
+	db, err := sql.Open("postgres", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad postgres url")
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "could not reach postgres")
+	}
+	return &Postgres{db}, nil
+}
+
+// Query runs query with args bound to $1, $2.., returning its rows with
+// null columns as empty strings.
+func (p *Postgres) Query(query string, args ...string) ([][]string, error) {
+	return queryRows(p.db, query, args)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewPostgresRefusesPlaintextFallback(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"mysql://localhost/spectacle", "bad postgres url"},
+		{"localhost:5432", "bad postgres url"},
+		{"postgres://localhost/spectacle?sslmode=allow", "sslmode allow"},
+		{"postgres://localhost/spectacle?sslmode=prefer", "sslmode prefer"},
+		{"postgresql://localhost/spectacle?sslmode=bogus", "sslmode bogus"},
+	}
+	for _, test := range tests {
+		_, err := NewPostgres(test.address)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("NewPostgres(%q) error = %v, want %q", test.address, err, test.want)
+		}
+	}
+}
+
+func TestNewPostgresFallbackFromEnvironment(t *testing.T) {
+	t.Setenv("PGSSLMODE", "prefer")
+	if _, err := NewPostgres("postgres://localhost/spectacle"); err == nil || !strings.Contains(err.Error(), "sslmode prefer") {
+		t.Errorf("NewPostgres with PGSSLMODE=prefer error = %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// groups holds what kills each process group started for a build, so they
+// are killed along with their children when spectacle shuts down.
+var groups = struct {
+	sync.Mutex
+	kills map[int]func()
+}{
+	kills: make(map[int]func()),
+}
+
+func trackGroup(pid int, kill func()) {
+	groups.Lock()
+	groups.kills[pid] = kill
+	groups.Unlock()
+}
+
+func untrackGroup(pid int) {
+	groups.Lock()
+	delete(groups.kills, pid)
+	groups.Unlock()
+}
+
+func killGroup(pid int) {
+	syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// killGroups kills every process group still running.
+func killGroups() {
+	groups.Lock()
+	defer groups.Unlock()
+	for pid, kill := range groups.kills {
+		kill()
+		delete(groups.kills, pid)
+	}
+}
+
+// startGroup starts cmd in a process group of its own, killing the whole
+// group when ctx is done rather than only cmd, as exec.CommandContext would,
+// so children like test binaries and docker clients don't outlive it. The
+// returned func waits for cmd.
+func startGroup(ctx context.Context, cmd *exec.Cmd) (func() error, error) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	pid := cmd.Process.Pid
+	trackGroup(pid, func() { killGroup(pid) })
+
+	stop := make(chan struct{})
+	go (func() {
+		select {
+		case <-ctx.Done():
+			killGroup(pid)
+		case <-stop:
+		}
+	})()
+	return func() error {
+		err := cmd.Wait()
+		close(stop)
+		untrackGroup(pid)
+		return err
+	}, nil
+}
+
+// runGroup runs cmd in a process group of its own, see startGroup.
+func runGroup(ctx context.Context, cmd *exec.Cmd) error {
+	wait, err := startGroup(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	return wait()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queueWait tracks how long builds wait to start, for the metrics endpoint
+// and the alert sent when builds wait longer than queue_wait_alert.
+var queueWait = struct {
+	sync.Mutex
+	sum      time.Duration
+	count    int
+	breaches int
+	alerted  map[string]bool
+}{
+	alerted: make(map[string]bool),
+}
+
+// queueWaitAlert is the longest builds should wait to start, 0 if any wait
+// will do.
+var queueWaitAlert time.Duration
+
+// recordQueueWait counts the wait of a job about to start.
+func recordQueueWait(job *BuildJob) {
+	wait := time.Since(job.Build.Queued)
+	key := jobKey(job.Name, job.Build.Number)
+	queueWait.Lock()
+	defer queueWait.Unlock()
+	queueWait.sum += wait
+	queueWait.count++
+	if queueWaitAlert > 0 && wait > queueWaitAlert && !queueWait.alerted[key] {
+		queueWait.breaches++
+	}
+	delete(queueWait.alerted, key)
+}
+
+// waiting lists the builds still queued along with the longest wait.
+func waiting() ([]Build, time.Duration) {
+	queued := make([]Build, 0, 10)
+	oldest := time.Duration(0)
+	for _, build := range store.List("") {
+		if build.Status != "QUEUED" {
+			continue
+		}
+		queued = append(queued, build)
+		if wait := time.Since(build.Queued); wait > oldest {
+			oldest = wait
+		}
+	}
+	return queued, oldest
+}
+
+// watchQueueWait tells the sinks named when builds have waited longer than
+// queue_wait_alert, once for each build, hinting that more workers are
+// needed.
+func watchQueueWait(names []string) {
+	threshold := queueWaitAlert
+	for range time.Tick(threshold / 4) {
+		queued, oldest := waiting()
+		late := 0
+		still := make(map[string]bool)
+		queueWait.Lock()
+		for _, build := range queued {
+			key := jobKey(build.Repo, build.Number)
+			still[key] = true
+			if time.Since(build.Queued) > threshold && !queueWait.alerted[key] {
+				queueWait.alerted[key] = true
+				queueWait.breaches++
+				late++
+			}
+		}
+		for key := range queueWait.alerted {
+			if !still[key] {
+				delete(queueWait.alerted, key)
+			}
+		}
+		queueWait.Unlock()
+		if late == 0 {
+			continue
+		}
+
+		message := fmt.Sprintf("%d builds waited over %s to start, %d queued, the oldest for %s", late, threshold, len(queued), oldest.Round(time.Second))
+		warnf("queue", "%s\n", message)
+		for _, name := range names {
+			if sink, ok := sinks[strings.TrimSpace(name)]; ok {
+				sink.deliver(message, true)
+			} else {
+				warnf("queue", "unknown notification sink %s for queue wait alerts\n", name)
+			}
+		}
+	}
+}
+
+// serveMetrics writes queue wait metrics in the prometheus text format.
+func serveMetrics(w http.ResponseWriter) {
+	queued, oldest := waiting()
+	queueWait.Lock()
+	defer queueWait.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# TYPE spectacle_queue_wait_seconds summary")
+	fmt.Fprintf(w, "spectacle_queue_wait_seconds_sum %f\n", queueWait.sum.Seconds())
+	fmt.Fprintf(w, "spectacle_queue_wait_seconds_count %d\n", queueWait.count)
+	fmt.Fprintln(w, "# TYPE spectacle_queue_wait_breaches_total counter")
+	fmt.Fprintf(w, "spectacle_queue_wait_breaches_total %d\n", queueWait.breaches)
+	fmt.Fprintln(w, "# TYPE spectacle_queued_builds gauge")
+	fmt.Fprintf(w, "spectacle_queued_builds %d\n", len(queued))
+	fmt.Fprintln(w, "# TYPE spectacle_queue_oldest_wait_seconds gauge")
+	fmt.Fprintf(w, "spectacle_queue_oldest_wait_seconds %f\n", oldest.Seconds())
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const quotaInterval = 10 * time.Second
+
+// parseSize reads sizes like 512M or 2G as bytes.
+func parseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	unit := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(size, suffix) {
+			unit = 1 << (10 * uint(i+1))
+			size = strings.TrimSuffix(size, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "bad size")
+	}
+	return n * unit, nil
+}
+
+func diskUsage(dir string) int64 {
+	var total int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// watchDiskQuota cancels the build once dir grows beyond quota, checking
+// periodically. The returned func stops watching, reporting whether the
+// quota was exceeded.
+func watchDiskQuota(dir string, quota int64, cancel context.CancelFunc) func() bool {
+	var exceeded int32
+	done := make(chan struct{})
+	go (func() {
+		ticker := time.NewTicker(quotaInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if diskUsage(dir) > quota {
+					atomic.StoreInt32(&exceeded, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	})()
+
+	return func() bool {
+		close(done)
+		return atomic.LoadInt32(&exceeded) == 1
+	}
+}
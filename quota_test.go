@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want int64
+		err  bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"1K", 1 << 10, false},
+		{"512M", 512 << 20, false},
+		{"2g", 2 << 30, false},
+		{" 3T ", 3 << 40, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"1.5G", 0, true},
+		{"10MB", 0, true},
+		{"-", 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseSize(test.size)
+		if (err != nil) != test.err {
+			t.Errorf("parseSize(%q) error = %v, want error %v", test.size, err, test.err)
+		} else if got != test.want {
+			t.Errorf("parseSize(%q) = %d, want %d", test.size, got, test.want)
+		}
+	}
+}
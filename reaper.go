@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const buildUid = 1001
+
+// reapOrphans kills the processes a finished build left behind, those that
+// escaped its process group by starting sessions of their own or being
+// reparented. They are found in /proc by the build's environment, owned by
+// the build user or spectacle's own.
+func reapOrphans(job *BuildJob) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	markers := [][]byte{
+		[]byte("SPECTACLE_REPO=" + job.Name),
+		[]byte("SPECTACLE_BUILD_NUMBER=" + strconv.Itoa(job.Build.Number)),
+	}
+
+	killed := 0
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		if uid := processUid(pid); uid != buildUid && uid != os.Getuid() {
+			continue
+		}
+		environ, err := ioutil.ReadFile("/proc/" + entry.Name() + "/environ")
+		if err != nil {
+			continue
+		}
+		found := 0
+		for _, variable := range bytes.Split(environ, []byte{0}) {
+			for _, marker := range markers {
+				if bytes.Equal(variable, marker) {
+					found++
+				}
+			}
+		}
+		if found == len(markers) && syscall.Kill(pid, syscall.SIGKILL) == nil {
+			killed++
+		}
+	}
+	if killed > 0 {
+		warnf("runner", "├killed %d orphaned processes\n", killed)
+	}
+}
+
+// processUid reads the real uid of a process, -1 if it is gone.
+func processUid(pid int) int {
+	status, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return -1
+	}
+	for _, line := range bytes.Split(status, []byte("\n")) {
+		uid := -1
+		if _, err := fmt.Sscanf(string(line), "Uid:\t%d", &uid); err == nil {
+			return uid
+		}
+	}
+	return -1
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Redis is a minimal client for the commands the shared queue needs, one
+// connection redialled whenever a command fails on it.
+type Redis struct {
+	sync.Mutex
+	server *url.URL
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func NewRedis(address string) (*Redis, error) {
+	server, err := url.Parse(address)
+	if err != nil || server.Scheme != "redis" {
+		return nil, errors.Errorf("bad redis url %s", address)
+	}
+	r := &Redis{
+		server: server,
+	}
+	if _, err := r.Do("PING"); err != nil {
+		return nil, errors.Wrap(err, "could not reach redis")
+	}
+	return r, nil
+}
+
+func (r *Redis) dial() error {
+	conn, err := net.DialTimeout("tcp", r.server.Host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+
+	if password, ok := r.server.User.Password(); ok {
+		if _, err := r.command("AUTH", password); err != nil {
+			return err
+		}
+	}
+	if db := strings.TrimPrefix(r.server.Path, "/"); db != "" {
+		if _, err := r.command("SELECT", db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Do runs a command, replies being strings, int64s, nil or slices of those.
+func (r *Redis) Do(args ...string) (interface{}, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.conn == nil {
+		if err := r.dial(); err != nil {
+			r.close()
+			return nil, errors.Wrap(err, "could not connect to redis")
+		}
+	}
+	reply, err := r.command(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		r.close()
+	}
+	return reply, err
+}
+
+func (r *Redis) close() {
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.conn = nil
+}
+
+func (r *Redis) command(args ...string) (interface{}, error) {
+	r.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	request := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		request += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	if _, err := io.WriteString(r.conn, request); err != nil {
+		return nil, err
+	}
+	return r.reply()
+}
+
+func (r *Redis) reply() (interface{}, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		raw := make([]byte, size+2)
+		if _, err := io.ReadFull(r.reader, raw); err != nil {
+			return nil, err
+		}
+		return string(raw[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		result := make([]interface{}, count)
+		for i := range result {
+			if result[i], err = r.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("unknown redis reply %q", line)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeRedis serves replies in order, sending each command it reads as its
+// arguments on commands.
+func fakeRedis(t *testing.T, replies ...string) (string, chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	commands := make(chan []string, len(replies))
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for _, reply := range replies {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			args := make([]string, count)
+			for i := range args {
+				line, _ = reader.ReadString('\n')
+				size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+				raw := make([]byte, size+2)
+				io.ReadFull(reader, raw)
+				args[i] = string(raw[:size])
+			}
+			commands <- args
+			io.WriteString(conn, reply)
+		}
+	}()
+	return listener.Addr().String(), commands
+}
+
+func TestRedisReplies(t *testing.T) {
+	address, commands := fakeRedis(t,
+		"+OK\r\n",
+		"+OK\r\n",
+		"+PONG\r\n",
+		":42\r\n",
+		"$5\r\na\r\nbc\r\n",
+		"$-1\r\n",
+		"*3\r\n$1\r\na\r\n:1\r\n*1\r\n$0\r\n\r\n",
+		"-ERR wrong type\r\n",
+		"+OK\r\n",
+	)
+	r, err := NewRedis("redis://:secret@" + address + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]string{{"AUTH", "secret"}, {"SELECT", "2"}, {"PING"}} {
+		if got := <-commands; !reflect.DeepEqual(got, want) {
+			t.Errorf("sent %q, want %q", got, want)
+		}
+	}
+
+	tests := []struct {
+		args []string
+		want interface{}
+	}{
+		{[]string{"INCR", "counter"}, int64(42)},
+		{[]string{"GET", "a\r\nbc"}, "a\r\nbc"},
+		{[]string{"GET", "missing"}, nil},
+		{[]string{"LRANGE", "list", "0", "-1"}, []interface{}{"a", int64(1), []interface{}{""}}},
+	}
+	for _, test := range tests {
+		got, err := r.Do(test.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s replied %#v, want %#v", test.args[0], got, test.want)
+		}
+		if sent := <-commands; !reflect.DeepEqual(sent, test.args) {
+			t.Errorf("sent %q, want %q", sent, test.args)
+		}
+	}
+
+	if _, err := r.Do("LPUSH", "string", "x"); err == nil || err.Error() != "ERR wrong type" {
+		t.Errorf("error reply = %v, want ERR wrong type", err)
+	}
+	<-commands
+	// Error replies leave the connection usable
+	if reply, err := r.Do("SET", "a", "b"); err != nil || reply != "OK" {
+		t.Errorf("SET after error replied %v, %v", reply, err)
+	}
+}
+
+func TestNewRedisRefusesOtherSchemes(t *testing.T) {
+	if _, err := NewRedis("http://127.0.0.1:6379"); err == nil {
+		t.Errorf("NewRedis accepted an http url")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var hookEvents = []string{"push", "pull_request", "issue_comment"}
+
+// registerHooks creates or updates the spectacle webhook on every configured
+// repo, using GITHUB_TOKEN or else each repo's own token.
+func registerHooks(repos []Repo) error {
+	if *publicUrl == "" {
+		return errors.New("register needs -url")
+	}
+	hookUrl := strings.TrimSuffix(*publicUrl, "/") + "/hook"
+
+	failed := 0
+	for _, repo := range repos {
+		token := os.Getenv("GITHUB_TOKEN")
+		if token == "" {
+			token = repo.Token
+		}
+		if token == "" {
+			warnf("daemon", "%s: no token, skipped\n", repo.Name)
+			failed++
+			continue
+		}
+
+		action, err := registerHook(token, repo, hookUrl)
+		if err != nil {
+			errorf("daemon", "%s: %s\n", repo.Name, err.Error())
+			failed++
+			continue
+		}
+		infof("daemon", "%s: %s %s\n", repo.Name, action, hookUrl)
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d repos not registered", failed, len(repos))
+	}
+	return nil
+}
+
+func registerHook(token string, repo Repo, hookUrl string) (string, error) {
+	hooks := []struct {
+		Id     int `json:"id"`
+		Config struct {
+			Url string `json:"url"`
+		} `json:"config"`
+	}{}
+	if err := githubGet(token, "/repos/"+repo.Name+"/hooks", &hooks); err != nil {
+		return "", errors.Wrap(err, "could not list hooks")
+	}
+
+	hook := map[string]interface{}{
+		"active": true,
+		"events": hookEvents,
+		"config": map[string]string{
+			"url":          hookUrl,
+			"content_type": "json",
+			"secret":       repo.Secret,
+		},
+	}
+
+	method, path, action := "POST", "/repos/"+repo.Name+"/hooks", "created"
+	for _, existing := range hooks {
+		if existing.Config.Url == hookUrl {
+			method, path, action = "PATCH", "/repos/"+repo.Name+"/hooks/"+strconv.Itoa(existing.Id), "updated"
+			break
+		}
+	}
+	if method == "POST" {
+		hook["name"] = "web"
+	}
+
+	res, err := githubRequest(token, method, path, hook)
+	if err != nil {
+		return "", errors.Wrap(err, "could not write hook")
+	}
+	res.Body.Close()
+	return action, nil
+}
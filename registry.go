@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+type Registry struct {
+	Host     string
+	User     string `ini:"user"`
+	Password string `ini:"password"`
+}
+
+// dockerConfig writes a docker config holding the credentials of the
+// registries the repo uses into dir, returning the env pointing docker and
+// podman at it so credentials never have to appear in build scripts.
+func dockerConfig(repo Repo, dir string) ([]string, error) {
+	if len(repo.Credentials) == 0 {
+		return nil, nil
+	}
+
+	auths := make(map[string]interface{})
+	for _, registry := range repo.Credentials {
+		auths[registry.Host] = map[string]string{
+			"auth": base64.StdEncoding.EncodeToString([]byte(registry.User + ":" + registry.Password)),
+		}
+	}
+	raw, _ := json.Marshal(map[string]interface{}{
+		"auths": auths,
+	})
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "could not create docker config")
+	}
+	if err := ioutil.WriteFile(dir+"/config.json", raw, 0600); err != nil {
+		return nil, errors.Wrap(err, "could not write docker config")
+	}
+	os.Chown(dir, 1001, 1001)
+	os.Chown(dir+"/config.json", 1001, 1001)
+	return []string{
+		"DOCKER_CONFIG=" + dir,
+		"REGISTRY_AUTH_FILE=" + dir + "/config.json",
+	}, nil
+}
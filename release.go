@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const releaseDir = "dist"
+
+// releaseStep cross compiles static binaries of the repo's release package
+// for each of its release platforms, named <name>-<version>-<os>-<arch> with
+// the version being the tag or the short commit.
+func releaseStep(ctx context.Context, workspace Workspace, result *StepResult, log io.Writer) error {
+	repo := workspace.Repo
+	if len(repo.ReleasePlatforms) == 0 {
+		return errors.New("no release platforms configured")
+	}
+	pkg := repo.ReleasePackage
+	if pkg == "" {
+		pkg = "."
+	}
+	name := path.Base(repo.Name)
+	if pkg != "." {
+		name = path.Base(pkg)
+	}
+	version := lookupEnv(workspace.Env, "SPECTACLE_TAG")
+	if version == "" {
+		version = lookupEnv(workspace.Env, "SPECTACLE_COMMIT")
+		if len(version) > 7 {
+			version = version[:7]
+		}
+	}
+
+	if err := os.MkdirAll(workspace.Dir+"/"+releaseDir, os.ModePerm); err != nil {
+		return errors.Wrap(err, "could not create release dir")
+	}
+	for _, platform := range repo.ReleasePlatforms {
+		parts := strings.SplitN(strings.TrimSpace(platform), "/", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("bad release platform %s", platform)
+		}
+		binary := releaseDir + "/" + name + "-" + version + "-" + parts[0] + "-" + parts[1]
+		if parts[0] == "windows" {
+			binary += ".exe"
+		}
+		fmt.Fprintf(log, "building %s\n", binary)
+
+		cmd := exec.Command("go", "build", "-trimpath", "-ldflags", "-s -w", "-o", binary, pkg)
+		cmd.Dir = workspace.Dir
+		cmd.Env = append(append([]string{}, workspace.Env...), "CGO_ENABLED=0", "GOOS="+parts[0], "GOARCH="+parts[1])
+		cmd.Stdout = log
+		cmd.Stderr = log
+		if err := runGroup(ctx, cmd); err != nil {
+			return errors.Wrap(err, "build for "+platform+" failed")
+		}
+		result.Outputs = append(result.Outputs, binary)
+	}
+	return nil
+}
+
+// lookupEnv finds key in env, later entries winning as they do for commands.
+func lookupEnv(env []string, key string) string {
+	value := ""
+	for _, entry := range env {
+		if strings.HasPrefix(entry, key+"=") {
+			value = strings.TrimPrefix(entry, key+"=")
+		}
+	}
+	return value
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// draining is set once the listening socket has been handed to a new
+// process, this one only finishing the builds it already has.
+var draining int32
+
+// listen takes over a socket passed down by systemd or a previous spectacle
+// when there is one, listening on addr otherwise.
+func listen(addr string) (net.Listener, error) {
+	fd := 0
+	if os.Getenv("LISTEN_FDS") == "1" && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		fd = 3
+	} else if inherited := os.Getenv("SPECTACLE_LISTEN_FD"); inherited != "" {
+		fd, _ = strconv.Atoi(inherited)
+	}
+	if fd == 0 {
+		return net.Listen("tcp", addr)
+	}
+	infof("daemon", "taking over inherited socket\n")
+	file := os.NewFile(uintptr(fd), "listener")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not take over socket")
+	}
+	return listener, nil
+}
+
+// signalReady tells the process that handed over the socket it may stop
+// serving.
+func signalReady() {
+	fd, _ := strconv.Atoi(os.Getenv("SPECTACLE_READY_FD"))
+	if fd == 0 {
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
+
+// handoff starts a new spectacle on the same socket, returning once it is
+// serving.
+func handoff(listener net.Listener) error {
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		return errors.New("listener can't be handed off")
+	}
+	file, err := tcp.File()
+	if err != nil {
+		return errors.Wrap(err, "could not get socket")
+	}
+	defer file.Close()
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "could not create pipe")
+	}
+	defer readyRead.Close()
+
+	binary, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "could not find binary")
+	}
+	env := []string{"SPECTACLE_LISTEN_FD=3", "SPECTACLE_READY_FD=4"}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "LISTEN_") && !strings.HasPrefix(v, "SPECTACLE_LISTEN_FD=") && !strings.HasPrefix(v, "SPECTACLE_READY_FD=") {
+			env = append(env, v)
+		}
+	}
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{file, readyWrite}
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return errors.Wrap(err, "could not start new process")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := readyRead.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			cmd.Process.Kill()
+			return errors.Wrap(err, "new process failed to start")
+		}
+	case <-time.After(30 * time.Second):
+		cmd.Process.Kill()
+		return errors.New("new process did not get ready in time")
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// awaitHandoff hands the socket over on SIGUSR2, shutting the server down
+// gracefully once the new process serves.
+func awaitHandoff(server *http.Server, listener net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	for range signals {
+		infof("daemon", "handing off socket...\n")
+		if err := handoff(listener); err != nil {
+			errorf("daemon", "could not hand off, %s\n", err.Error())
+			continue
+		}
+		// Stay deaf to further SIGUSR2, the default of which would kill
+		// this process while it drains.
+		signal.Ignore(syscall.SIGUSR2)
+		atomic.StoreInt32(&draining, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		server.Shutdown(ctx)
+		cancel()
+		return
+	}
+}
+
+// drain waits for queued and running builds to finish.
+func drain() {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+
+	for {
+		busy := len(scheduler.pending)
+		for _, running := range scheduler.running {
+			busy += running
+		}
+		if busy == 0 {
+			return
+		}
+		scheduler.cond.Wait()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Route sends the builds it matches to a backend, runner or runners with
+// labels, repos and branches matching globs and events being push, tag,
+// pull_request or bisect. Empty matchers match everything.
+type Route struct {
+	Name     string
+	Repos    []string `ini:"repo" delim:","`
+	Branches []string `ini:"branch" delim:","`
+	Events   []string `ini:"event" delim:","`
+	Backend  string   `ini:"backend"`
+	Runner   string   `ini:"runner"`
+	Labels   []string `ini:"labels" delim:","`
+}
+
+// routes are tried in config order when a build is queued, the first
+// matching one routing it. They are replaced on reload while builds are
+// being routed.
+var routes = struct {
+	sync.RWMutex
+	list []Route
+}{}
+
+func setRoutes(list []Route) error {
+	for _, route := range list {
+		if _, ok := backends[route.Backend]; !ok && route.Backend != "" && route.Backend != "local" {
+			return errors.Errorf("route %s uses unknown backend %s", route.Name, route.Backend)
+		}
+		for _, event := range route.Events {
+			switch strings.TrimSpace(event) {
+			case "push", "tag", "pull_request", "bisect":
+			default:
+				return errors.Errorf("route %s matches unknown event %s", route.Name, event)
+			}
+		}
+	}
+	routes.Lock()
+	routes.list = list
+	routes.Unlock()
+	return nil
+}
+
+func buildEvent(build Build) string {
+	if build.Bisect {
+		return "bisect"
+	} else if build.Pull > 0 {
+		return "pull_request"
+	} else if build.Tag != "" {
+		return "tag"
+	}
+	return "push"
+}
+
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.TrimSpace(pattern), value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// route applies the first route matching build, a backend already picked by
+// policy being kept. Fork builds keep to the repo's fork backend whatever
+// the route, so a catch-all route can't run them on the host.
+func route(build *Build) {
+	event := buildEvent(*build)
+	routes.RLock()
+	list := routes.list
+	routes.RUnlock()
+	for _, route := range list {
+		if !matchAny(route.Repos, build.Repo) || !matchAny(route.Branches, build.Branch) || !matchAny(route.Events, event) {
+			continue
+		}
+		if build.Backend == "" && !build.Fork {
+			build.Backend = route.Backend
+		}
+		build.Runner = route.Runner
+		build.Labels = labelList(labelSet(route.Labels))
+		debugf("queue", "├routed %s build of %s by %s\n", event, build.Repo, route.Name)
+		return
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type BuildJob struct {
+	Name   string
+	Url    string
+	Branch string
+	Repo   Repo
+	Build  Build
+
+	ctx   context.Context
+	token string
+	span  *Span
+}
+
+const logDir = "logs"
+
+// workDir holds build checkouts and the caches kept between builds.
+var workDir = "/tmp"
+
+// queueBuild allocates a build number for build and queues it for repo.
+func queueBuild(repo *Repo, build Build) (Build, error) {
+	build, err := allocateBuild(repo, build)
+	if err != nil {
+		return build, err
+	}
+
+	err = queueWork(newJob(repo, build))
+	if err != nil {
+		build.Status = "DROPPED"
+		store.Update(build)
+		return build, err
+	}
+	publish(Event{Type: "queued", Repo: repo.Name, Number: build.Number, Status: build.Status})
+	return build, nil
+}
+
+// allocateBuild routes, numbers and records a build.
+func allocateBuild(repo *Repo, build Build) (Build, error) {
+	route(&build)
+	if sharedQueue != nil && !build.Bisect {
+		number, err := sharedQueue.Number(repo.Name)
+		if err != nil {
+			return build, err
+		}
+		build.Number = number
+	}
+	build, err := store.Next(build)
+	if err != nil {
+		return build, errors.Wrap(err, "could not allocate build")
+	}
+	build.Log = logDir + "/" + workspaceName(*repo, repo.Name) + "-" + strconv.Itoa(build.Number) + ".log"
+	return build, nil
+}
+
+// forkBackend picks the backend of fork pull requests, the most isolated one
+// configured unless the repo names one, local naming this host.
+func forkBackend(repo Repo) string {
+	if repo.ForkBackend != "" {
+		return repo.ForkBackend
+	} else if _, ok := backends["microvm"]; ok {
+		return "microvm"
+	}
+	return repo.Backend
+}
+
+func newJob(repo *Repo, build Build) BuildJob {
+	return BuildJob{
+		Name:   repo.Name,
+		Url:    "https://github.com/" + repo.Name,
+		Branch: build.Branch,
+		Repo:   *repo,
+		Build:  build,
+	}
+}
+
+func jobRunner() {
+	var job BuildJob
+	defer reportPanic(&job)
+	for {
+		job = nextJob()
+
+		start := time.Now()
+		infof("runner", "┌running build job #%d on %s|%s\n", job.Build.Number, job.Name, job.Branch)
+
+		startSpanAt(job.Build.Trace, "queue", job.Build.Queued).End()
+		recordQueueWait(&job)
+		job.span = startSpan(job.Build.Trace, "build")
+		job.span.Set("spectacle.repo", job.Name)
+		job.span.Set("spectacle.build", strconv.Itoa(job.Build.Number))
+		job.span.Set("spectacle.branch", job.Branch)
+
+		job.Build.Status = "RUNNING"
+		job.Build.Started = start
+		if err := store.Update(job.Build); err != nil {
+			errorf("runner", "├could not update build, %s", err.Error())
+			reportError(errors.Wrap(err, "could not update build"), &job)
+		}
+		publish(Event{Type: "started", Repo: job.Name, Number: job.Build.Number, Status: job.Build.Status})
+
+		token, err := repoToken(job.Repo)
+		if err != nil {
+			warnf("runner", "├no github token, %s", err.Error())
+		}
+		job.token = token
+
+		// The build's own timeout fails it rather than cancelling it
+		parent, cancel := job.ctx, context.CancelFunc(func() {})
+		if job.Repo.BuildTimeout > 0 {
+			job.ctx, cancel = context.WithTimeout(parent, job.Repo.BuildTimeout)
+		}
+		name, err := pickRunner(&job)
+		if err != nil {
+			warnf("runner", "├%s", err.Error())
+			reportError(err, &job)
+		} else if err = runHook(currentHooks().PreBuild, &job); err != nil {
+			warnf("runner", "├pre build %s", err.Error())
+			reportError(errors.Wrap(err, "pre build hook failed"), &job)
+		} else if name != "" {
+			err = runRemote(&job, name, backends[name])
+		} else {
+			err = runJob(&job)
+			reapOrphans(&job)
+		}
+		job.Build.TimedOut = job.ctx.Err() == context.DeadlineExceeded
+		cancel()
+		job.ctx = parent
+
+		job.Build.Status = "OK"
+		if job.Build.TimedOut {
+			warnf("runner", "├timed out after %s", job.Repo.BuildTimeout)
+			job.Build.Status = "FAIL"
+		} else if job.ctx.Err() != nil {
+			job.Build.Status = "CANCELLED"
+		} else if err != nil {
+			job.Build.Status = "FAIL"
+		}
+		job.Build.Duration = time.Since(start)
+		if err := store.Update(job.Build); err != nil {
+			errorf("runner", "├could not update build, %s", err.Error())
+			reportError(errors.Wrap(err, "could not update build"), &job)
+		}
+		publish(Event{Type: "completed", Repo: job.Name, Number: job.Build.Number, Status: job.Build.Status})
+		if logIndex != nil {
+			logIndex.Add(job.Build)
+		}
+		job.span.Set("spectacle.status", job.Build.Status)
+		if job.Build.Status == "FAIL" {
+			job.span.Fail(err)
+		}
+		job.span.End()
+		if err := runHook(currentHooks().PostBuild, &job); err != nil {
+			warnf("runner", "├post build %s", err.Error())
+			reportError(errors.Wrap(err, "post build hook failed"), &job)
+		}
+		checkDuration(&job)
+		maybeBisect(&job)
+		notifyBuild(&job)
+		if job.Build.Pull > 0 {
+			if err := commentSummary(&job); err != nil {
+				warnf("runner", "├could not comment on pull request, %s", err.Error())
+			}
+		}
+		infof("runner", "└[%s] #%d in %.2fs\n", job.Build.Status, job.Build.Number, float64(job.Build.Duration)/float64(time.Second))
+		finishJob(job)
+	}
+}
+
+func runJob(job *BuildJob) error {
+	// Set up working directory and prepare
+	tmpDir := workDir + "/spectacle-" + workspaceName(job.Repo, job.Name) + "-" + strconv.Itoa(job.Build.Number)
+	buildPath := tmpDir + "/src/github.com/" + job.Name
+	if info, _ := os.Stat(tmpDir); info != nil {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			errorf("runner", "├could not remove temporary files, %s", err.Error())
+			reportError(errors.Wrap(err, "could not remove temporary files"), job)
+			return errors.Wrap(err, "remove failed")
+		}
+	}
+	defer os.RemoveAll(tmpDir)
+	os.MkdirAll(buildPath, os.ModePerm)
+	filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			err = os.Chown(path, 1001, 1001)
+		}
+		return err
+	})
+
+	// Open build log
+	os.MkdirAll(logDir, os.ModePerm)
+	logFile, err := os.Create(job.Build.Log)
+	if err != nil {
+		errorf("runner", "├could not create build log, %s", err.Error())
+		reportError(errors.Wrap(err, "could not create build log"), job)
+		return errors.Wrap(err, "log create failed")
+	}
+	defer logFile.Close()
+
+	// Fetch code
+	span := job.span.Child("checkout")
+	err = checkout(job, buildPath, logFile)
+	span.Fail(err)
+	span.End()
+	if err != nil {
+		warnf("git", "├failed to prepare for build, %s", err.Error())
+		return err
+	}
+
+	if err := verifyCommit(job, buildPath); err != nil {
+		warnf("runner", "├refusing unverified commit, %s", err.Error())
+		return errors.Wrap(err, "commit verification failed")
+	}
+	if err := verifyTag(job, buildPath); err != nil {
+		warnf("runner", "├refusing unverified tag, %s", err.Error())
+		return errors.Wrap(err, "tag verification failed")
+	}
+
+	// Find and run pipeline steps
+	pipeline, err := loadPipeline(buildPath, job.Repo.GoMode, goModCacheFor(job, tmpDir))
+	if err != nil {
+		warnf("runner", "├no pipeline, %s", err.Error())
+		return errors.Wrap(err, "could not load pipeline")
+	}
+	if err := applyTemplate(pipeline, job); err != nil {
+		warnf("runner", "├could not prepare environment, %s", err.Error())
+		return errors.Wrap(err, "template failed")
+	}
+	// Deploys are only retried when the step asks for it
+	for i := range pipeline.Steps {
+		if pipeline.Steps[i].Retries == 0 && !pipeline.Steps[i].Deploy {
+			pipeline.Steps[i].Retries = job.Repo.Retries
+		}
+	}
+
+	// Bring up services
+	services, err := startServices("spectacle-"+strings.Replace(job.Name, "/", "-", -1)+"-"+strconv.Itoa(job.Build.Number), pipeline.Services)
+	defer stopServices(services)
+	if err != nil {
+		warnf("runner", "├failed to start services, %s", err.Error())
+		return errors.Wrap(err, "services failed")
+	}
+
+	env := []string{
+		"HOME=/home/spectacle",
+		"GOPATH=" + tmpDir,
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/bin",
+		"SPECTACLE_REPO=" + job.Name,
+		"SPECTACLE_BRANCH=" + job.Branch,
+		"SPECTACLE_TAG=" + job.Build.Tag,
+		"SPECTACLE_COMMIT=" + job.Build.Commit,
+		"SPECTACLE_PULL=" + strconv.Itoa(job.Build.Pull),
+		"SPECTACLE_BUILD_NUMBER=" + strconv.Itoa(job.Build.Number),
+	}
+	nix := ""
+	if job.Repo.Nix {
+		if nix = nixEnvironment(buildPath); nix != "" {
+			infof("runner", "├running steps in nix %s\n", nix)
+			env = append(env, "PATH=/nix/var/nix/profiles/default/bin:/usr/local/sbin:/usr/local/bin:/usr/bin")
+		}
+	}
+	// Untrusted forks get neither credentials nor caches they could poison
+	if trusted(job) {
+		if blobCache != nil {
+			grant := blobCache.Grant()
+			defer blobCache.Revoke(grant)
+			env = append(env, "SPECTACLE_CACHE_URL="+cacheUrl, "SPECTACLE_CACHE_TOKEN="+grant)
+		}
+		cacheEnv, err := compilerCacheEnv(job.Repo, pipeline, env)
+		if err != nil {
+			warnf("runner", "├could not prepare compiler cache, %s", err.Error())
+			return errors.Wrap(err, "compiler cache failed")
+		}
+		env = append(env, cacheEnv...)
+		registryEnv, err := dockerConfig(job.Repo, tmpDir+"/.docker")
+		if err != nil {
+			warnf("runner", "├could not prepare registry credentials, %s", err.Error())
+			return errors.Wrap(err, "registry credentials failed")
+		}
+		env = append(env, registryEnv...)
+	} else {
+		infof("runner", "├fork pull request, secrets withheld\n")
+	}
+	env = append(env, job.Build.Env...)
+	env = append(env, pipeline.Env...)
+	env = append(env, serviceEnv(services)...)
+	ctx := job.ctx
+	exceeded := func() bool { return false }
+	if job.Repo.DiskQuota != "" {
+		quota, err := parseSize(job.Repo.DiskQuota)
+		if err != nil {
+			return errors.Wrap(err, "bad disk quota")
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(job.ctx)
+		defer cancel()
+		exceeded = watchDiskQuota(tmpDir, quota, cancel)
+	}
+
+	var stepErr error
+	var refusal *string
+	for _, step := range pipeline.Steps {
+		if ctx.Err() != nil {
+			stepErr = errors.New("cancelled")
+			break
+		}
+
+		context := "spectacle/" + step.Name
+		if step.Deploy {
+			if refusal == nil {
+				reason := deployRefusal(job)
+				refusal = &reason
+			}
+			if *refusal != "" {
+				warnf("runner", "├refused deploy step %s, %s\n", step.Name, *refusal)
+				job.Build.Steps = append(job.Build.Steps, StepResult{
+					Name:    step.Name,
+					Skipped: *refusal,
+				})
+				if err := store.Update(job.Build); err != nil {
+					errorf("runner", "├could not update build, %s", err.Error())
+				}
+				if err := postStatus(job.token, job.Name, job.Build.Commit, context, "error", "deploy refused"); err != nil {
+					warnf("runner", "├%s", err.Error())
+				}
+				continue
+			}
+		}
+
+		approvedBy := ""
+		if step.Approval == "required" {
+			by, err := awaitApproval(ctx, job, step.Name)
+			if err != nil {
+				warnf("runner", "├step %s %s\n", step.Name, err.Error())
+				stepErr = err
+				break
+			}
+			approvedBy = by
+		}
+
+		if err := postStatus(job.token, job.Name, job.Build.Commit, context, "pending", "running"); err != nil {
+			warnf("runner", "├%s", err.Error())
+		}
+
+		// Retried attempts keep their own logs, the flaky flag recording that
+		// the step passed only after failing
+		stepLog := strings.TrimSuffix(job.Build.Log, ".log") + "." + strings.NewReplacer("/", "-", " ", "-").Replace(step.Name)
+		var result StepResult
+		var err error
+		span := job.span.Child("step " + step.Name)
+		for attempt := 1; attempt <= step.Retries+1; attempt++ {
+			logPath := stepLog + ".log"
+			if attempt > 1 {
+				logPath = stepLog + "." + strconv.Itoa(attempt) + ".log"
+				infof("runner", "├retrying step %s, attempt %d\n", step.Name, attempt)
+			}
+			result, err = runStep(ctx, step, Workspace{
+				Repo:    job.Repo,
+				Root:    tmpDir,
+				Dir:     buildPath,
+				Env:     env,
+				Mounts:  pipeline.Mounts,
+				Nix:     nix,
+				Trusted: trusted(job),
+			}, logPath)
+			result.Attempts = attempt
+			result.Flaky = err == nil && attempt > 1
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+		}
+		result.ApprovedBy = approvedBy
+		span.Set("spectacle.attempts", strconv.Itoa(result.Attempts))
+		span.Fail(err)
+		span.End()
+		job.Build.Steps = append(job.Build.Steps, result)
+		if err := store.Update(job.Build); err != nil {
+			errorf("runner", "├could not update build, %s", err.Error())
+		}
+
+		state := "success"
+		if err != nil {
+			state = "failure"
+		}
+		publish(Event{Type: "step", Repo: job.Name, Number: job.Build.Number, Step: step.Name, Status: state})
+		description := fmt.Sprintf("exit %d in %.2fs", result.ExitCode, float64(result.Duration)/float64(time.Second))
+		if err := postStatus(job.token, job.Name, job.Build.Commit, context, state, description); err != nil {
+			warnf("runner", "├%s", err.Error())
+		}
+
+		infof("runner", "├step %s %s\n", step.Name, description)
+		if err != nil {
+			warnf("runner", "├failed to complete, %s", err.Error())
+			stepErr = err
+			break
+		}
+	}
+
+	if exceeded() {
+		warnf("runner", "├disk quota of %s exceeded\n", job.Repo.DiskQuota)
+		fmt.Fprintf(logFile, "disk quota of %s exceeded\n", job.Repo.DiskQuota)
+		stepErr = errors.Errorf("disk quota of %s exceeded", job.Repo.DiskQuota)
+	}
+
+	if len(job.Repo.CompilerCache) > 0 {
+		job.Build.CompilerCache = compilerCacheStats(job.Repo, env)
+		if err := store.Update(job.Build); err != nil {
+			errorf("runner", "├could not update build, %s", err.Error())
+		}
+	}
+
+	// Collect test reports, failed builds included
+	if tests := collectJunit(job, buildPath); len(tests) > 0 {
+		job.Build.Tests = tests
+		job.Build.FailedTests = failedTests(tests)
+		if err := store.Update(job.Build); err != nil {
+			errorf("runner", "├could not update build, %s", err.Error())
+		}
+
+		if len(job.Build.FailedTests) > 0 {
+			warnf("runner", "├failed tests: %s\n", strings.Join(job.Build.FailedTests, ", "))
+		}
+	}
+	if stepErr != nil {
+		return stepErr
+	}
+
+	// Collect coverage
+	if coverage, ok := collectCoverage(job, buildPath); ok {
+		job.Build.Coverage = &coverage
+		if err := store.Update(job.Build); err != nil {
+			errorf("runner", "├could not update build, %s", err.Error())
+		}
+
+		infof("runner", "├coverage %.1f%%\n", coverage)
+		if coverage < job.Repo.CoverageThreshold {
+			warnf("runner", "├coverage below %.1f%%", job.Repo.CoverageThreshold)
+			return errors.Errorf("coverage %.1f%% below threshold", coverage)
+		}
+	}
+
+	artifacts, err := collectArtifacts(job, buildPath)
+	if len(artifacts) > 0 {
+		job.Build.Artifacts = artifacts
+		if err := store.Update(job.Build); err != nil {
+			errorf("runner", "├could not update build, %s", err.Error())
+		}
+		infof("runner", "├collected %d artifacts\n", len(artifacts))
+	}
+	if err != nil {
+		warnf("runner", "├failed to collect artifacts, %s", err.Error())
+		return errors.Wrap(err, "artifacts failed")
+	}
+
+	return nil
+}
+
+// runGit runs git for job, verbose git logging the commands and their output
+// with the token bearing cloneUrl left out.
+func runGit(job *BuildJob, logFile io.Writer, cloneUrl string, args ...string) error {
+	gitCmd := exec.Command("git", args...)
+	gitCmd.Stdout = logFile
+	gitCmd.Stderr = logFile
+	if logEnabled(levelDebug, "git", &job.Repo) {
+		logf(levelDebug, "git", &job.Repo, "├git %s\n", strings.Replace(strings.Join(args, " "), cloneUrl, job.Url, -1))
+		gitCmd.Stdout = io.MultiWriter(logFile, log.Writer())
+		gitCmd.Stderr = gitCmd.Stdout
+	}
+	return errors.Wrap(gitCmd.Run(), "git command failed")
+}
+
+// checkout clones the job's repo into dir and checks out the commit being
+// built, resolving it when the build has none.
+func checkout(job *BuildJob, dir string, logFile io.Writer) error {
+	cloneUrl := job.Url
+	if githubApp != nil && job.token != "" {
+		cloneUrl = strings.Replace(job.Url, "https://", "https://x-access-token:"+job.token+"@", 1)
+	}
+	merge := job.Build.Pull > 0 && job.Repo.PullMerge
+	// Worktrees share the mirror's gitdir, hooks and config included, so
+	// pull requests and untrusted builds get a private clone instead
+	worktree := job.Repo.Checkout == "worktree" && trusted(job) && job.Build.Pull == 0
+	mirror := ""
+	if job.Repo.GitMirror || job.Repo.Checkout == "worktree" {
+		var err error
+		if mirror, err = updateMirror(job, cloneUrl, logFile); err != nil {
+			return err
+		}
+	}
+
+	if worktree {
+		ref := job.Build.Commit
+		if merge {
+			ref = "refs/pull/" + strconv.Itoa(job.Build.Pull) + "/merge"
+		} else if ref == "" && job.Build.Pull > 0 {
+			ref = "refs/pull/" + strconv.Itoa(job.Build.Pull) + "/head"
+		} else if ref == "" {
+			ref = "refs/heads/" + job.Branch
+		}
+		if err := addWorktree(job, cloneUrl, mirror, dir, ref, logFile); err != nil {
+			return err
+		}
+	} else if job.Repo.Checkout == "fetch" {
+		// Only the commit built is transferred, merges along with their
+		// parents for the check below
+		ref, depth := job.Build.Commit, "1"
+		if merge {
+			ref, depth = "pull/"+strconv.Itoa(job.Build.Pull)+"/merge", "2"
+		} else if ref == "" && job.Build.Pull > 0 {
+			ref = "pull/" + strconv.Itoa(job.Build.Pull) + "/head"
+		} else if ref == "" {
+			ref = "refs/heads/" + job.Branch
+		}
+		gitCmds := [][]string{
+			{"init", "-q", dir},
+			{"-C", dir, "remote", "add", "origin", job.Url},
+			{"-C", dir, "fetch", "--depth", depth, cloneUrl, ref},
+			{"-C", dir, "checkout", "-q", "FETCH_HEAD"},
+		}
+		for _, args := range gitCmds {
+			if err := runGit(job, logFile, cloneUrl, args...); err != nil {
+				return err
+			}
+		}
+	} else {
+		clone := []string{"clone"}
+		if mirror != "" {
+			clone = append(clone, "--reference", mirror, "--dissociate")
+		}
+		if job.Build.Pull == 0 && job.Branch != "" {
+			clone = append(clone, "-b", job.Branch)
+		}
+		// The token is dropped from the remote right away so steps can't read
+		// it from .git/config, later fetches passing it along themselves
+		gitCmds := [][]string{
+			append(clone, cloneUrl, dir),
+			{"-C", dir, "remote", "set-url", "origin", job.Url},
+		}
+		if merge {
+			gitCmds = append(gitCmds, []string{"-C", dir, "fetch", cloneUrl, "pull/" + strconv.Itoa(job.Build.Pull) + "/merge"})
+			gitCmds = append(gitCmds, []string{"-C", dir, "checkout", "-q", "FETCH_HEAD"})
+		} else if job.Build.Pull > 0 {
+			gitCmds = append(gitCmds, []string{"-C", dir, "fetch", cloneUrl, "pull/" + strconv.Itoa(job.Build.Pull) + "/head"})
+		}
+		if job.Build.Commit != "" && !merge {
+			gitCmds = append(gitCmds, []string{"-C", dir, "checkout", "-q", job.Build.Commit})
+		}
+		for _, args := range gitCmds {
+			if err := runGit(job, logFile, cloneUrl, args...); err != nil {
+				return err
+			}
+		}
+	}
+
+	// GitHub only has a merge ref for mergeable pull requests, updated some
+	// time after a push
+	if merge {
+		out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD", "HEAD^2").Output()
+		commits := strings.Fields(string(out))
+		if err != nil || len(commits) != 2 {
+			return errors.New("could not resolve merge commit, is the pull request mergeable?")
+		}
+		if job.Build.Commit != "" && commits[1] != job.Build.Commit {
+			return errors.Errorf("merge ref is of %s rather than %s, not yet updated", commits[1], job.Build.Commit)
+		}
+		job.Build.Merge = commits[0]
+		fmt.Fprintf(logFile, "testing merge %s of %s\n", job.Build.Merge, commits[1])
+	}
+
+	if job.Build.Commit == "" {
+		if out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output(); err == nil {
+			job.Build.Commit = strings.TrimSpace(string(out))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// S3Bucket keeps objects in an S3 bucket, requests signed with AWS signature
+// version 4. Keys missing from the config are taken from the usual AWS
+// environment variables. Other S3 compatible stores like MinIO are reached
+// at Endpoint, those without bucket subdomains with PathStyle and those with
+// self-signed certificates trusting the ca in CaFile.
+type S3Bucket struct {
+	Bucket    string
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Endpoint  string
+	PathStyle bool
+	CaFile    string
+	client    *http.Client
+}
+
+func NewS3Bucket(bucket S3Bucket) (*S3Bucket, error) {
+	if bucket.Bucket == "" {
+		return nil, errors.New("s3 needs a bucket")
+	}
+	if bucket.Region == "" {
+		bucket.Region = os.Getenv("AWS_REGION")
+	}
+	if bucket.Region == "" {
+		bucket.Region = "us-east-1"
+	}
+	if bucket.AccessKey == "" {
+		bucket.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		bucket.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if bucket.AccessKey == "" || bucket.SecretKey == "" {
+		return nil, errors.Errorf("s3 bucket %s has no access_key and secret_key", bucket.Bucket)
+	}
+	bucket.Prefix = strings.Trim(bucket.Prefix, "/")
+	bucket.client = &http.Client{Timeout: 30 * time.Second}
+
+	if bucket.Endpoint == "" {
+		bucket.Endpoint = "https://s3." + bucket.Region + ".amazonaws.com"
+	}
+	bucket.Endpoint = strings.TrimSuffix(bucket.Endpoint, "/")
+	if endpoint, err := url.Parse(bucket.Endpoint); err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, errors.Errorf("bad s3 endpoint %s", bucket.Endpoint)
+	}
+	if bucket.CaFile != "" {
+		ca, err := ioutil.ReadFile(bucket.CaFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read s3 ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("s3 ca is not pem")
+		}
+		bucket.client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+	return &bucket, nil
+}
+
+func (b *S3Bucket) url(key string) string {
+	if b.Prefix != "" {
+		key = b.Prefix + "/" + key
+	}
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	if b.PathStyle {
+		return b.Endpoint + "/" + awsEscape(b.Bucket) + "/" + strings.Join(segments, "/")
+	}
+	scheme := strings.Index(b.Endpoint, "://") + 3
+	return b.Endpoint[:scheme] + b.Bucket + "." + b.Endpoint[scheme:] + "/" + strings.Join(segments, "/")
+}
+
+func (b *S3Bucket) Put(key string, body []byte, contentType string) error {
+	req, err := http.NewRequest("PUT", b.url(key), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "bad s3 key "+key)
+	}
+	req.Header.Set("Content-Type", contentType)
+	_, err = b.do(req, body)
+	return errors.Wrap(err, "could not put "+key)
+}
+
+func (b *S3Bucket) Get(key string) ([]byte, error) {
+	req, err := http.NewRequest("GET", b.url(key), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad s3 key "+key)
+	}
+	body, err := b.do(req, nil)
+	return body, errors.Wrap(err, "could not get "+key)
+}
+
+func (b *S3Bucket) do(req *http.Request, body []byte) ([]byte, error) {
+	b.sign(req, body, time.Now())
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return nil, errors.New(strings.TrimSpace(resp.Status + " " + string(raw)))
+	}
+	return raw, err
+}
+
+// sign adds the x-amz headers and authorization of signature version 4,
+// signing the host, content type and x-amz headers.
+func (b *S3Bucket) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	payload := sha256.Sum256(body)
+	req.Header.Set("x-amz-date", stamp)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payload[:]))
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" && b.AccessKey == os.Getenv("AWS_ACCESS_KEY_ID") {
+		req.Header.Set("x-amz-security-token", token)
+	}
+
+	values := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			values[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := &strings.Builder{}
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signed,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + b.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + b.SecretKey)
+	for _, part := range []string{date, b.Region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", b.AccessKey, scope, signed, hex.EncodeToString(key)))
+}
+
+// awsEscape percent encodes all but the unreserved characters, as AWS
+// expects of canonical paths.
+func awsEscape(segment string) string {
+	escaped := &strings.Builder{}
+	for _, c := range []byte(segment) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
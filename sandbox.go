@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// selfPath is the spectacle binary, re-executed to sandbox build commands.
+var selfPath, _ = os.Executable()
+
+// defaultSeccomp are the syscalls denied by the "default" seccomp setting,
+// those no build has business making.
+var defaultSeccomp = []string{
+	"mount", "umount2", "pivot_root", "unshare",
+	"reboot", "kexec_load", "init_module", "delete_module",
+	"swapon", "swapoff", "acct", "settimeofday", "clock_settime",
+	"ptrace", "perf_event_open", "keyctl", "add_key", "request_key",
+}
+
+// limits are the repo's cpu and memory limits, defaulting to the global ones.
+func limits(repo Repo) (cpu string, memory int64) {
+	cpu = repo.CpuLimit
+	if cpu == "" {
+		cpu = *cpuLimit
+	}
+	size := repo.MemoryLimit
+	if size == "" {
+		size = *memoryLimit
+	}
+	if size != "" {
+		memory, _ = parseSize(size)
+	}
+	return cpu, memory
+}
+
+// sandboxed wraps a command run on the host in the repo's apparmor profile
+// and seccomp filter, if any, and for network none in a network namespace
+// with nothing but loopback. Cpu and memory limits put it in its own cgroup.
+func sandboxed(repo Repo, args []string) []string {
+	if len(repo.Seccomp) > 0 {
+		args = append([]string{selfPath, "sandbox", strings.Join(repo.Seccomp, ",")}, args...)
+	}
+	if repo.AppArmor != "" {
+		args = append([]string{"aa-exec", "-p", repo.AppArmor, "--"}, args...)
+	}
+	if repo.Network == "none" {
+		args = append([]string{"unshare", "--net", "--", "sh", "-c", `ip link set lo up && exec "$@"`, "sh"}, args...)
+	}
+	if cpu, memory := limits(repo); cpu != "" || memory > 0 {
+		scope := []string{"systemd-run", "--scope", "--quiet"}
+		if cores, err := strconv.ParseFloat(cpu, 64); err == nil {
+			scope = append(scope, "-p", "CPUQuota="+strconv.Itoa(int(cores*100))+"%")
+		}
+		if memory > 0 {
+			scope = append(scope, "-p", "MemoryMax="+strconv.FormatInt(memory, 10))
+		}
+		args = append(append(scope, "--"), args...)
+	}
+	return args
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const sbomFile = "sbom.cdx.json"
+
+type goModule struct {
+	Path    string
+	Version string
+	Main    bool
+	Replace *goModule
+}
+
+type sbomComponent struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Purl    string `json:"purl,omitempty"`
+}
+
+// sbomStep writes a CycloneDX SBOM of the checkout's Go modules.
+func sbomStep(ctx context.Context, workspace Workspace, result *StepResult, log io.Writer) error {
+	cmd := exec.Command("go", "list", "-m", "-json", "all")
+	cmd.Dir = workspace.Dir
+	cmd.Env = workspace.Env
+	cmd.Stderr = log
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrap(err, "could not list modules")
+	}
+	wait, err := startGroup(ctx, cmd)
+	if err != nil {
+		return errors.Wrap(err, "could not list modules")
+	}
+
+	var main sbomComponent
+	components := make([]sbomComponent, 0, 50)
+	decoder := json.NewDecoder(out)
+	for decoder.More() {
+		module := goModule{}
+		if err := decoder.Decode(&module); err != nil {
+			wait()
+			return errors.Wrap(err, "could not decode module list")
+		}
+		if module.Replace != nil {
+			module.Path, module.Version = module.Replace.Path, module.Replace.Version
+		}
+
+		component := sbomComponent{
+			Type:    "library",
+			Name:    module.Path,
+			Version: module.Version,
+		}
+		if module.Version != "" {
+			component.Purl = "pkg:golang/" + module.Path + "@" + module.Version
+		}
+		if module.Main {
+			component.Type = "application"
+			main = component
+			continue
+		}
+		components = append(components, component)
+	}
+	if err := wait(); err != nil {
+		return errors.Wrap(err, "could not list modules")
+	}
+
+	bom := map[string]interface{}{
+		"bomFormat":   "CycloneDX",
+		"specVersion": "1.4",
+		"version":     1,
+		"metadata": map[string]interface{}{
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+			"component": main,
+		},
+		"components": components,
+	}
+	raw, _ := json.MarshalIndent(bom, "", "  ")
+	if err := ioutil.WriteFile(workspace.Dir+"/"+sbomFile, raw, 0644); err != nil {
+		return errors.Wrap(err, "could not write sbom")
+	}
+	result.Outputs = append(result.Outputs, sbomFile)
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var errQueueFull = errors.New("queue full")
+
+// scheduler holds queued jobs until a worker is free and the job's repo is
+// below its concurrency limit, jobs of a repo at its limit being skipped
+// rather than blocking the queue.
+var scheduler = struct {
+	sync.Mutex
+	cond    *sync.Cond
+	pending []BuildJob
+	running map[string]int
+	cancels map[string]context.CancelFunc
+}{
+	pending: make([]BuildJob, 0, 10),
+	running: make(map[string]int),
+	cancels: make(map[string]context.CancelFunc),
+}
+
+func jobKey(repo string, number int) string {
+	return repo + "#" + strconv.Itoa(number)
+}
+
+func init() {
+	scheduler.cond = sync.NewCond(&scheduler)
+}
+
+// queueWork queues job in the shared queue when there is one, bisect builds
+// staying local as their outcome is awaited here.
+func queueWork(job BuildJob) error {
+	if sharedQueue != nil && !job.Build.Bisect {
+		return sharedQueue.Push(job.Build, jobLabels(job))
+	}
+	if runner := pinnedRunner(job); runner != "" && runner != *runnerName {
+		return errors.Errorf("no runner %s", runner)
+	}
+	if _, err := pickRunner(&job); err != nil {
+		return err
+	}
+	return queueLocal(job)
+}
+
+// runsHere reports whether this instance's workers may run the job, jobs
+// not pinned to a runner running anywhere it or one of its backends has the
+// labels they ask for.
+func runsHere(job BuildJob) bool {
+	if runner := pinnedRunner(job); runner != "" && runner != *runnerName {
+		return false
+	}
+	_, err := pickRunner(&job)
+	return err == nil
+}
+
+func queueLocal(job BuildJob) error {
+	scheduler.Lock()
+	if len(scheduler.pending) >= *queueSize {
+		scheduler.Unlock()
+		return errQueueFull
+	}
+	var cancel context.CancelFunc
+	job.ctx, cancel = context.WithCancel(context.Background())
+	scheduler.cancels[jobKey(job.Name, job.Build.Number)] = cancel
+	scheduler.pending = append(scheduler.pending, job)
+	debugf("queue", "├%d pending, %d running on %s\n", len(scheduler.pending), scheduler.running[job.Name], job.Name)
+	scheduler.Unlock()
+	scheduler.cond.Broadcast()
+	return nil
+}
+
+func nextJob() BuildJob {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+
+	for {
+		for i, job := range scheduler.pending {
+			limit := job.Repo.Concurrency
+			if limit > 0 && scheduler.running[job.Name] >= limit {
+				continue
+			}
+
+			scheduler.pending = append(scheduler.pending[:i], scheduler.pending[i+1:]...)
+			scheduler.running[job.Name]++
+			return job
+		}
+		scheduler.cond.Wait()
+	}
+}
+
+func finishJob(job BuildJob) {
+	scheduler.Lock()
+	scheduler.running[job.Name]--
+	key := jobKey(job.Name, job.Build.Number)
+	if cancel, ok := scheduler.cancels[key]; ok {
+		cancel()
+		delete(scheduler.cancels, key)
+	}
+	scheduler.Unlock()
+	scheduler.cond.Broadcast()
+	if sharedQueue != nil {
+		sharedQueue.Done(job)
+	}
+}
+
+// cancelJob drops a queued job or stops a running one, reporting false if
+// the job is neither.
+func cancelJob(repo string, number int) bool {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+
+	key := jobKey(repo, number)
+	cancel, ok := scheduler.cancels[key]
+	if !ok {
+		return cancelShared(repo, number)
+	}
+	cancel()
+
+	for i, job := range scheduler.pending {
+		if job.Name == repo && job.Build.Number == number {
+			scheduler.pending = append(scheduler.pending[:i], scheduler.pending[i+1:]...)
+			delete(scheduler.cancels, key)
+
+			job.Build.Status = "CANCELLED"
+			store.Update(job.Build)
+			publish(Event{Type: "completed", Repo: job.Name, Number: job.Build.Number, Status: job.Build.Status})
+			break
+		}
+	}
+	return true
+}
+
+func cancelShared(repo string, number int) bool {
+	if sharedQueue == nil || !sharedQueue.Remove(repo, number) {
+		return false
+	}
+	if build, ok := store.Get(repo, number); ok {
+		build.Status = "CANCELLED"
+		store.Update(build)
+	}
+	publish(Event{Type: "completed", Repo: repo, Number: number, Status: "CANCELLED"})
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+var seccompSyscalls = map[string]uintptr{
+	"mount":           syscall.SYS_MOUNT,
+	"umount2":         syscall.SYS_UMOUNT2,
+	"pivot_root":      syscall.SYS_PIVOT_ROOT,
+	"unshare":         syscall.SYS_UNSHARE,
+	"reboot":          syscall.SYS_REBOOT,
+	"kexec_load":      syscall.SYS_KEXEC_LOAD,
+	"init_module":     syscall.SYS_INIT_MODULE,
+	"delete_module":   syscall.SYS_DELETE_MODULE,
+	"swapon":          syscall.SYS_SWAPON,
+	"swapoff":         syscall.SYS_SWAPOFF,
+	"acct":            syscall.SYS_ACCT,
+	"settimeofday":    syscall.SYS_SETTIMEOFDAY,
+	"clock_settime":   syscall.SYS_CLOCK_SETTIME,
+	"ptrace":          syscall.SYS_PTRACE,
+	"perf_event_open": syscall.SYS_PERF_EVENT_OPEN,
+	"keyctl":          syscall.SYS_KEYCTL,
+	"add_key":         syscall.SYS_ADD_KEY,
+	"request_key":     syscall.SYS_REQUEST_KEY,
+}
+
+const (
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	seccompRetKill  = 0x00000000
+	seccompRetErrno = 0x00050000
+	seccompRetAllow = 0x7fff0000
+
+	bpfLdAbsW = 0x00 | 0x00 | 0x20
+	bpfJeqK   = 0x05 | 0x10 | 0x00
+	bpfJgeK   = 0x05 | 0x30 | 0x00
+	bpfRetK   = 0x06 | 0x00
+)
+
+// runSandboxed execs args with the named syscalls failing with EPERM, the
+// filter being installed on this thread just before exec so it binds the
+// command and everything it spawns.
+func runSandboxed(deny []string, args []string) error {
+	if auditArch == 0 {
+		return errors.New("seccomp not supported on " + runtime.GOARCH)
+	}
+	if len(args) == 0 {
+		return errors.New("nothing to run")
+	}
+
+	filter, err := seccompFilter(deny)
+	if err != nil {
+		return err
+	}
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return errors.Wrap(err, "could not find "+args[0])
+	}
+
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errors.Wrap(errno, "could not set no_new_privs")
+	}
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return errors.Wrap(errno, "could not install seccomp filter")
+	}
+	return syscall.Exec(path, args, os.Environ())
+}
+
+// seccompFilter builds the filter killing other architectures' syscalls and
+// failing the denied ones, x32 ones failing as a whole so they can't stand
+// in for the denied ones.
+func seccompFilter(deny []string) ([]syscall.SockFilter, error) {
+	filter := []syscall.SockFilter{
+		{Code: bpfLdAbsW, K: 4},
+		{Code: bpfJeqK, Jt: 1, K: auditArch},
+		{Code: bpfRetK, K: seccompRetKill},
+		{Code: bpfLdAbsW, K: 0},
+	}
+	if x32SyscallBit != 0 {
+		filter = append(filter,
+			syscall.SockFilter{Code: bpfJgeK, Jf: 1, K: x32SyscallBit},
+			syscall.SockFilter{Code: bpfRetK, K: seccompRetErrno | uint32(syscall.EPERM)},
+		)
+	}
+	for _, name := range deny {
+		names := []string{strings.TrimSpace(name)}
+		if names[0] == "default" {
+			names = defaultSeccomp
+		}
+		for _, name := range names {
+			nr, ok := seccompSyscalls[name]
+			if !ok {
+				return nil, errors.Errorf("unknown syscall %s", name)
+			}
+			filter = append(filter,
+				syscall.SockFilter{Code: bpfJeqK, Jf: 1, K: uint32(nr)},
+				syscall.SockFilter{Code: bpfRetK, K: seccompRetErrno | uint32(syscall.EPERM)},
+			)
+		}
+	}
+	return append(filter, syscall.SockFilter{Code: bpfRetK, K: seccompRetAllow}), nil
+}
@@ -0,0 +1,7 @@
+package main
+
+const auditArch = 0xc000003e
+
+// x32SyscallBit marks x32 syscalls, which share the x86_64 audit arch but
+// are numbered apart from it.
+const x32SyscallBit = 0x40000000
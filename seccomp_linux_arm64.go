@@ -0,0 +1,5 @@
+package main
+
+const auditArch = 0xc00000b7
+
+const x32SyscallBit = 0
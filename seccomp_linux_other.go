@@ -0,0 +1,8 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package main
+
+const auditArch = 0
+
+const x32SyscallBit = 0
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+)
+
+// runFilter evaluates the instructions seccompFilter emits against a
+// syscall of arch numbered nr, returning the filter's verdict.
+func runFilter(t *testing.T, filter []syscall.SockFilter, arch, nr uint32) uint32 {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data[0:], nr)
+	binary.LittleEndian.PutUint32(data[4:], arch)
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		switch ins.Code {
+		case bpfLdAbsW:
+			acc = binary.LittleEndian.Uint32(data[ins.K:])
+		case bpfJeqK:
+			if acc == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case bpfJgeK:
+			if acc >= ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case bpfRetK:
+			return ins.K
+		default:
+			t.Fatalf("unexpected instruction %#x", ins.Code)
+		}
+	}
+	t.Fatal("filter fell through")
+	return 0
+}
+
+func TestSeccompFilter(t *testing.T) {
+	if auditArch == 0 {
+		t.Skip("seccomp not supported on this arch")
+	}
+	denied := seccompRetErrno | uint32(syscall.EPERM)
+	x32 := uint32(seccompRetAllow)
+	if x32SyscallBit != 0 {
+		x32 = denied
+	}
+	tests := []struct {
+		deny []string
+		arch uint32
+		nr   uint32
+		want uint32
+	}{
+		{nil, auditArch, syscall.SYS_GETPID, seccompRetAllow},
+		{nil, auditArch, syscall.SYS_MOUNT, seccompRetAllow},
+		{[]string{"mount"}, auditArch, syscall.SYS_MOUNT, denied},
+		{[]string{"mount"}, auditArch, syscall.SYS_UNSHARE, seccompRetAllow},
+		{[]string{" ptrace", "keyctl "}, auditArch, syscall.SYS_KEYCTL, denied},
+		{[]string{"default"}, auditArch, syscall.SYS_UNSHARE, denied},
+		{[]string{"default"}, auditArch, syscall.SYS_PIVOT_ROOT, denied},
+		{[]string{"default"}, auditArch, syscall.SYS_READ, seccompRetAllow},
+		{[]string{"default"}, auditArch + 1, syscall.SYS_READ, seccompRetKill},
+		{nil, auditArch, 0x40000000 | syscall.SYS_GETPID, x32},
+	}
+	for _, test := range tests {
+		filter, err := seccompFilter(test.deny)
+		if err != nil {
+			t.Fatalf("seccompFilter(%q) error = %v", test.deny, err)
+		}
+		if got := runFilter(t, filter, test.arch, test.nr); got != test.want {
+			t.Errorf("seccompFilter(%q) on arch %#x syscall %d = %#x, want %#x", test.deny, test.arch, test.nr, got, test.want)
+		}
+	}
+
+	if _, err := seccompFilter([]string{"mount", "chmod"}); err == nil {
+		t.Error("seccompFilter accepted an unknown syscall")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+func runSandboxed(deny []string, args []string) error {
+	return errors.New("seccomp is only supported on linux")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var sentry *Sentry
+
+// Sentry reports panics and failures of spectacle itself, not of the builds
+// it runs, to a Sentry project.
+type Sentry struct {
+	envelopeUrl string
+	auth        string
+	dsn         string
+}
+
+func NewSentry(dsn string) (*Sentry, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil || parsed.User == nil || parsed.Host == "" {
+		return nil, errors.Errorf("bad sentry dsn %s", dsn)
+	}
+	path := strings.Trim(parsed.Path, "/")
+	project := path[strings.LastIndex(path, "/")+1:]
+	prefix := strings.TrimSuffix(path, project)
+	if project == "" {
+		return nil, errors.Errorf("sentry dsn %s has no project", dsn)
+	}
+
+	return &Sentry{
+		envelopeUrl: parsed.Scheme + "://" + parsed.Host + "/" + prefix + "api/" + project + "/envelope/",
+		auth:        "Sentry sentry_version=7, sentry_client=spectacle/1.0, sentry_key=" + parsed.User.Username(),
+		dsn:         dsn,
+	}, nil
+}
+
+func (s *Sentry) send(level, message string, tags map[string]string, stack string) error {
+	id := randomHex(16)
+	event := map[string]interface{}{
+		"event_id":  id,
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		"level":     level,
+		"platform":  "go",
+		"logger":    "spectacle",
+		"message":   map[string]string{"formatted": message},
+		"tags":      tags,
+	}
+	if stack != "" {
+		event["extra"] = map[string]string{"stack": stack}
+	}
+	header, _ := json.Marshal(map[string]string{"event_id": id, "dsn": s.dsn})
+	raw, _ := json.Marshal(event)
+	body := bytes.NewBuffer(header)
+	fmt.Fprintf(body, "\n{\"type\":\"event\",\"length\":%d}\n%s\n", len(raw), raw)
+
+	req, _ := http.NewRequest("POST", s.envelopeUrl, body)
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+	res, err := notifyClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+func jobTags(job *BuildJob) map[string]string {
+	tags := make(map[string]string)
+	if job != nil {
+		tags["repo"] = job.Name
+		tags["build"] = strconv.Itoa(job.Build.Number)
+		tags["branch"] = job.Branch
+		tags["commit"] = job.Build.Commit
+	}
+	return tags
+}
+
+// reportError reports an unexpected failure of spectacle's own, in the
+// background, with the job it happened during if any.
+func reportError(err error, job *BuildJob) {
+	if sentry == nil || err == nil {
+		return
+	}
+	tags := jobTags(job)
+	go func() {
+		if err := sentry.send("error", err.Error(), tags, ""); err != nil {
+			warnf("daemon", "could not report to sentry, %s\n", err.Error())
+		}
+	}()
+}
+
+// reportFatal reports an error spectacle can't start with, then exits.
+func reportFatal(err error) {
+	if sentry != nil {
+		if err := sentry.send("fatal", err.Error(), jobTags(nil), ""); err != nil {
+			warnf("daemon", "could not report to sentry, %s\n", err.Error())
+		}
+	}
+	log.Fatal(err)
+}
+
+// reportPanic is deferred to report a panic before letting it continue.
+func reportPanic(job *BuildJob) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if sentry != nil {
+		if err := sentry.send("fatal", fmt.Sprintf("panic: %v", r), jobTags(job), string(debug.Stack())); err != nil {
+			warnf("daemon", "could not report to sentry, %s\n", err.Error())
+		}
+	}
+	panic(r)
+}
+
+type panicReporter struct {
+	handler http.Handler
+}
+
+func (p panicReporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer reportPanic(nil)
+	p.handler.ServeHTTP(w, r)
+}
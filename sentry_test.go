@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewSentryEnvelopeUrl(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{"https://key@o1.ingest.sentry.io/42", "https://o1.ingest.sentry.io/api/42/envelope/"},
+		{"https://key@sentry.example.com/sentry/7", "https://sentry.example.com/sentry/api/7/envelope/"},
+	}
+	for _, test := range tests {
+		s, err := NewSentry(test.dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.envelopeUrl != test.want {
+			t.Errorf("envelope url of %s = %s, want %s", test.dsn, s.envelopeUrl, test.want)
+		}
+	}
+
+	for _, dsn := range []string{"https://o1.ingest.sentry.io/42", "https://key@o1.ingest.sentry.io/", "key@host"} {
+		if _, err := NewSentry(dsn); err == nil {
+			t.Errorf("NewSentry accepted %s", dsn)
+		}
+	}
+}
+
+func TestSentrySendsEnvelope(t *testing.T) {
+	type envelope struct {
+		auth   string
+		header map[string]string
+		item   map[string]interface{}
+		length int
+		event  map[string]interface{}
+	}
+	received := make(chan envelope, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := envelope{auth: r.Header.Get("X-Sentry-Auth")}
+		scanner := bufio.NewScanner(r.Body)
+		lines := []string{}
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if len(lines) == 3 {
+			json.Unmarshal([]byte(lines[0]), &got.header)
+			json.Unmarshal([]byte(lines[1]), &got.item)
+			got.length = len(lines[2])
+			json.Unmarshal([]byte(lines[2]), &got.event)
+		}
+		received <- got
+	}))
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "://", "://public@", 1) + "/3"
+	s, err := NewSentry(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &BuildJob{Name: "perlw/spectacle", Branch: "master"}
+	job.Build.Number = 12
+	if err := s.send("error", "could not clone", jobTags(job), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-received
+	if !strings.Contains(got.auth, "sentry_key=public") || !strings.Contains(got.auth, "sentry_version=7") {
+		t.Errorf("X-Sentry-Auth = %s", got.auth)
+	}
+	if got.header["dsn"] != dsn || got.header["event_id"] == "" || got.header["event_id"] != got.event["event_id"] {
+		t.Errorf("envelope header %v of event %v", got.header, got.event["event_id"])
+	}
+	if got.item["type"] != "event" || got.item["length"] != float64(got.length) {
+		t.Errorf("item header %v, event of %d bytes", got.item, got.length)
+	}
+	tags, _ := got.event["tags"].(map[string]interface{})
+	if got.event["level"] != "error" || tags["repo"] != "perlw/spectacle" || tags["build"] != "12" {
+		t.Errorf("event %v", got.event)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// newServer sets up the http server from the [spectacle] section, timeouts
+// left at zero falling back to net/http's own defaults.
+func newServer(config ServerConfig, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              config.Listen,
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    1 << 20,
+	}
+	if !config.Http2 {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return server
+}
+
+// serve accepts connections on the server's address, at most
+// max_connections at once if set. Once handed off to a new process it
+// returns after the builds left here have finished.
+func serve(server *http.Server, config ServerConfig) error {
+	listener, err := listen(server.Addr)
+	if err != nil {
+		return err
+	}
+	go awaitHandoff(server, listener)
+	signalReady()
+	if config.MaxConnections > 0 {
+		listener = &limitListener{Listener: listener, slots: make(chan struct{}, config.MaxConnections)}
+	}
+	if config.TLSCert != "" {
+		err = server.ServeTLS(listener, config.TLSCert, config.TLSKey)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err == http.ErrServerClosed && atomic.LoadInt32(&draining) == 1 {
+		infof("daemon", "handed off, finishing builds...\n")
+		drain()
+		return nil
+	}
+	return err
+}
+
+// limitListener holds off accepting connections while all slots are taken.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.slots <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
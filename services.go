@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const serviceStartTimeout = 60 * time.Second
+
+type Service struct {
+	Name  string
+	Image string   `ini:"image"`
+	Port  string   `ini:"port"`
+	Env   []string `ini:"env" delim:","`
+}
+
+// RunningService is a started service container, Container being the docker
+// name used for teardown.
+type RunningService struct {
+	Service
+	Container string
+	Host      string
+	HostPort  string
+}
+
+// startServices runs each service as a detached container with its port
+// published on the host, waiting until the port accepts connections. Already
+// started services are returned on failure so the caller can tear them down.
+func startServices(prefix string, services []Service) ([]RunningService, error) {
+	running := make([]RunningService, 0, len(services))
+	for _, service := range services {
+		container := prefix + "-" + service.Name
+		args := []string{"run", "-d", "--rm", "--name", container}
+		for _, env := range service.Env {
+			args = append(args, "-e", strings.TrimSpace(env))
+		}
+		if service.Port != "" {
+			args = append(args, "-p", "127.0.0.1::"+service.Port)
+		}
+		args = append(args, service.Image)
+
+		if out, err := exec.Command("docker", args...).CombinedOutput(); err != nil {
+			return running, errors.Wrapf(err, "could not start service %s, %s", service.Name, bytes.TrimSpace(out))
+		}
+		started := RunningService{
+			Service:   service,
+			Container: container,
+		}
+		running = append(running, started)
+		if service.Port == "" {
+			continue
+		}
+
+		out, err := exec.Command("docker", "port", container, service.Port).Output()
+		if err != nil {
+			return running, errors.Wrapf(err, "could not find port of service %s", service.Name)
+		}
+		host, port, err := net.SplitHostPort(strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0]))
+		if err != nil {
+			return running, errors.Wrapf(err, "unexpected port mapping for service %s", service.Name)
+		}
+		started.Host = host
+		started.HostPort = port
+		running[len(running)-1] = started
+
+		if err := waitForPort(net.JoinHostPort(host, port), serviceStartTimeout); err != nil {
+			return running, errors.Wrapf(err, "service %s never came up", service.Name)
+		}
+	}
+	return running, nil
+}
+
+func waitForPort(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func stopServices(running []RunningService) {
+	for _, service := range running {
+		exec.Command("docker", "rm", "-f", service.Container).Run()
+	}
+}
+
+// serviceEnv exports connection info as <NAME>_HOST and <NAME>_PORT.
+func serviceEnv(running []RunningService) []string {
+	env := make([]string, 0, len(running)*2)
+	for _, service := range running {
+		if service.HostPort == "" {
+			continue
+		}
+		name := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(service.Name))
+		env = append(env, name+"_HOST="+service.Host, name+"_PORT="+service.HostPort)
+	}
+	return env
+}
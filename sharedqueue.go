@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sharedQueueKey   = "spectacle:queue"
+	sharedClaimedKey = "spectacle:claimed"
+	sharedJobsKey    = "spectacle:jobs"
+	sharedQueuedKey  = "spectacle:queued"
+	sharedQueuesKey  = "spectacle:queues"
+	runnersKey       = "spectacle:runners"
+	runnersSeenKey   = "spectacle:runners:seen"
+)
+
+// claimScript moves the oldest queued job to the claimed set, scored by the
+// time its claim expires.
+const claimScript = `
+local key = redis.call('RPOP', KEYS[1])
+if not key then return nil end
+local job = redis.call('HGET', KEYS[3], key)
+if not job then return nil end
+redis.call('ZADD', KEYS[2], ARGV[1], key)
+return job`
+
+// reapScript puts jobs whose claims expired back at the front of the queue
+// they were taken from.
+const reapScript = `
+local keys = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+for _, key in ipairs(keys) do
+	redis.call('ZREM', KEYS[2], key)
+	redis.call('RPUSH', redis.call('HGET', KEYS[3], key) or KEYS[1], key)
+end
+return #keys`
+
+// handBackScript drops a claim and queues the job again at the back of its
+// queue, unless the claim expired and was reaped meanwhile.
+const handBackScript = `
+if redis.call('ZREM', KEYS[2], ARGV[1]) == 0 then return 0 end
+redis.call('LPUSH', KEYS[1], ARGV[1])
+return 1`
+
+// numberScript increments a build counter, first raising it to the latest
+// number in the store so numbers already used are not handed out again.
+const numberScript = `
+if tonumber(redis.call('GET', KEYS[1]) or '0') < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return redis.call('INCR', KEYS[1])`
+
+var sharedQueue *SharedQueue
+
+// SharedQueue keeps queued builds in redis so instances behind a load
+// balancer share them, each claiming jobs while it has idle workers. Claims
+// are renewed while the job runs, so the jobs of a crashed instance are
+// queued again once its claims expire. Builds are numbered in redis too,
+// whichever instance runs a build recording it in its store, which is best
+// shared by all instances.
+//
+// Builds of repos asking for labels wait in a queue of their own, claimed
+// only by instances with runners having those labels, so they neither hold
+// up nor are held up by builds others must run. Instances advertise their
+// labels, builds no live instance could run being refused when queued.
+type SharedQueue struct {
+	sync.Mutex
+	redis      *Redis
+	repos      *RepoSet
+	visibility time.Duration
+	claimed    map[string]bool
+	id         string
+	next       int
+}
+
+func NewSharedQueue(address string, visibility time.Duration, repos *RepoSet) (*SharedQueue, error) {
+	redis, err := NewRedis(address)
+	if err != nil {
+		return nil, err
+	}
+
+	id := *runnerName
+	if id == "" {
+		host, _ := os.Hostname()
+		id = host + ":" + strconv.Itoa(os.Getpid())
+	}
+	q := &SharedQueue{
+		redis:      redis,
+		repos:      repos,
+		visibility: visibility,
+		claimed:    make(map[string]bool),
+		id:         id,
+	}
+	return q, q.advertise()
+}
+
+// labelQueue names the queue of builds asking for labels.
+func labelQueue(labels []string) string {
+	if list := labelList(labelSet(labels)); len(list) > 0 {
+		return sharedQueueKey + ":" + strings.Join(list, ",")
+	}
+	return sharedQueueKey
+}
+
+func queueLabels(queue string) []string {
+	if queue == sharedQueueKey {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(queue, sharedQueueKey+":"), ",")
+}
+
+// runnerSets lists the label sets of this instance's runners, its own
+// workers and each backend.
+func runnerSets() [][]string {
+	sets := [][]string{labelList(localLabels)}
+	for name := range backends {
+		sets = append(sets, labelList(backendLabels[name]))
+	}
+	return sets
+}
+
+func canRun(sets [][]string, labels []string) bool {
+	for _, set := range sets {
+		if hasLabels(labelSet(set), labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// advertise records the labels of this instance's runners until its claims
+// would expire.
+func (q *SharedQueue) advertise() error {
+	raw, _ := json.Marshal(runnerSets())
+	if _, err := q.redis.Do("HSET", runnersKey, q.id, string(raw)); err != nil {
+		return errors.Wrap(err, "could not advertise runner labels")
+	}
+	_, err := q.redis.Do("ZADD", runnersSeenKey, q.deadline(), q.id)
+	return errors.Wrap(err, "could not advertise runner labels")
+}
+
+// matched reports whether a live instance has a runner with labels.
+func (q *SharedQueue) matched(labels []string) (bool, error) {
+	reply, err := q.redis.Do("ZRANGEBYSCORE", runnersSeenKey, strconv.FormatInt(time.Now().Unix(), 10), "+inf")
+	if err != nil {
+		return false, err
+	}
+	ids, _ := reply.([]interface{})
+	for _, id := range ids {
+		reply, err := q.redis.Do("HGET", runnersKey, id.(string))
+		if err != nil {
+			return false, err
+		}
+		raw, _ := reply.(string)
+		sets := [][]string{}
+		if json.Unmarshal([]byte(raw), &sets) == nil && canRun(sets, labels) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (q *SharedQueue) Number(repo string) (int, error) {
+	reply, err := q.redis.Do("EVAL", numberScript, "1", "spectacle:counter:"+repo, strconv.Itoa(store.Last(repo)))
+	if err != nil {
+		return 0, errors.Wrap(err, "could not allocate build number")
+	}
+	number, _ := reply.(int64)
+	return int(number), nil
+}
+
+func (q *SharedQueue) Push(build Build, labels []string) error {
+	if !canRun(runnerSets(), labels) {
+		matched, err := q.matched(labels)
+		if err != nil {
+			return errors.Wrap(err, "could not queue build")
+		} else if !matched {
+			return noRunnerError(labels)
+		}
+	}
+
+	queue := labelQueue(labels)
+	reply, err := q.redis.Do("LLEN", queue)
+	if err != nil {
+		return errors.Wrap(err, "could not queue build")
+	}
+	if length, _ := reply.(int64); int(length) >= *queueSize {
+		return errQueueFull
+	}
+
+	raw, _ := json.Marshal(build)
+	key := jobKey(build.Repo, build.Number)
+	if _, err := q.redis.Do("HSET", sharedJobsKey, key, string(raw)); err != nil {
+		return errors.Wrap(err, "could not queue build")
+	}
+	if _, err := q.redis.Do("HSET", sharedQueuedKey, key, queue); err != nil {
+		return errors.Wrap(err, "could not queue build")
+	}
+	if _, err := q.redis.Do("SADD", sharedQueuesKey, queue); err != nil {
+		return errors.Wrap(err, "could not queue build")
+	}
+	_, err = q.redis.Do("LPUSH", queue, key)
+	return errors.Wrap(err, "could not queue build")
+}
+
+// Remove drops a build still waiting in the queue, reporting false if some
+// instance already claimed it.
+func (q *SharedQueue) Remove(repo string, number int) bool {
+	key := jobKey(repo, number)
+	reply, err := q.redis.Do("HGET", sharedQueuedKey, key)
+	queue, _ := reply.(string)
+	if err != nil || queue == "" {
+		queue = sharedQueueKey
+	}
+	reply, err = q.redis.Do("LREM", queue, "0", key)
+	if removed, _ := reply.(int64); err != nil || removed == 0 {
+		return false
+	}
+	q.redis.Do("HDEL", sharedJobsKey, key)
+	q.redis.Do("HDEL", sharedQueuedKey, key)
+	return true
+}
+
+func (q *SharedQueue) Done(job BuildJob) {
+	key := jobKey(job.Name, job.Build.Number)
+	q.Lock()
+	claimed := q.claimed[key]
+	delete(q.claimed, key)
+	q.Unlock()
+	if !claimed {
+		return
+	}
+
+	if _, err := q.redis.Do("ZREM", sharedClaimedKey, key); err != nil {
+		warnf("queue", "├could not release claim, %s", err.Error())
+	}
+	q.redis.Do("HDEL", sharedJobsKey, key)
+	q.redis.Do("HDEL", sharedQueuedKey, key)
+}
+
+func (q *SharedQueue) deadline() string {
+	return strconv.FormatInt(time.Now().Add(q.visibility).Unix(), 10)
+}
+
+// idle reports whether a local worker would be left waiting.
+func idle() bool {
+	if atomic.LoadInt32(&draining) == 1 {
+		return false
+	}
+	scheduler.Lock()
+	defer scheduler.Unlock()
+
+	busy := len(scheduler.pending)
+	for _, running := range scheduler.running {
+		busy += running
+	}
+	return busy < *workers
+}
+
+// queues lists the queues holding builds some runner of this instance has
+// the labels for.
+func (q *SharedQueue) queues() ([]string, error) {
+	reply, err := q.redis.Do("SMEMBERS", sharedQueuesKey)
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]interface{})
+	queues := []string{sharedQueueKey}
+	sets := runnerSets()
+	for _, member := range members {
+		if queue := member.(string); queue != sharedQueueKey && canRun(sets, queueLabels(queue)) {
+			queues = append(queues, queue)
+		}
+	}
+	sort.Strings(queues[1:])
+	return queues, nil
+}
+
+// claim takes the oldest build off the queues this instance may run, trying
+// them in turn so none is starved by another.
+func (q *SharedQueue) claim() (bool, error) {
+	queues, err := q.queues()
+	if err != nil {
+		return false, err
+	}
+	for range queues {
+		q.next = (q.next + 1) % len(queues)
+		claimed, err := q.claimFrom(queues[q.next])
+		if err != nil || claimed {
+			return claimed, err
+		}
+	}
+	return false, nil
+}
+
+func (q *SharedQueue) claimFrom(queue string) (bool, error) {
+	reply, err := q.redis.Do("EVAL", claimScript, "3", queue, sharedClaimedKey, sharedJobsKey, q.deadline())
+	if err != nil || reply == nil {
+		return false, err
+	}
+	build := Build{}
+	if err := json.Unmarshal([]byte(reply.(string)), &build); err != nil {
+		return false, errors.Wrap(err, "corrupt queued build")
+	}
+	key := jobKey(build.Repo, build.Number)
+
+	repo := q.repos.Find(build.Repo)
+	if repo == nil || !runsHere(newJob(repo, build)) {
+		// Left to other instances, at the back so others behind it are not held up
+		if _, err := q.redis.Do("EVAL", handBackScript, "2", queue, sharedClaimedKey, key); err != nil {
+			warnf("queue", "could not hand back %s, %s\n", key, err.Error())
+		}
+		debugf("queue", "left %s to other runners\n", key)
+		return false, nil
+	}
+
+	q.Lock()
+	q.claimed[key] = true
+	q.Unlock()
+	debugf("queue", "claimed %s\n", key)
+	if err := store.Put(build); err != nil {
+		errorf("queue", "could not record claimed build, %s", err.Error())
+	}
+	return true, queueLocal(newJob(repo, build))
+}
+
+// Run claims jobs for idle workers, renews the claims of running ones and
+// requeues those whose claims expired.
+func (q *SharedQueue) Run() {
+	renew := time.Now()
+	for range time.Tick(time.Second) {
+		if _, err := q.redis.Do("EVAL", reapScript, "3", sharedQueueKey, sharedClaimedKey, sharedQueuedKey, strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+			warnf("queue", "could not requeue expired claims, %s", err.Error())
+		}
+
+		if time.Since(renew) > q.visibility/3 {
+			renew = time.Now()
+			if err := q.advertise(); err != nil {
+				warnf("queue", "%s", err.Error())
+			}
+			q.unmatched()
+			q.Lock()
+			keys := make([]string, 0, len(q.claimed))
+			for key := range q.claimed {
+				keys = append(keys, key)
+			}
+			q.Unlock()
+			for _, key := range keys {
+				if _, err := q.redis.Do("ZADD", sharedClaimedKey, "XX", q.deadline(), key); err != nil {
+					warnf("queue", "could not renew claim of %s, %s", key, err.Error())
+				}
+			}
+		}
+
+		for idle() {
+			claimed, err := q.claim()
+			if err != nil {
+				warnf("queue", "could not claim queued build, %s", err.Error())
+			}
+			if !claimed {
+				break
+			}
+		}
+	}
+}
+
+// unmatched warns of builds waiting for labels no live instance has.
+func (q *SharedQueue) unmatched() {
+	reply, err := q.redis.Do("SMEMBERS", sharedQueuesKey)
+	if err != nil {
+		return
+	}
+	members, _ := reply.([]interface{})
+	for _, member := range members {
+		queue := member.(string)
+		reply, err := q.redis.Do("LLEN", queue)
+		length, _ := reply.(int64)
+		if err != nil || length == 0 {
+			continue
+		}
+		if matched, err := q.matched(queueLabels(queue)); err == nil && !matched {
+			warnf("queue", "%d builds waiting, %s\n", length, noRunnerError(queueLabels(queue)).Error())
+		}
+	}
+}
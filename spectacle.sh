@@ -2,7 +2,9 @@
 go get -u golang.org/x/vgo &> goget.log
 $GOPATH/bin/vgo build -o bin/spectacle &> build.log
 
-pkill spectacle
-cp bin/spectacle $HOME/services/
+cp bin/spectacle $HOME/services/spectacle.new
+mv $HOME/services/spectacle.new $HOME/services/spectacle
 cd $HOME/services
-nohup ./spectacle &> /var/log/spectacle.log &
+if ! pkill -USR2 -x spectacle; then
+	nohup ./spectacle &> /var/log/spectacle.log &
+fi
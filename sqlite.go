@@ -0,0 +1,33 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+// SQLite keeps the database in a file through the pure Go sqlite driver,
+// arguments bound as parameters. Writers wait on each other for up to ten
+// seconds, as other instances may share the file.
+type SQLite struct {
+	db *sql.DB
+}
+
+func NewSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open sqlite database")
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "could not open sqlite database")
+	}
+	return &SQLite{db}, nil
+}
+
+// Query runs query with args bound to $1, $2.., returning its rows with
+// null columns as empty strings.
+func (s *SQLite) Query(query string, args ...string) ([][]string, error) {
+	return queryRows(s.db, query, args)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type sqlDB interface {
+	Query(query string, args ...string) ([][]string, error)
+}
+
+// queryRows runs query on db with args bound as parameters, reading every
+// column as a string, null ones as empty strings.
+func queryRows(db *sql.DB, query string, args []string) ([][]string, error) {
+	params := make([]interface{}, len(args))
+	for i, arg := range args {
+		params[i] = arg
+	}
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][]string, 0, 10)
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(columns))
+		for i, value := range values {
+			row[i] = value.String
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// SQLStore keeps builds and deliveries as json in a database shared by all
+// instances, reading from it on every query. Only the latest keep builds of
+// each repo are kept.
+type SQLStore struct {
+	db   sqlDB
+	keep int
+}
+
+// NewSQLStore creates the store's tables unless they exist, idColumn being
+// the database's notion of an auto incremented key.
+func NewSQLStore(db sqlDB, idColumn string, keep int) (*SQLStore, error) {
+	_, err := db.Query(`CREATE TABLE IF NOT EXISTS builds (
+		repo text NOT NULL,
+		number integer NOT NULL,
+		queued bigint NOT NULL,
+		data text NOT NULL,
+		PRIMARY KEY (repo, number)
+	)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create builds table")
+	}
+	_, err = db.Query(`CREATE TABLE IF NOT EXISTS deliveries (
+		` + idColumn + `,
+		repo text NOT NULL,
+		data text NOT NULL
+	)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create deliveries table")
+	}
+	_, err = db.Query(`CREATE TABLE IF NOT EXISTS payloads (
+		id text PRIMARY KEY,
+		data text NOT NULL
+	)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create payloads table")
+	}
+	return &SQLStore{
+		db:   db,
+		keep: keep,
+	}, nil
+}
+
+// Next numbers the build after the repo's latest, retrying should another
+// instance claim the number first.
+func (s *SQLStore) Next(build Build) (Build, error) {
+	build.Status = "QUEUED"
+	build.Queued = time.Now()
+	numbered := build.Number != 0
+
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		if !numbered {
+			build.Number = s.Last(build.Repo) + 1
+		}
+		raw, _ := json.Marshal(build)
+		_, err = s.db.Query("INSERT INTO builds (repo, number, queued, data) VALUES ($1, $2, $3, $4)",
+			build.Repo, strconv.Itoa(build.Number), strconv.FormatInt(build.Queued.UnixNano(), 10), string(raw))
+		if err == nil || numbered {
+			break
+		}
+	}
+	if err != nil {
+		return build, errors.Wrap(err, "could not write build")
+	}
+	s.prune(build)
+	return build, nil
+}
+
+// prune drops the builds of build's repo that fell out of the kept ones.
+func (s *SQLStore) prune(build Build) {
+	if s.keep <= 0 || build.Number <= s.keep {
+		return
+	}
+	_, err := s.db.Query("DELETE FROM builds WHERE repo = $1 AND number <= $2", build.Repo, strconv.Itoa(build.Number-s.keep))
+	if err != nil {
+		warnf("store", "could not prune builds of %s, %s\n", build.Repo, err.Error())
+	}
+}
+
+func (s *SQLStore) Put(build Build) error {
+	raw, _ := json.Marshal(build)
+	_, err := s.db.Query(`INSERT INTO builds (repo, number, queued, data) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (repo, number) DO UPDATE SET data = excluded.data`,
+		build.Repo, strconv.Itoa(build.Number), strconv.FormatInt(build.Queued.UnixNano(), 10), string(raw))
+	return errors.Wrap(err, "could not write build")
+}
+
+func (s *SQLStore) Update(build Build) error {
+	raw, _ := json.Marshal(build)
+	rows, err := s.db.Query("UPDATE builds SET data = $1 WHERE repo = $2 AND number = $3 RETURNING number",
+		string(raw), build.Repo, strconv.Itoa(build.Number))
+	if err != nil {
+		return errors.Wrap(err, "could not write build")
+	} else if len(rows) == 0 {
+		return errors.Errorf("no build %s#%d", build.Repo, build.Number)
+	}
+	return nil
+}
+
+func (s *SQLStore) Get(repo string, number int) (Build, bool) {
+	builds := s.builds("SELECT data FROM builds WHERE repo = $1 AND number = $2", repo, strconv.Itoa(number))
+	if len(builds) == 0 {
+		return Build{}, false
+	}
+	return builds[0], true
+}
+
+// List returns builds newest first, optionally filtered by repo.
+func (s *SQLStore) List(repo string) []Build {
+	if repo == "" {
+		return s.builds("SELECT data FROM builds ORDER BY queued DESC, number DESC")
+	}
+	return s.builds("SELECT data FROM builds WHERE repo = $1 ORDER BY queued DESC, number DESC", repo)
+}
+
+// Page returns up to limit builds newest first after skipping offset,
+// optionally filtered by repo.
+func (s *SQLStore) Page(repo string, offset, limit int) []Build {
+	page := " LIMIT " + strconv.Itoa(limit) + " OFFSET " + strconv.Itoa(offset)
+	if repo == "" {
+		return s.builds("SELECT data FROM builds ORDER BY queued DESC, number DESC" + page)
+	}
+	return s.builds("SELECT data FROM builds WHERE repo = $1 ORDER BY queued DESC, number DESC"+page, repo)
+}
+
+func (s *SQLStore) Last(repo string) int {
+	rows, err := s.db.Query("SELECT COALESCE(MAX(number), 0) FROM builds WHERE repo = $1", repo)
+	if err != nil || len(rows) == 0 {
+		return 0
+	}
+	number, _ := strconv.Atoi(rows[0][0])
+	return number
+}
+
+func (s *SQLStore) builds(query string, args ...string) []Build {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		warnf("store", "could not read builds, %s\n", err.Error())
+	}
+	builds := make([]Build, 0, len(rows))
+	for _, row := range rows {
+		build := Build{}
+		if err := json.Unmarshal([]byte(row[0]), &build); err != nil {
+			continue
+		}
+		builds = append(builds, build)
+	}
+	return builds
+}
+
+func (s *SQLStore) AddDelivery(delivery Delivery) error {
+	raw, err := json.Marshal(delivery)
+	if err != nil {
+		return errors.Wrap(err, "could not encode delivery")
+	}
+	_, err = s.db.Query("INSERT INTO deliveries (repo, data) VALUES ($1, $2)", delivery.Repo, string(raw))
+	return errors.Wrap(err, "could not write delivery")
+}
+
+// Deliveries returns the latest deliveries newest first, optionally filtered
+// by repo.
+func (s *SQLStore) Deliveries(repo string) []Delivery {
+	query := "SELECT data FROM deliveries ORDER BY id DESC LIMIT " + strconv.Itoa(maxDeliveries)
+	args := []string{}
+	if repo != "" {
+		query = strings.Replace(query, "ORDER", "WHERE repo = $1 ORDER", 1)
+		args = append(args, repo)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		warnf("store", "could not read deliveries, %s\n", err.Error())
+	}
+	deliveries := make([]Delivery, 0, len(rows))
+	for _, row := range rows {
+		delivery := Delivery{}
+		if err := json.Unmarshal([]byte(row[0]), &delivery); err != nil {
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries
+}
+
+func (s *SQLStore) SavePayload(id string, raw []byte) error {
+	_, err := s.db.Query("INSERT INTO payloads (id, data) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING", id, string(raw))
+	return errors.Wrap(err, "could not write payload")
+}
+
+func (s *SQLStore) Payload(id string) ([]byte, error) {
+	rows, err := s.db.Query("SELECT data FROM payloads WHERE id = $1", id)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read payload")
+	} else if len(rows) == 0 {
+		return nil, errors.Errorf("no payload of %s", id)
+	}
+	return []byte(rows[0][0]), nil
+}
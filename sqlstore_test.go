@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLStoreOnSQLite(t *testing.T) {
+	db, err := NewSQLite(filepath.Join(t.TempDir(), "spectacle.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSQLStore(db, "id integer PRIMARY KEY", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		build, err := s.Next(Build{Repo: "it's"})
+		if err != nil {
+			t.Fatal(err)
+		} else if build.Number != i+1 {
+			t.Fatalf("Next numbered build %d, want %d", build.Number, i+1)
+		}
+	}
+	if _, err := s.Next(Build{Repo: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.Last("it's"); got != 5 {
+		t.Errorf("Last = %d, want 5", got)
+	}
+	if got := len(s.List("it's")); got != 3 {
+		t.Errorf("List kept %d builds, want 3", got)
+	}
+	if _, ok := s.Get("it's", 2); ok {
+		t.Errorf("Get found pruned build 2")
+	}
+
+	build, _ := s.Get("it's", 5)
+	build.Status = "SUCCESS"
+	if err := s.Update(build); err != nil {
+		t.Fatal(err)
+	}
+	if build, _ := s.Get("it's", 5); build.Status != "SUCCESS" {
+		t.Errorf("Update left status %s", build.Status)
+	}
+	if err := s.Update(Build{Repo: "it's", Number: 9}); err == nil {
+		t.Errorf("Update of a missing build succeeded")
+	}
+
+	page := s.Page("it's", 1, 1)
+	if len(page) != 1 || page[0].Number != 4 {
+		t.Errorf("Page(1, 1) = %v, want build 4", page)
+	}
+	if got := len(s.Page("", 0, 10)); got != 4 {
+		t.Errorf("Page of all repos = %d builds, want 4", got)
+	}
+
+	if err := s.SavePayload("a", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SavePayload("a", []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	if raw, err := s.Payload("a"); err != nil || string(raw) != "{}" {
+		t.Errorf("Payload = %q, %v, want first payload", raw, err)
+	}
+}
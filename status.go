@@ -0,0 +1,79 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// StatusHandler serves the unauthenticated status page, showing the latest
+// build of the branch of each public repo.
+type StatusHandler struct {
+	Store Store
+	Repos *RepoSet
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>spectacle status</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+td, th { padding: 0.2em 1em; text-align: left; }
+.OK { color: green; } .FAIL { color: red; }
+</style>
+</head>
+<body>
+<h1>status</h1>
+<table>
+<tr><th>repo</th><th>branch</th><th>build</th><th>status</th><th>finished</th></tr>
+{{range .}}<tr>
+<td>{{.Repo.Name}}</td>
+<td>{{.Repo.Branch}}</td>
+{{if .Build}}<td>#{{.Build.Number}}</td>
+<td class="{{.Build.Status}}">{{.Build.Status}}</td>
+<td>{{(.Build.Started.Add .Build.Duration).Format "2006-01-02 15:04"}}</td>{{else}}<td></td><td>none</td><td></td>{{end}}
+</tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+type repoStatus struct {
+	Repo  Repo
+	Build *Build
+}
+
+func (h StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "spectacle")
+
+	statuses := make([]repoStatus, 0, 10)
+	for _, repo := range h.Repos.List() {
+		if !repo.Public {
+			continue
+		}
+		statuses = append(statuses, repoStatus{
+			Repo:  repo,
+			Build: latestBuild(h.Store, repo),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, statuses); err != nil {
+		errorf("http", "could not render status page, %s\n", err.Error())
+	}
+}
+
+// latestBuild is the newest finished build of the repo's branch, pull
+// requests and tags aside.
+func latestBuild(store Store, repo Repo) *Build {
+	for _, build := range store.List(repo.Name) {
+		if build.Branch != repo.Branch || build.Pull > 0 || build.Tag != "" || build.Bisect {
+			continue
+		}
+		if build.Status == "OK" || build.Status == "FAIL" {
+			return &build
+		}
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type StorageConfig struct {
+	Postgres   string `ini:"postgres"`
+	Sqlite     string `ini:"sqlite"`
+	KeepBuilds int    `ini:"keep_builds"`
+}
+
+// Store keeps build history, build numbers and received hooks along with the
+// full payloads of verified ones. Queued and running builds are those not
+// yet given a final status.
+type Store interface {
+	Next(build Build) (Build, error)
+	Put(build Build) error
+	Update(build Build) error
+	Get(repo string, number int) (Build, bool)
+	List(repo string) []Build
+	Page(repo string, offset, limit int) []Build
+	Last(repo string) int
+
+	AddDelivery(delivery Delivery) error
+	Deliveries(repo string) []Delivery
+	SavePayload(id string, raw []byte) error
+	Payload(id string) ([]byte, error)
+}
+
+var store Store
+
+// openStore opens the configured store, the embedded json files unless a
+// database is configured.
+func openStore(config StorageConfig) (Store, error) {
+	if config.KeepBuilds <= 0 {
+		config.KeepBuilds = 1000
+	}
+	if config.Postgres != "" {
+		db, err := NewPostgres(config.Postgres)
+		if err != nil {
+			return nil, err
+		}
+		return NewSQLStore(db, "id bigserial PRIMARY KEY", config.KeepBuilds)
+	}
+	if config.Sqlite != "" {
+		db, err := NewSQLite(config.Sqlite)
+		if err != nil {
+			return nil, err
+		}
+		return NewSQLStore(db, "id integer PRIMARY KEY", config.KeepBuilds)
+	}
+
+	builds, err := OpenBuildStore("spectacle.json", config.KeepBuilds)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := OpenDeliveryStore("deliveries.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	return MemoryStore{builds, deliveries}, nil
+}
+
+// MemoryStore keeps everything in memory, persisted to files.
+type MemoryStore struct {
+	*BuildStore
+	*DeliveryStore
+}
+
+type Build struct {
+	Repo     string        `json:"repo"`
+	Number   int           `json:"number"`
+	Branch   string        `json:"branch"`
+	Tag      string        `json:"tag,omitempty"`
+	Commit   string        `json:"commit"`
+	Merge    string        `json:"merge,omitempty"`
+	Pull     int           `json:"pull_request,omitempty"`
+	Fork     bool          `json:"fork,omitempty"`
+	Bisect   bool          `json:"bisect,omitempty"`
+	Author   string        `json:"author,omitempty"`
+	Backend  string        `json:"backend,omitempty"`
+	Runner   string        `json:"runner,omitempty"`
+	Labels   []string      `json:"labels,omitempty"`
+	Env      []string      `json:"env,omitempty"`
+	Trace    string        `json:"trace,omitempty"`
+	Forced   bool          `json:"forced,omitempty"`
+	Status   string        `json:"status"`
+	Queued   time.Time     `json:"queued"`
+	Started  time.Time     `json:"started,omitempty"`
+	Duration time.Duration `json:"duration"`
+	TimedOut bool          `json:"timed_out,omitempty"`
+	Log      string        `json:"log,omitempty"`
+	Steps    []StepResult  `json:"steps"`
+	Coverage *float64      `json:"coverage,omitempty"`
+	Tests    []TestResult  `json:"tests,omitempty"`
+
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+	FirstBad  string     `json:"first_bad,omitempty"`
+
+	FailedTests   []string             `json:"failed_tests,omitempty"`
+	CompilerCache []CompilerCacheStats `json:"compiler_cache,omitempty"`
+}
+
+// BuildStore keeps build numbers and history, persisted as json on every
+// change so numbers stay monotonic across restarts. While a handed off
+// process drains, both it and its successor use the file, so changes are
+// made to what is on disk under a lock and reads pick up the other's writes.
+// Only the latest keep builds of each repo are kept, as the whole file is
+// rewritten on every change.
+type BuildStore struct {
+	sync.Mutex
+	path     string
+	keep     int
+	modified time.Time
+	size     int64
+
+	Counters map[string]int `json:"counters"`
+	Builds   []Build        `json:"builds"`
+}
+
+func OpenBuildStore(path string, keep int) (*BuildStore, error) {
+	store := &BuildStore{
+		path:     path,
+		keep:     keep,
+		Counters: make(map[string]int),
+		Builds:   make([]Build, 0, 100),
+	}
+
+	if err := store.refresh(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// refresh reloads the file when it was changed since last read.
+func (s *BuildStore) refresh() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "could not read build store")
+	}
+	if info.ModTime().Equal(s.modified) && info.Size() == s.size {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return errors.Wrap(err, "could not read build store")
+	}
+	loaded := BuildStore{
+		Counters: make(map[string]int),
+		Builds:   make([]Build, 0, 100),
+	}
+	if err := json.Unmarshal(raw, &loaded); err != nil {
+		return errors.Wrap(err, "corrupt build store")
+	}
+	s.Counters, s.Builds = loaded.Counters, loaded.Builds
+	s.modified, s.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// change applies change to the store as it is on disk and saves it, holding
+// the lock file so another process can't write in between.
+func (s *BuildStore) change(change func() error) error {
+	lock, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not open build store lock")
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrap(err, "could not lock build store")
+	}
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *BuildStore) save() error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "could not encode build store")
+	}
+	if err := ioutil.WriteFile(s.path+".tmp", raw, 0600); err != nil {
+		return errors.Wrap(err, "could not write build store")
+	}
+	if err := os.Rename(s.path+".tmp", s.path); err != nil {
+		return errors.Wrap(err, "could not replace build store")
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modified, s.size = info.ModTime(), info.Size()
+	}
+	return nil
+}
+
+// Next allocates the next build number for the build's repo, unless it was
+// numbered by the shared queue, and records it as queued.
+func (s *BuildStore) Next(build Build) (Build, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.change(func() error {
+		if build.Number == 0 {
+			s.Counters[build.Repo]++
+			build.Number = s.Counters[build.Repo]
+		} else if build.Number > s.Counters[build.Repo] {
+			s.Counters[build.Repo] = build.Number
+		}
+		build.Status = "QUEUED"
+		build.Queued = time.Now()
+		s.Builds = append(s.Builds, build)
+		s.prune(build.Repo)
+		return nil
+	})
+	return build, err
+}
+
+// prune drops the builds of repo that fell out of the kept ones, its counter
+// staying so numbers aren't reused.
+func (s *BuildStore) prune(repo string) {
+	if s.keep <= 0 || s.Counters[repo] <= s.keep {
+		return
+	}
+	kept := s.Builds[:0]
+	for _, build := range s.Builds {
+		if build.Repo != repo || build.Number > s.Counters[repo]-s.keep {
+			kept = append(kept, build)
+		}
+	}
+	s.Builds = kept
+}
+
+func (s *BuildStore) Update(build Build) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.change(func() error {
+		for i := len(s.Builds) - 1; i >= 0; i-- {
+			if s.Builds[i].Repo == build.Repo && s.Builds[i].Number == build.Number {
+				s.Builds[i] = build
+				return nil
+			}
+		}
+		return errors.Errorf("no build %s#%d", build.Repo, build.Number)
+	})
+}
+
+// Put records a build claimed from the shared queue, which may have been
+// queued by another instance.
+func (s *BuildStore) Put(build Build) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.change(func() error {
+		for i := len(s.Builds) - 1; i >= 0; i-- {
+			if s.Builds[i].Repo == build.Repo && s.Builds[i].Number == build.Number {
+				s.Builds[i] = build
+				return nil
+			}
+		}
+		if build.Number > s.Counters[build.Repo] {
+			s.Counters[build.Repo] = build.Number
+		}
+		s.Builds = append(s.Builds, build)
+		s.prune(build.Repo)
+		return nil
+	})
+}
+
+func (s *BuildStore) Last(repo string) int {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.refresh(); err != nil {
+		warnf("store", "%s\n", err.Error())
+	}
+
+	return s.Counters[repo]
+}
+
+func (s *BuildStore) Get(repo string, number int) (Build, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.refresh(); err != nil {
+		warnf("store", "%s\n", err.Error())
+	}
+
+	for i := len(s.Builds) - 1; i >= 0; i-- {
+		if s.Builds[i].Repo == repo && s.Builds[i].Number == number {
+			return s.Builds[i], true
+		}
+	}
+	return Build{}, false
+}
+
+// List returns builds newest first, optionally filtered by repo.
+func (s *BuildStore) List(repo string) []Build {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.refresh(); err != nil {
+		warnf("store", "%s\n", err.Error())
+	}
+
+	result := make([]Build, 0, len(s.Builds))
+	for i := len(s.Builds) - 1; i >= 0; i-- {
+		if repo == "" || s.Builds[i].Repo == repo {
+			result = append(result, s.Builds[i])
+		}
+	}
+	return result
+}
+
+// Page returns up to limit builds newest first after skipping offset,
+// optionally filtered by repo.
+func (s *BuildStore) Page(repo string, offset, limit int) []Build {
+	builds := s.List(repo)
+	if offset >= len(builds) {
+		return []Build{}
+	}
+	builds = builds[offset:]
+	if len(builds) > limit {
+		builds = builds[:limit]
+	}
+	return builds
+}
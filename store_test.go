@@ -0,0 +1,37 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildStoreKeepsLatestBuilds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spectacle.json")
+	s, err := OpenBuildStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := s.Next(Build{Repo: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Next(Build{Repo: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenBuildStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builds := reopened.List("a")
+	if len(builds) != 2 || builds[0].Number != 4 || builds[1].Number != 3 {
+		t.Errorf("kept builds %v, want 4 and 3", builds)
+	}
+	if got := len(reopened.List("b")); got != 1 {
+		t.Errorf("kept %d builds of b, want 1", got)
+	}
+	if build, err := reopened.Next(Build{Repo: "a"}); err != nil || build.Number != 5 {
+		t.Errorf("Next numbered %d, %v, want 5", build.Number, err)
+	}
+}
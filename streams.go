@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	stdoutTag = "[out] "
+	stderrTag = "[err] "
+)
+
+// streamWriter writes the lines of one of a command's output streams to a
+// log shared with its other stream, each line stamped with the time it was
+// written and how long after start, and tagged with the stream it came
+// from. Partial lines are held back until complete or flushed. With a
+// colored log, lines are stripped of terminal escapes in log and kept as
+// they are in colored.
+type streamWriter struct {
+	mu      *sync.Mutex
+	log     io.Writer
+	colored io.Writer
+	tag     string
+	start   time.Time
+	partial []byte
+}
+
+// tagStreams returns writers for the stdout and stderr of a command logging
+// to log, and colored if not nil, timed from start.
+func tagStreams(log, colored io.Writer, start time.Time) (*streamWriter, *streamWriter) {
+	mu := &sync.Mutex{}
+	return &streamWriter{mu: mu, log: log, colored: colored, tag: stdoutTag, start: start},
+		&streamWriter{mu: mu, log: log, colored: colored, tag: stderrTag, start: start}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := s.line(s.partial[:i+1]); err != nil {
+			return len(p), err
+		}
+		s.partial = s.partial[i+1:]
+	}
+}
+
+func (s *streamWriter) line(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Elapsed time is taken from the monotonic clock, unaffected by the wall
+	// clock being adjusted mid build
+	now := time.Now()
+	stamp := fmt.Sprintf("%s +%s ", now.Format("15:04:05.000"), now.Sub(s.start).Round(time.Millisecond))
+	tagged := append([]byte(stamp+s.tag), line...)
+	if s.colored == nil {
+		_, err := s.log.Write(tagged)
+		return err
+	}
+	if _, err := s.colored.Write(tagged); err != nil {
+		return err
+	}
+	_, err := s.log.Write(stripAnsi(tagged))
+	return err
+}
+
+// Flush writes what is left of an unterminated last line.
+func (s *streamWriter) Flush() error {
+	if len(s.partial) == 0 {
+		return nil
+	}
+	err := s.line(append(s.partial, '\n'))
+	s.partial = nil
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var cacheDir = "/tmp/spectacle-cache"
+
+// EnvTemplate is a named build environment repos opt into with "template",
+// any repo keys in its section serving as defaults for those repos.
+type EnvTemplate struct {
+	Name      string
+	Env       []string      `ini:"env" delim:","`
+	Image     string        `ini:"image"`
+	CacheDirs []string      `ini:"cache_dirs" delim:","`
+	Timeout   time.Duration `ini:"timeout"`
+
+	Defaults Repo `ini:"-"`
+}
+
+// applyTemplate gives steps the template's image and timeout unless they set
+// their own, and adds its env along with cache dirs kept across the repo's
+// builds. Untrusted builds get no cache dirs so they can't poison those of
+// trusted ones.
+func applyTemplate(pipeline *Pipeline, job *BuildJob) error {
+	template := job.Repo.Environment
+	if template == nil {
+		return nil
+	}
+
+	for i := range pipeline.Steps {
+		if pipeline.Steps[i].Image == "" {
+			pipeline.Steps[i].Image = template.Image
+		}
+		if pipeline.Steps[i].Timeout == 0 {
+			pipeline.Steps[i].Timeout = template.Timeout
+		}
+	}
+
+	env := make([]string, 0, len(template.Env)+len(template.CacheDirs))
+	for _, value := range template.Env {
+		env = append(env, strings.TrimSpace(value))
+	}
+	cacheDirs := template.CacheDirs
+	if !trusted(job) {
+		cacheDirs = nil
+	}
+	for _, name := range cacheDirs {
+		name = strings.TrimSpace(name)
+		dir := cacheDir + "/" + template.Name + "/" + workspaceName(job.Repo, job.Name) + "/" + name
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return errors.Wrap(err, "could not create cache dir "+name)
+		}
+		os.Chown(dir, buildUid, buildUid)
+		env = append(env, name+"="+dir)
+		pipeline.Mounts = append(pipeline.Mounts, dir)
+	}
+	pipeline.Env = append(env, pipeline.Env...)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+)
+
+// Tenant groups repos under their own dashboard login and tokens. Users and
+// tokens bound to a tenant only see and act on that tenant's repos.
+type Tenant struct {
+	Name      string
+	User      string   `ini:"user"`
+	Password  string   `ini:"password"`
+	OAuthOrgs []string `ini:"oauth_orgs" delim:","`
+}
+
+// visibleTo reports whether repo belongs to tenant, everything being visible
+// outside of a tenant.
+func visibleTo(repos []Repo, tenant, repo string) bool {
+	if tenant == "" {
+		return true
+	}
+	config := findRepo(repos, repo)
+	return config != nil && config.Tenant == tenant
+}
+
+func tenantBuilds(repos []Repo, tenant string, builds []Build) []Build {
+	result := make([]Build, 0, len(builds))
+	for _, build := range builds {
+		if visibleTo(repos, tenant, build.Repo) {
+			result = append(result, build)
+		}
+	}
+	return result
+}
+
+func tenantDeliveries(repos []Repo, tenant string, deliveries []Delivery) []Delivery {
+	result := make([]Delivery, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		if visibleTo(repos, tenant, delivery.Repo) {
+			result = append(result, delivery)
+		}
+	}
+	return result
+}
+
+func tenantLogin(tenants []Tenant, user, password string) (*Tenant, bool) {
+	for i := range tenants {
+		if tenants[i].User != "" && subtle.ConstantTimeCompare([]byte(user), []byte(tenants[i].User)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(tenants[i].Password)) == 1 {
+			return &tenants[i], true
+		}
+	}
+	return nil, false
+}
+
+// workspaceName prefixes name with the repo's tenant, keeping tenants' files
+// apart on disk.
+func workspaceName(repo Repo, name string) string {
+	name = strings.Replace(name, "/", "-", -1)
+	if repo.Tenant != "" {
+		return repo.Tenant + "-" + name
+	}
+	return name
+}
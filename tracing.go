@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// spans carries ended spans to the exporter, spans being dropped when it
+// falls behind rather than holding up hooks and builds.
+var spans = make(chan *Span, 1000)
+
+// Span is one timed operation of a trace, exported over OTLP when tracing
+// is enabled. Traces cross the queue as W3C traceparent strings.
+type Span struct {
+	trace      string
+	id         string
+	parent     string
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+func randomHex(size int) string {
+	raw := make([]byte, size)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// startSpan starts a span continuing the trace of traceparent, or a new
+// trace when it is empty or malformed.
+func startSpan(traceparent, name string) *Span {
+	return startSpanAt(traceparent, name, time.Now())
+}
+
+func startSpanAt(traceparent, name string, start time.Time) *Span {
+	span := &Span{
+		trace:      randomHex(16),
+		id:         randomHex(8),
+		name:       name,
+		start:      start,
+		attributes: make(map[string]string),
+	}
+	if parts := strings.Split(traceparent, "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		span.trace, span.parent = parts[1], parts[2]
+	}
+	return span
+}
+
+func (s *Span) Child(name string) *Span {
+	return startSpan(s.Traceparent(), name)
+}
+
+func (s *Span) Traceparent() string {
+	return "00-" + s.trace + "-" + s.id + "-01"
+}
+
+func (s *Span) Set(key, value string) {
+	s.attributes[key] = value
+}
+
+func (s *Span) Fail(err error) {
+	s.err = err
+}
+
+func (s *Span) End() {
+	if *otlpEndpoint == "" {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case spans <- s:
+	default:
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId      string          `json:"traceId"`
+	SpanId       string          `json:"spanId"`
+	ParentSpanId string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func (s *Span) otlp() otlpSpan {
+	span := otlpSpan{
+		TraceId:      s.trace,
+		SpanId:       s.id,
+		ParentSpanId: s.parent,
+		Name:         s.name,
+		Kind:         1,
+		Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+		End:          strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:   make([]otlpAttribute, 0, len(s.attributes)),
+	}
+	for key, value := range s.attributes {
+		span.Attributes = append(span.Attributes, otlpAttribute{Key: key, Value: otlpValue{value}})
+	}
+	if s.err != nil {
+		span.Status.Code = 2
+		span.Status.Message = s.err.Error()
+	}
+	return span
+}
+
+// exportSpans sends ended spans to the OTLP/HTTP collector in batches, as
+// json so no protobuf is needed.
+func exportSpans(endpoint string) {
+	batch := make([]otlpSpan, 0, 100)
+	flush := time.NewTicker(5 * time.Second)
+	for {
+		select {
+		case span := <-spans:
+			batch = append(batch, span.otlp())
+			if len(batch) < cap(batch) {
+				continue
+			}
+		case <-flush.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := postSpans(endpoint, batch); err != nil {
+			warnf("daemon", "could not export spans, %s\n", err.Error())
+		}
+		batch = batch[:0]
+	}
+}
+
+// postSpans sends a batch of spans to the collector's traces endpoint.
+func postSpans(endpoint string, batch []otlpSpan) error {
+	raw, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue{"spectacle"}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "spectacle"},
+				"spans": batch,
+			}},
+		}},
+	})
+	res, err := notifyClient.Post(strings.TrimSuffix(endpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
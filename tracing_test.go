@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestStartSpanContinuesTraceparent(t *testing.T) {
+	span := startSpan("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "hook")
+	if span.trace != "4bf92f3577b34da6a3ce929d0e0e4736" || span.parent != "00f067aa0ba902b7" {
+		t.Errorf("span of trace %s parent %s", span.trace, span.parent)
+	}
+	child := span.Child("build")
+	if child.trace != span.trace || child.parent != span.id || child.id == span.id {
+		t.Errorf("child of trace %s parent %s id %s", child.trace, child.parent, child.id)
+	}
+
+	for _, traceparent := range []string{"", "00-abc-def-01", "garbage"} {
+		span := startSpan(traceparent, "hook")
+		if len(span.trace) != 32 || len(span.id) != 16 || span.parent != "" {
+			t.Errorf("span of %q has trace %s id %s parent %s", traceparent, span.trace, span.id, span.parent)
+		}
+	}
+}
+
+func TestPostSpansAsOtlpJson(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer server.Close()
+
+	start := time.Unix(1, 0)
+	batch := []otlpSpan{}
+	for i := 0; i < 2; i++ {
+		span := startSpanAt("", "build", start)
+		span.Set("repo", "perlw/spectacle")
+		span.Fail(errors.New("exit status 1"))
+		span.end = start.Add(time.Second)
+		batch = append(batch, span.otlp())
+	}
+	if err := postSpans(server.URL+"/", batch); err != nil {
+		t.Fatal(err)
+	}
+
+	body := <-received
+	resource := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	exported := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	if len(exported) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(exported))
+	}
+	span := exported[0].(map[string]interface{})
+	if span["name"] != "build" || span["startTimeUnixNano"] != "1000000000" || span["endTimeUnixNano"] != "2000000000" || span["kind"] != 1.0 {
+		t.Errorf("exported span %v", span)
+	}
+	status := span["status"].(map[string]interface{})
+	if status["code"] != 2.0 || status["message"] != "exit status 1" {
+		t.Errorf("exported status %v", status)
+	}
+	attribute := span["attributes"].([]interface{})[0].(map[string]interface{})
+	if attribute["key"] != "repo" || attribute["value"].(map[string]interface{})["stringValue"] != "perlw/spectacle" {
+		t.Errorf("exported attribute %v", attribute)
+	}
+}
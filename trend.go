@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// trendWindow is how many of the latest successful builds the median
+// duration is taken over.
+const trendWindow = 20
+
+// medianDuration is the median duration of the latest successful builds
+// before number, zero when there are none.
+func medianDuration(history []Build, number int) time.Duration {
+	durations := make([]time.Duration, 0, trendWindow)
+	for _, build := range history {
+		if build.Number < number && build.Status == "OK" {
+			durations = append(durations, build.Duration)
+			if len(durations) == trendWindow {
+				break
+			}
+		}
+	}
+	if len(durations) == 0 {
+		return 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2]
+}
+
+// checkDuration notifies when a successful build took more than the repo's
+// duration_alert percent longer than the median.
+func checkDuration(job *BuildJob) {
+	if job.Repo.DurationAlert <= 0 || job.Build.Status != "OK" {
+		return
+	}
+	median := medianDuration(store.List(job.Name), job.Build.Number)
+	if median == 0 || job.Build.Duration <= median+median*time.Duration(job.Repo.DurationAlert)/100 {
+		return
+	}
+
+	notify(job.Repo, fmt.Sprintf("%s build #%d on %s took %.0fs, %d%% over the median of %.0fs",
+		job.Name, job.Build.Number, job.Branch, job.Build.Duration.Seconds(),
+		int(100*(job.Build.Duration-median)/median), median.Seconds()))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// downloadClient fetches release binaries, which may take longer than the
+// notify client's timeout allows, so only waiting for headers is bounded.
+var downloadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// Release is what the release endpoint answers, binaries keyed by os/arch.
+type Release struct {
+	Version  string                   `json:"version"`
+	Binaries map[string]ReleaseBinary `json:"binaries"`
+}
+
+// ReleaseBinary is signed over its release, so a signature can't be replayed
+// for another version or platform. The signed message is the version, os/arch
+// and hex sha256 each on a line of their own, as in "1.4.0\nlinux/amd64\n<sha256>\n".
+type ReleaseBinary struct {
+	Url       string `json:"url"`
+	Sha256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// releaseMessage is what the signature of binary for platform in version
+// covers.
+func releaseMessage(version, platform string, binary ReleaseBinary) []byte {
+	return []byte(version + "\n" + platform + "\n" + binary.Sha256 + "\n")
+}
+
+// newerVersion reports whether the semver release is newer than current,
+// dev builds taking any release.
+func newerVersion(release, current string) (bool, error) {
+	next := semverTag.FindStringSubmatch(release)
+	if next == nil {
+		return false, errors.Errorf("release version %s is not semver", release)
+	}
+	if current == "dev" {
+		return true, nil
+	}
+	now := semverTag.FindStringSubmatch(current)
+	if now == nil {
+		return false, errors.Errorf("current version %s is not semver", current)
+	}
+	for i := 1; i <= 3; i++ {
+		a, _ := strconv.Atoi(next[i])
+		b, _ := strconv.Atoi(now[i])
+		if a != b {
+			return a > b, nil
+		}
+	}
+	// Pre-releases come before their release
+	if next[4] == "" || now[4] == "" {
+		return next[4] == "" && now[4] != "", nil
+	}
+	return next[4] > now[4], nil
+}
+
+// upgrade replaces the running binary with the latest release when it
+// differs, then has the spectacle with the given pid hand over to it.
+func upgrade(config ServerConfig, pid int) error {
+	if config.ReleaseUrl == "" {
+		return errors.New("upgrade needs release_url")
+	}
+	if config.ReleaseKey == "" && !config.ReleaseInsecure {
+		return errors.New("upgrade needs release_key to check signatures, or release_insecure=true to skip them")
+	}
+	res, err := notifyClient.Get(config.ReleaseUrl)
+	if err != nil {
+		return errors.Wrap(err, "could not check release")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return errors.Errorf("release endpoint answered %s", res.Status)
+	}
+	release := Release{}
+	if err := json.NewDecoder(res.Body).Decode(&release); err != nil {
+		return errors.Wrap(err, "malformed release")
+	}
+	if newer, err := newerVersion(release.Version, version); err != nil {
+		return err
+	} else if !newer {
+		infof("daemon", "already at %s, release is %s\n", version, release.Version)
+		return nil
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	binary, ok := release.Binaries[platform]
+	if !ok {
+		return errors.Errorf("release %s has no %s/%s binary", release.Version, runtime.GOOS, runtime.GOARCH)
+	}
+
+	current, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "could not find binary")
+	}
+	current, _ = filepath.EvalSymlinks(current)
+	infof("daemon", "upgrading %s to %s\n", version, release.Version)
+	tmp, err := ioutil.TempFile(filepath.Dir(current), ".spectacle-upgrade")
+	if err != nil {
+		return errors.Wrap(err, "could not create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	sum, err := download(binary.Url, tmp)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	if err := verifyRelease(config.ReleaseKey, releaseMessage(release.Version, platform, binary), binary, sum); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return errors.Wrap(err, "could not make binary executable")
+	}
+	if err := os.Rename(tmp.Name(), current); err != nil {
+		return errors.Wrap(err, "could not replace binary")
+	}
+	infof("daemon", "replaced %s\n", current)
+
+	if pid == 0 {
+		infof("daemon", "no pid given, send SIGUSR2 to the running spectacle to switch over\n")
+		return nil
+	}
+	if err := syscall.Kill(pid, syscall.SIGUSR2); err != nil {
+		return errors.Wrap(err, "could not signal "+strconv.Itoa(pid))
+	}
+	infof("daemon", "asked %d to hand over\n", pid)
+	return nil
+}
+
+// download writes the body at url to w, returning its sha256.
+func download(url string, w io.Writer) ([]byte, error) {
+	res, err := downloadClient.Get(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not download binary")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, errors.Errorf("binary download answered %s", res.Status)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), res.Body); err != nil {
+		return nil, errors.Wrap(err, "could not download binary")
+	}
+	return hash.Sum(nil), nil
+}
+
+// verifyRelease checks the binary's checksum and, with a release key, the
+// signature over message naming its version, platform and checksum.
+func verifyRelease(keyFile string, message []byte, binary ReleaseBinary, sum []byte) error {
+	if binary.Sha256 != hex.EncodeToString(sum) {
+		return errors.New("checksum mismatch")
+	}
+	if keyFile == "" {
+		warnf("daemon", "release_insecure, signature not checked\n")
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not read release key")
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return errors.New("release key is not pem")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return errors.Wrap(err, "could not parse release key")
+	}
+	digest := sha256.Sum256(message)
+	signature, err := base64.StdEncoding.DecodeString(binary.Signature)
+	if err != nil || len(signature) == 0 {
+		return errors.New("release is not signed")
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			err = errors.New("verification failed")
+		}
+	default:
+		err = errors.New("unsupported key type")
+	}
+	if err != nil {
+		return errors.Wrap(err, "bad release signature")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewerVersion(t *testing.T) {
+	tests := []struct {
+		release string
+		current string
+		want    bool
+		err     bool
+	}{
+		{"1.2.4", "1.2.3", true, false},
+		{"v1.3.0", "1.2.9", true, false},
+		{"2.0.0", "1.10.10", true, false},
+		{"1.10.0", "1.9.0", true, false},
+		{"1.2.3", "1.2.3", false, false},
+		{"1.2.2", "1.2.3", false, false},
+		{"0.9.0", "1.0.0", false, false},
+		{"1.2.3", "1.2.3-rc.1", true, false},
+		{"1.2.3-rc.1", "1.2.3", false, false},
+		{"1.2.3-rc.2", "1.2.3-rc.1", true, false},
+		{"1.0.0", "dev", true, false},
+		{"latest", "1.0.0", false, true},
+		{"1.0.0", "nightly", false, true},
+	}
+	for _, test := range tests {
+		got, err := newerVersion(test.release, test.current)
+		if (err != nil) != test.err {
+			t.Errorf("newerVersion(%q, %q) error = %v, want error %v", test.release, test.current, err, test.err)
+		} else if got != test.want {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", test.release, test.current, got, test.want)
+		}
+	}
+}
+
+func TestVerifyRelease(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	keyFile := filepath.Join(t.TempDir(), "release.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("binary"))
+	binary := ReleaseBinary{Sha256: hex.EncodeToString(sum[:])}
+	digest := sha256.Sum256(releaseMessage("1.4.0", "linux/amd64", binary))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.Signature = base64.StdEncoding.EncodeToString(signature)
+	other := sha256.Sum256([]byte("other"))
+
+	tests := []struct {
+		name     string
+		version  string
+		platform string
+		sum      []byte
+		ok       bool
+	}{
+		{"signed release", "1.4.0", "linux/amd64", sum[:], true},
+		{"other version", "1.3.0", "linux/amd64", sum[:], false},
+		{"other platform", "1.4.0", "darwin/arm64", sum[:], false},
+		{"other binary", "1.4.0", "linux/amd64", other[:], false},
+	}
+	for _, test := range tests {
+		err := verifyRelease(keyFile, releaseMessage(test.version, test.platform, binary), binary, test.sum)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: verifyRelease error = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
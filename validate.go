@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var commitSha = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// validatePayload lists what is missing from a hook's payload for its event,
+// only checked in strict mode.
+func validatePayload(event string, payload GithubPayload) []string {
+	problems := []string{}
+	switch event {
+	case "ping", "watch":
+	case "push":
+		if !strings.HasPrefix(payload.Ref, "refs/") {
+			problems = append(problems, "ref is missing or not a full ref")
+		}
+		if !payload.Deleted && !commitSha.MatchString(payload.After) {
+			problems = append(problems, "after is missing or not a commit sha")
+		}
+	case "pull_request":
+		if payload.Action == "" {
+			problems = append(problems, "action is missing")
+		}
+		if payload.Number <= 0 {
+			problems = append(problems, "number is missing")
+		}
+		if payload.PullRequest.Head.Ref == "" {
+			problems = append(problems, "pull_request.head.ref is missing")
+		}
+		if !commitSha.MatchString(payload.PullRequest.Head.Sha) {
+			problems = append(problems, "pull_request.head.sha is missing or not a commit sha")
+		}
+		if payload.PullRequest.Base.Ref == "" {
+			problems = append(problems, "pull_request.base.ref is missing")
+		}
+	case "issue_comment":
+		if payload.Issue.Number <= 0 {
+			problems = append(problems, "issue.number is missing")
+		}
+	case "":
+		problems = append(problems, "X-GitHub-Event header is missing")
+	default:
+		problems = append(problems, "unknown event "+event)
+	}
+	return problems
+}
+
+// badRequest answers a hook that can't be handled, explaining why in strict
+// mode to aid setting up the hook.
+func badRequest(w http.ResponseWriter, strict bool, problems ...string) {
+	if !strict {
+		http.Error(w, "400 bad request", http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "400 bad request\n"+strings.Join(problems, "\n"), http.StatusBadRequest)
+}
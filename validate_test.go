@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidatePayload(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	push := GithubPayload{Ref: "refs/heads/main", After: sha}
+	deleted := GithubPayload{Ref: "refs/heads/gone", Deleted: true}
+	pull := GithubPayload{Action: "opened", Number: 4}
+	pull.PullRequest.Head.Ref = "feature"
+	pull.PullRequest.Head.Sha = sha
+	pull.PullRequest.Base.Ref = "main"
+	comment := GithubPayload{}
+	comment.Issue.Number = 4
+
+	tests := []struct {
+		event   string
+		payload GithubPayload
+		want    []string
+	}{
+		{"ping", GithubPayload{}, []string{}},
+		{"watch", GithubPayload{}, []string{}},
+		{"push", push, []string{}},
+		{"push", deleted, []string{}},
+		{"push", GithubPayload{Ref: "main", After: "abc"}, []string{"ref is missing or not a full ref", "after is missing or not a commit sha"}},
+		{"push", GithubPayload{Ref: "refs/heads/main", After: "0123456789ABCDEF0123456789ABCDEF01234567"}, []string{"after is missing or not a commit sha"}},
+		{"pull_request", pull, []string{}},
+		{"pull_request", GithubPayload{}, []string{
+			"action is missing",
+			"number is missing",
+			"pull_request.head.ref is missing",
+			"pull_request.head.sha is missing or not a commit sha",
+			"pull_request.base.ref is missing",
+		}},
+		{"issue_comment", comment, []string{}},
+		{"issue_comment", GithubPayload{}, []string{"issue.number is missing"}},
+		{"", GithubPayload{}, []string{"X-GitHub-Event header is missing"}},
+		{"deployment", GithubPayload{}, []string{"unknown event deployment"}},
+	}
+	for _, test := range tests {
+		if got := validatePayload(test.event, test.payload); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("validatePayload(%q, %+v) = %q, want %q", test.event, test.payload, got, test.want)
+		}
+	}
+}
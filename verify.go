@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// verifyCommit checks the signature of the build's commit, either through
+// GitHub's verification of it or locally against the repo's keyring.
+func verifyCommit(job *BuildJob, buildPath string) error {
+	switch job.Repo.VerifyCommits {
+	case "":
+		return nil
+	case "api":
+		if job.token == "" {
+			return errors.New("no token to look up commit verification")
+		}
+		commit := struct {
+			Commit struct {
+				Verification struct {
+					Verified bool   `json:"verified"`
+					Reason   string `json:"reason"`
+				} `json:"verification"`
+			} `json:"commit"`
+		}{}
+		if err := githubGet(job.token, "/repos/"+job.Name+"/commits/"+job.Build.Commit, &commit); err != nil {
+			return errors.Wrap(err, "could not look up commit")
+		}
+		if !commit.Commit.Verification.Verified {
+			return errors.Errorf("commit signature not verified, %s", commit.Commit.Verification.Reason)
+		}
+		return nil
+	case "git":
+		return gitVerify(job.Repo, buildPath, "verify-commit", job.Build.Commit)
+	default:
+		return errors.Errorf("unknown verify_commits mode %q", job.Repo.VerifyCommits)
+	}
+}
+
+// verifyTag checks that a release build's tag is signed by a key in the
+// repo's keyring or allowed signers.
+func verifyTag(job *BuildJob, buildPath string) error {
+	if job.Build.Tag == "" || !job.Repo.VerifyTags {
+		return nil
+	}
+	return gitVerify(job.Repo, buildPath, "verify-tag", job.Build.Tag)
+}
+
+// gitVerify runs a git verify-* command against the repo's gpg keyring or
+// ssh allowed signers.
+func gitVerify(repo Repo, buildPath string, command, object string) error {
+	args := []string{"-C", buildPath}
+	if repo.AllowedSigners != "" {
+		args = append(args, "-c", "gpg.ssh.allowedSignersFile="+repo.AllowedSigners)
+	}
+	args = append(args, command, object)
+
+	cmd := exec.Command("git", args...)
+	if repo.Keyring != "" {
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+repo.Keyring)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "%s failed, %s", command, bytes.TrimSpace(out))
+	}
+	return nil
+}